@@ -18,6 +18,7 @@ import (
 // The DefaultApiRouter implementation should parse necessary information from the http request,
 // pass the data to a DefaultApiServicer to perform the required actions, then write the service results to the http response.
 type DefaultApiRouter interface {
+	DownloadsDownloadIdDelete(http.ResponseWriter, *http.Request)
 	DownloadsDownloadIdGet(http.ResponseWriter, *http.Request)
 	DownloadsDownloadIdPatch(http.ResponseWriter, *http.Request)
 	DownloadsGet(http.ResponseWriter, *http.Request)
@@ -29,8 +30,9 @@ type DefaultApiRouter interface {
 // while the service implementation can be ignored with the .openapi-generator-ignore file
 // and updated with the logic required for the API.
 type DefaultApiServicer interface {
+	DownloadsDownloadIdDelete(context.Context, string, bool) (ImplResponse, error)
 	DownloadsDownloadIdGet(context.Context, string) (ImplResponse, error)
 	DownloadsDownloadIdPatch(context.Context, string, DownloadUpdate) (ImplResponse, error)
-	DownloadsGet(context.Context) (ImplResponse, error)
+	DownloadsGet(context.Context, string, string, string, string, []string, string, int32, string) (ImplResponse, error)
 	DownloadsPost(context.Context, DownloadRequest) (ImplResponse, error)
 }
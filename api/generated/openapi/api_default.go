@@ -50,6 +50,12 @@ func NewDefaultApiController(s DefaultApiServicer, opts ...DefaultApiOption) Rou
 // Routes returns all the api routes for the DefaultApiController
 func (c *DefaultApiController) Routes() Routes {
 	return Routes{
+		{
+			"DownloadsDownloadIdDelete",
+			strings.ToUpper("Delete"),
+			"/v1/downloads/{downloadId}",
+			c.DownloadsDownloadIdDelete,
+		},
 		{
 			"DownloadsDownloadIdGet",
 			strings.ToUpper("Get"),
@@ -77,6 +83,27 @@ func (c *DefaultApiController) Routes() Routes {
 	}
 }
 
+// DownloadsDownloadIdDelete - Delete a download
+func (c *DefaultApiController) DownloadsDownloadIdDelete(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	query := r.URL.Query()
+	downloadIdParam := params["downloadId"]
+	keepFileParam, err := parseBoolParameter(query.Get("keepFile"), false)
+	if err != nil {
+		c.errorHandler(w, r, &ParsingError{Err: err}, nil)
+		return
+	}
+	result, err := c.service.DownloadsDownloadIdDelete(r.Context(), downloadIdParam, keepFileParam)
+	// If an error occurred, encode the error with the status code
+	if err != nil {
+		c.errorHandler(w, r, err, &result)
+		return
+	}
+	// If no error, encode the body and the result code
+	EncodeJSONResponse(result.Body, &result.Code, result.Headers, w)
+
+}
+
 // DownloadsDownloadIdGet - Get the current status of a download
 func (c *DefaultApiController) DownloadsDownloadIdGet(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
@@ -88,7 +115,7 @@ func (c *DefaultApiController) DownloadsDownloadIdGet(w http.ResponseWriter, r *
 		return
 	}
 	// If no error, encode the body and the result code
-	EncodeJSONResponse(result.Body, &result.Code, w)
+	EncodeJSONResponse(result.Body, &result.Code, result.Headers, w)
 
 }
 
@@ -114,20 +141,33 @@ func (c *DefaultApiController) DownloadsDownloadIdPatch(w http.ResponseWriter, r
 		return
 	}
 	// If no error, encode the body and the result code
-	EncodeJSONResponse(result.Body, &result.Code, w)
+	EncodeJSONResponse(result.Body, &result.Code, result.Headers, w)
 
 }
 
 // DownloadsGet - List all ongoing downloads
 func (c *DefaultApiController) DownloadsGet(w http.ResponseWriter, r *http.Request) {
-	result, err := c.service.DownloadsGet(r.Context())
+	query := r.URL.Query()
+	statusParam := query.Get("status")
+	urlParam := query.Get("url")
+	sinceParam := query.Get("since")
+	untilParam := query.Get("until")
+	labelParam := query["label"]
+	sortParam := query.Get("sort")
+	limitParam, err := parseInt32Parameter(query.Get("limit"), false)
+	if err != nil {
+		c.errorHandler(w, r, &ParsingError{Err: err}, nil)
+		return
+	}
+	cursorParam := query.Get("cursor")
+	result, err := c.service.DownloadsGet(r.Context(), statusParam, urlParam, sinceParam, untilParam, labelParam, sortParam, limitParam, cursorParam)
 	// If an error occurred, encode the error with the status code
 	if err != nil {
 		c.errorHandler(w, r, err, &result)
 		return
 	}
 	// If no error, encode the body and the result code
-	EncodeJSONResponse(result.Body, &result.Code, w)
+	EncodeJSONResponse(result.Body, &result.Code, result.Headers, w)
 
 }
 
@@ -151,6 +191,6 @@ func (c *DefaultApiController) DownloadsPost(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	// If no error, encode the body and the result code
-	EncodeJSONResponse(result.Body, &result.Code, w)
+	EncodeJSONResponse(result.Body, &result.Code, result.Headers, w)
 
 }
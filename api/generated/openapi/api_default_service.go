@@ -26,6 +26,23 @@ func NewDefaultApiService() DefaultApiServicer {
 	return &DefaultApiService{}
 }
 
+// DownloadsDownloadIdDelete - Delete a download
+func (s *DefaultApiService) DownloadsDownloadIdDelete(ctx context.Context, downloadId string, keepFile bool) (ImplResponse, error) {
+	// TODO - update DownloadsDownloadIdDelete with the required logic for this service method.
+	// Add api_default_service.go to the .openapi-generator-ignore to avoid overwriting this service implementation when updating open api generation.
+
+	//TODO: Uncomment the next line to return response Response(204, {}) or use other options such as http.Ok ...
+	//return Response(204, nil),nil
+
+	//TODO: Uncomment the next line to return response Response(404, Error{}) or use other options such as http.Ok ...
+	//return Response(404, Error{}), nil
+
+	//TODO: Uncomment the next line to return response Response(429, Error{}) or use other options such as http.Ok ...
+	//return Response(429, Error{}), nil
+
+	return Response(http.StatusNotImplemented, nil), errors.New("DownloadsDownloadIdDelete method not implemented")
+}
+
 // DownloadsDownloadIdGet - Get the current status of a download
 func (s *DefaultApiService) DownloadsDownloadIdGet(ctx context.Context, downloadId string) (ImplResponse, error) {
 	// TODO - update DownloadsDownloadIdGet with the required logic for this service method.
@@ -64,7 +81,7 @@ func (s *DefaultApiService) DownloadsDownloadIdPatch(ctx context.Context, downlo
 }
 
 // DownloadsGet - List all ongoing downloads
-func (s *DefaultApiService) DownloadsGet(ctx context.Context) (ImplResponse, error) {
+func (s *DefaultApiService) DownloadsGet(ctx context.Context, status string, url string, since string, until string, label []string, sort string, limit int32, cursor string) (ImplResponse, error) {
 	// TODO - update DownloadsGet with the required logic for this service method.
 	// Add api_default_service.go to the .openapi-generator-ignore to avoid overwriting this service implementation when updating open api generation.
 
@@ -16,8 +16,18 @@ import (
 // Response return a ImplResponse struct filled
 func Response(code int, body interface{}) ImplResponse {
 	return ImplResponse{
-		Code: code,
-		Body: body,
+		Code:    code,
+		Headers: nil,
+		Body:    body,
+	}
+}
+
+// ResponseWithHeaders return a ImplResponse struct filled, including headers
+func ResponseWithHeaders(code int, headers map[string][]string, body interface{}) ImplResponse {
+	return ImplResponse{
+		Code:    code,
+		Headers: headers,
+		Body:    body,
 	}
 }
 
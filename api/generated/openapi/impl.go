@@ -9,8 +9,9 @@
 
 package openapi
 
-// ImplResponse response defines an error code with the associated body
+// ImplResponse defines an implementation response with error code, headers and the associated body
 type ImplResponse struct {
-	Code int
-	Body interface{}
+	Code    int
+	Headers map[string][]string
+	Body    interface{}
 }
@@ -13,6 +13,9 @@ type DownloadRequest struct {
 
 	// The URL of the artefact to be downloaded
 	Url string `json:"url"`
+
+	// Free form labels to filter downloads by
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // AssertDownloadRequestRequired checks if the required fields are not zero-ed
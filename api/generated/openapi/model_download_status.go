@@ -9,6 +9,10 @@
 
 package openapi
 
+import (
+	"time"
+)
+
 type DownloadStatus struct {
 
 	// The ID of the download
@@ -18,19 +22,25 @@ type DownloadStatus struct {
 	Url string `json:"url,omitempty"`
 
 	// The number of bytes that have been downloaded so far
-	BytesDownloaded int32 `json:"bytesDownloaded,omitempty"`
+	BytesDownloaded int64 `json:"bytesDownloaded,omitempty"`
 
-	// The total size of the artefact being downloaded
-	TotalSize int32 `json:"totalSize,omitempty"`
+	// The total size of the artefact being downloaded, 0 if the origin did not say
+	TotalSize int64 `json:"totalSize,omitempty"`
 
 	// The current status of the download
 	Status string `json:"status,omitempty"`
 
-	// The number of milliseconds that have elapsed since the download started
+	// The number of milliseconds the fragments have been downloading
 	ElapsedMS int64 `json:"elapsedMS,omitempty"`
 
 	// The percentage of the download that has been completed, if known
 	Progress int `json:"progress,omitempty"`
+
+	// When the download was requested
+	StartTime time.Time `json:"startTime,omitempty"`
+
+	// The labels of the download request
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // AssertDownloadStatusRequired checks if the required fields are not zero-ed
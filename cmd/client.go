@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codejago/polypully/downloader/cmd/options"
+	"github.com/codejago/polypully/downloader/pkg/client"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// ClientCmd groups the commands that operate a running service
+// through its REST API
+func ClientCmd() *cobra.Command {
+	o := &options.ClientOptions{}
+	cmd := &cobra.Command{
+		Use:   "client",
+		Short: "operate a running downloader service",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if o.Output != "table" && o.Output != "json" {
+				return fmt.Errorf("invalid output %q, expected table or json", o.Output)
+			}
+			argumentsChecked(cmd)
+			return nil
+		},
+	}
+	o.AddFlags(cmd, viper.GetViper())
+	cmd.AddCommand(addCmd(o))
+	cmd.AddCommand(listCmd(o))
+	cmd.AddCommand(statusCmd(o))
+	for _, action := range []string{"pause", "resume", "cancel"} {
+		cmd.AddCommand(updateCmd(o, action))
+	}
+	cmd.AddCommand(deleteCmd())
+	cmd.AddCommand(watchCmd(o))
+	return cmd
+}
+
+func newClient() (client.ClientApi, error) {
+	return client.NewClient(&client.ClientConfig{
+		Address: viper.GetString("client.address"),
+		Timeout: viper.GetDuration("client.timeout")})
+}
+
+func addCmd(o *options.ClientOptions) *cobra.Command {
+	var labels []string
+	cmd := &cobra.Command{
+		Use:   "add <url>",
+		Short: "request a download",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			parsed, err := parseLabels(labels)
+			if err != nil {
+				return err
+			}
+			request := &client.DownloadRequest{Url: args[0], Labels: parsed}
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			status, err := c.Add(cmd.Context(), request)
+			if err != nil {
+				return err
+			}
+			if o.Output == "json" {
+				return printJson(cmd.OutOrStdout(), status)
+			}
+			return printDownloads(cmd.OutOrStdout(), o, *status)
+		},
+	}
+	cmd.Flags().StringSliceVarP(&labels, "label", "l", nil, "key:value label, repeat or separate with commas")
+	return cmd
+}
+
+func parseLabels(labels []string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, l := range labels {
+		k, v, ok := strings.Cut(l, ":")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key:value", l)
+		}
+		parsed[k] = v
+	}
+	return parsed, nil
+}
+
+func listCmd(o *options.ClientOptions) *cobra.Command {
+	var since, until string
+	var labels []string
+	var all bool
+	options := &client.ListOptions{}
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "list downloads, newest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if options.Labels, err = parseLabels(labels); err != nil {
+				return err
+			}
+			if options.Since, err = parseTime(since); err != nil {
+				return err
+			}
+			if options.Until, err = parseTime(until); err != nil {
+				return err
+			}
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			downloads := make([]client.DownloadStatus, 0)
+			for {
+				page, err := c.List(cmd.Context(), options)
+				if err != nil {
+					return err
+				}
+				downloads = append(downloads, page.Downloads...)
+				if !all || page.Next == "" {
+					break
+				}
+				options.Cursor = page.Next
+			}
+			return printDownloads(cmd.OutOrStdout(), o, downloads...)
+		},
+	}
+	cmd.Flags().StringVar(&options.Status, "status", "", "only downloads in this status")
+	cmd.Flags().StringVar(&options.UrlPrefix, "url", "", "only downloads whose url starts with this")
+	cmd.Flags().StringVar(&since, "since", "", "only downloads started at or after this RFC 3339 time")
+	cmd.Flags().StringVar(&until, "until", "", "only downloads started before this RFC 3339 time")
+	cmd.Flags().StringSliceVarP(&labels, "label", "l", nil, "only downloads with these key:value labels")
+	cmd.Flags().BoolVar(&options.Oldest, "oldest", false, "oldest first")
+	cmd.Flags().IntVar(&options.Limit, "limit", 0, "page size, 100 by default")
+	cmd.Flags().BoolVar(&all, "all", false, "follow the pages to the end")
+	return cmd
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func statusCmd(o *options.ClientOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status <id>...",
+		Short: "show the status of downloads",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			downloads, err := getDownloads(cmd.Context(), c, args)
+			if err != nil {
+				return err
+			}
+			return printDownloads(cmd.OutOrStdout(), o, downloads...)
+		},
+	}
+}
+
+func getDownloads(ctx context.Context, c client.ClientApi, ids []string) ([]client.DownloadStatus, error) {
+	downloads := make([]client.DownloadStatus, 0, len(ids))
+	for _, id := range ids {
+		status, err := c.Get(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		downloads = append(downloads, *status)
+	}
+	return downloads, nil
+}
+
+// updateCmd pauses, resumes or cancels downloads and shows where
+// they ended up
+func updateCmd(o *options.ClientOptions, action string) *cobra.Command {
+	return &cobra.Command{
+		Use:   action + " <id>...",
+		Short: action + " downloads",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			update := map[string]func(context.Context, string) error{
+				"pause": c.Pause, "resume": c.Resume, "cancel": c.Cancel}[action]
+			for _, id := range args {
+				if err := update(cmd.Context(), id); err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+			}
+			downloads, err := getDownloads(cmd.Context(), c, args)
+			if err != nil {
+				return err
+			}
+			return printDownloads(cmd.OutOrStdout(), o, downloads...)
+		},
+	}
+}
+
+func deleteCmd() *cobra.Command {
+	var keepFile bool
+	cmd := &cobra.Command{
+		Use:   "delete <id>...",
+		Short: "cancel downloads and remove their files and records",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			for _, id := range args {
+				if err := c.Delete(cmd.Context(), id, keepFile); err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				fmt.Fprintln(cmd.ErrOrStderr(), "deleted", id)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&keepFile, "keep-file", false, "keep the downloaded file")
+	return cmd
+}
+
+// watchCmd polls the downloads until they have all finished, or the
+// running ones until interrupted. Tables are redrawn on a terminal,
+// json is a line per change.
+func watchCmd(o *options.ClientOptions) *cobra.Command {
+	var interval time.Duration
+	cmd := &cobra.Command{
+		Use:   "watch [id]...",
+		Short: "follow downloads, the running ones by default",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if interval <= 0 {
+				return fmt.Errorf("invalid interval %s, expected more than 0", interval)
+			}
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer stop()
+			out := cmd.OutOrStdout()
+			terminal := isTerminal(out)
+			last := make(map[string]client.DownloadStatus)
+			for {
+				var downloads []client.DownloadStatus
+				if len(args) > 0 {
+					downloads, err = getDownloads(ctx, c, args)
+				} else {
+					var page *client.Page
+					page, err = c.List(ctx, &client.ListOptions{Status: client.StatusRunning})
+					if page != nil {
+						downloads = page.Downloads
+					}
+				}
+				if ctx.Err() != nil {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				changed := make([]client.DownloadStatus, 0)
+				finished := len(args) > 0
+				for _, d := range downloads {
+					previous, ok := last[d.DownloadId]
+					if !ok || previous.Status != d.Status || previous.BytesDownloaded != d.BytesDownloaded {
+						changed = append(changed, d)
+					}
+					last[d.DownloadId] = d
+					finished = finished && client.Finished(d.Status)
+				}
+				if o.Output == "json" {
+					for _, d := range changed {
+						json.NewEncoder(out).Encode(d)
+					}
+				} else if len(changed) > 0 || len(last) == 0 {
+					if terminal {
+						fmt.Fprint(out, "\033[H\033[2J") // clear the screen
+					}
+					printDownloads(out, o, downloads...)
+				}
+				if finished {
+					return nil
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(interval):
+				}
+			}
+		},
+	}
+	cmd.Flags().DurationVar(&interval, "interval", time.Second, "time between polls")
+	return cmd
+}
+
+func isTerminal(w io.Writer) bool {
+	if f, ok := w.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			return info.Mode()&os.ModeCharDevice != 0
+		}
+	}
+	return false
+}
+
+func printDownloads(w io.Writer, o *options.ClientOptions, downloads ...client.DownloadStatus) error {
+	if o.Output == "json" {
+		return printJson(w, downloads)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tPROGRESS\tSIZE\tSTARTED\tURL")
+	for _, d := range downloads {
+		progress := byteSize(int(d.BytesDownloaded))
+		size := "-"
+		if d.TotalSize > 0 {
+			progress = fmt.Sprintf("%d%%", d.BytesDownloaded*100/d.TotalSize)
+			size = byteSize(int(d.TotalSize))
+		}
+		started := "-"
+		if !d.StartTime.IsZero() {
+			started = d.StartTime.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.DownloadId, d.Status, progress, size, started, d.Url)
+	}
+	return tw.Flush()
+}
+
+func printJson(w io.Writer, v any) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
@@ -2,12 +2,15 @@ package cmd
 
 import (
 	"fmt"
+	log "log/slog"
 	"os"
 	"strings"
 
+	"github.com/codejago/polypully/downloader/internal/app/config"
+	"github.com/codejago/polypully/downloader/internal/app/redact"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	log "golang.org/x/exp/slog"
 )
 
 // Load the application properties following
@@ -16,6 +19,8 @@ import (
 
 var (
 	envVar envy
+	// config files merged, in order
+	configFiles []string
 )
 
 func init() {
@@ -49,16 +54,49 @@ func Config() *cobra.Command {
 			if viper.ConfigFileUsed() != "" {
 				log.Debug("Detected a config file", "ConfigFileUsed", viper.ConfigFileUsed())
 			}
+			if err := redaction(cmd); err != nil {
+				return err
+			}
 			log.Info("All Properties:")
-			for key, value := range viper.AllSettings() {
+			for key, value := range redact.Default().Settings(viper.AllSettings()) {
 				log.Info("property", key, value)
 			}
 			return nil
 		},
 	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "validate",
+		Short: "check the application config",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			argumentsChecked(cmd)
+			problems := validateConfig()
+			for _, p := range problems {
+				fmt.Fprintln(cmd.OutOrStdout(), p)
+			}
+			if n := config.Errors(problems); n > 0 {
+				return fmt.Errorf("%d config errors", n)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "config ok: %s\n", strings.Join(configFiles, ", "))
+			return nil
+		},
+	})
 	return cmd
 }
 
+// validateConfig checks the merged config and warns of unknown keys
+// in each file
+func validateConfig() []config.Problem {
+	problems := config.Validate(viper.GetViper())
+	for _, file := range configFiles {
+		unknown, err := config.Unknown(file)
+		if err != nil {
+			problems = append(problems, config.Problem{Key: file, Message: err.Error()})
+		}
+		problems = append(problems, unknown...)
+	}
+	return problems
+}
+
 type Configuration struct {
 }
 
@@ -68,7 +106,7 @@ func (o *Configuration) Load() {
 	location := envVar.Getenv("CONFIG_LOCATION")
 	filetype := envVar.Getenv("CONFIG_FILETYPE")
 	if err := o.Init(profiles, location, filetype); err != nil {
-		log.Error("error while reading configuration %v", err)
+		log.Error("error while reading configuration", "error", err)
 		panic(err)
 	}
 }
@@ -101,6 +139,17 @@ func (o *Configuration) Init(profiles []string, location string, fileType string
 	return nil
 }
 
+// mergeConfigFile merges a file named on the command line over the
+// config, it is reloaded with the rest
+func mergeConfigFile(file string) error {
+	viper.SetConfigFile(file)
+	if err := viper.MergeInConfig(); err != nil {
+		return err
+	}
+	configFiles = append(configFiles, viper.ConfigFileUsed())
+	return nil
+}
+
 func readFileType(fileType string) (string, error) {
 	if fileType == "" {
 		return "yaml", nil
@@ -125,5 +174,6 @@ func readInConfig(name string, profile string) error {
 		}
 	}
 	log.Debug(fmt.Sprintf("Config file %s.yaml found", name))
+	configFiles = append(configFiles, viper.ConfigFileUsed())
 	return nil
 }
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/disk"
+	"github.com/codejago/polypully/downloader/internal/app/message"
+	"github.com/codejago/polypully/downloader/internal/app/retention"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func GcCmd() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "remove downloads past the retention policy, the service must be stopped",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			message.SetSource(viper.GetString("events.source"))
+			localStorage, err := newLocalStorage()
+			if err != nil {
+				return err
+			}
+			defer localStorage.Close()
+			collector := retention.NewCollector(&retention.CollectorConfig{Policy: retentionPolicy()},
+				storage.NewStorage(localStorage), nil)
+			candidates, err := collector.Collect(dryRun)
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tSTATUS\tFILE\tREASON")
+			for _, c := range candidates {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Resource.Id, c.Resource.Status, c.Resource.File, c.Reason)
+			}
+			w.Flush()
+			if dryRun {
+				fmt.Fprintf(cmd.OutOrStdout(), "%d downloads would be removed\n", len(candidates))
+			}
+			return err
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "list what would be removed without removing it")
+	return cmd
+}
+
+// retentionPolicy reads the retention rules from the config
+func retentionPolicy() *retention.Policy {
+	maxAge := make(map[string]time.Duration)
+	for status, age := range viper.GetStringMap("retention.max-age") {
+		maxAge[status] = cast.ToDuration(age)
+	}
+	return &retention.Policy{
+		MaxAge:        maxAge,
+		MaxTotalBytes: viper.GetInt64("retention.max-total-mib") * disk.MiB,
+		KeepLast:      viper.GetInt("retention.keep-last"),
+	}
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	apphttp "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/redact"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/codejago/polypully/downloader/internal/app/tracing"
+	appevents "github.com/matthogan/polypully-events"
+
+	"github.com/spf13/cobra"
+)
+
+// the state of a paused download is kept next to the file
+const stateSuffix = ".download"
+
+// GetCmd downloads a single file in the foreground, without the
+// service, its store or its events
+func GetCmd() *cobra.Command {
+	var output, sha256 string
+	var fragments int
+	var resume, verbose bool
+	cmd := &cobra.Command{
+		Use:   "get <url>",
+		Short: "download a file in the foreground, Ctrl-C pauses it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			argumentsChecked(cmd)
+			uri := args[0]
+			if output == "" {
+				name, err := fileName(uri)
+				if err != nil {
+					return err
+				}
+				output = name
+			}
+			abs, err := filepath.Abs(output)
+			if err != nil {
+				return err
+			}
+			output = abs
+			if !verbose {
+				log.SetOutput(io.Discard) // the default handlers of both slog packages
+			}
+			// the store only lives as long as the download
+			localStorage, err := storage.NewLocalStorage(&storage.LocalStorageConfig{Type: storage.MemoryBackend})
+			if err != nil {
+				return err
+			}
+			defer localStorage.Close()
+			events, _ := appevents.NewEvents(&appevents.EventsConfig{Enabled: false})
+			// nothing stays up to be scraped, metrics are only pushed
+			config := metricsConfig()
+			config.Enable = config.Enable && config.Model == "push"
+			metrics := metrics.NewMetrics(config)
+			metrics.Expose()
+			defer metrics.Close()
+			tracer, err := tracing.NewTracing(tracingConfig())
+			if err != nil {
+				return err
+			}
+			defer tracer.Shutdown(context.Background())
+			d, err := startDownload(uri, output, fragments, resume, events, storage.NewStorage(localStorage), metrics)
+			if err != nil {
+				return err
+			}
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(signals)
+			bar := newProgressBar(cmd.ErrOrStderr())
+			ticker := time.NewTicker(200 * time.Millisecond)
+			defer ticker.Stop()
+		wait:
+			for {
+				select {
+				case <-d.Done():
+					break wait
+				case <-signals:
+					d.Pause()
+				case <-ticker.C:
+					bar.Render(d.Snapshot().BytesDownloaded(), d.FileSize)
+				}
+			}
+			bar.Clear()
+
+			state := output + stateSuffix
+			switch d.Status {
+			case model.DownloadComplete:
+				if err := os.Remove(state); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				if sha256 != "" && !strings.EqualFold(sha256, d.Sha256) {
+					return fmt.Errorf("sha256 of %s is %s, expected %s", output, d.Sha256, sha256)
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s  %s  %s\n", output, byteSize(d.BytesDownloaded()), d.Sha256)
+				return nil
+			case model.DownloadPaused:
+				if err := saveState(state, &d.Resource); err != nil {
+					return err
+				}
+				return fmt.Errorf("paused at %s, resume with: downloader get --continue -o %s %s",
+					byteSize(d.BytesDownloaded()), output, redact.Url(uri))
+			}
+			for e := d.Errors.Front(); e != nil; e = e.Next() {
+				fmt.Fprintf(cmd.ErrOrStderr(), "  %v\n", e.Value)
+			}
+			if len(d.Fragments) > 0 && saveState(state, &d.Resource) == nil {
+				return fmt.Errorf("download %s, retry with: downloader get --continue -o %s %s", d.Status, output, redact.Url(uri))
+			}
+			return fmt.Errorf("download %s", d.Status)
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "file to write, named after the url by default")
+	cmd.Flags().IntVar(&fragments, "fragments", 0, "fragments downloaded at once, download.max-conc-fragments by default")
+	cmd.Flags().StringVar(&sha256, "sha256", "", "expected hex digest of the file")
+	cmd.Flags().BoolVar(&resume, "continue", false, "resume the paused or failed download of the output file")
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "log to stderr alongside the progress")
+	return cmd
+}
+
+// argumentsChecked marks the command past its usage checks, an error
+// from then on is not a usage problem and main reports it
+func argumentsChecked(cmd *cobra.Command) {
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+}
+
+// startDownload starts a new download of the url to the output file,
+// or resumes the one saved next to it
+func startDownload(uri string, output string, fragments int, resume bool,
+	events appevents.EventsApi, storage storage.StorageApi, metrics metrics.MetricsApi) (*apphttp.Download, error) {
+	state := output + stateSuffix
+	if resume {
+		r, err := apphttp.ReadManifest(state)
+		if err != nil {
+			return nil, fmt.Errorf("nothing to continue: %v", err)
+		}
+		// the state has the url without its credentials
+		if r.Uri != redact.Url(uri) {
+			return nil, fmt.Errorf("%s is a download of %s", state, r.Uri)
+		}
+		r.Uri = uri
+		d := apphttp.RestoreDownload(r, events, storage, metrics)
+		d.NoManifest = true
+		if fragments > 0 {
+			d.MaxConcFragments = fragments
+		}
+		return &d, d.Resume()
+	}
+	if _, err := os.Stat(state); err == nil {
+		return nil, fmt.Errorf("%s holds a paused download, use --continue or remove it", state)
+	}
+	if _, err := os.Stat(output); err == nil {
+		return nil, fmt.Errorf("%s already exists", output)
+	}
+	d := apphttp.NewDownload(uri, events, storage, metrics)
+	d.NoManifest = true
+	d.Destination = filepath.Dir(output)
+	d.File = output
+	if fragments > 0 {
+		d.MaxConcFragments = fragments
+	}
+	return &d, d.Download()
+}
+
+// fileName is the last segment of the url path
+func fileName(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", errors.New("the url does not name a file, use --output")
+	}
+	return name, nil
+}
+
+func saveState(state string, r *model.Resource) error {
+	saved := *r
+	saved.Uri = redact.Url(r.Uri)
+	data, err := json.MarshalIndent(&saved, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(state, data, 0o644)
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"log/slog"
+
+	apphttp "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/logging"
+	"github.com/codejago/polypully/downloader/internal/app/redact"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serviceLogger becomes the default logger, from the log keys. The
+// records of a download are tagged with its id.
+func serviceLogger() (logging.LoggerApi, error) {
+	logger, err := logging.NewLogger(&logging.LoggerConfig{
+		Level:       viper.GetString("log.level"),
+		Format:      viper.GetString("log.format"),
+		Directory:   viper.GetString("log.directory"),
+		File:        viper.GetString("log.file"),
+		MaxSizeMiB:  viper.GetInt("log.max-size-mib"),
+		MaxAge:      viper.GetDuration("log.max-age"),
+		MaxBackups:  viper.GetInt("log.max-backups"),
+		Compress:    viper.GetBool("log.compress"),
+		Context:     map[string]any{"download_id": apphttp.ContextKey("download_id")},
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr { return redact.Default().Attr(groups, a) }})
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger.Logger())
+	return logger, nil
+}
+
+// redaction sets the default redactor from redact.patterns, which add
+// to the built in patterns, and --unsafe-show-secrets
+func redaction(cmd *cobra.Command) error {
+	show, _ := cmd.Flags().GetBool("unsafe-show-secrets")
+	r, err := redact.NewRedactor(&redact.RedactorConfig{
+		Patterns: append(redact.DefaultPatterns, viper.GetStringSlice("redact.patterns")...),
+		Disabled: show})
+	if err != nil {
+		return err
+	}
+	redact.SetDefault(r)
+	return nil
+}
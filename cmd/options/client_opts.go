@@ -0,0 +1,27 @@
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type ClientOptions struct {
+	Address string
+	Timeout time.Duration
+	Output  string
+}
+
+var _ Interface = (*ClientOptions)(nil)
+
+// AddFlags implements Interface, the flags are shared by the subcommands
+func (o *ClientOptions) AddFlags(cmd *cobra.Command, v *viper.Viper) {
+	cmd.PersistentFlags().StringVarP(&o.Address, "address", "a", "http://127.0.0.1:8080", "address of the running service")
+	viper.BindPFlag("client.address", cmd.PersistentFlags().Lookup("address"))
+
+	cmd.PersistentFlags().DurationVar(&o.Timeout, "timeout", 30*time.Second, "timeout of each request")
+	viper.BindPFlag("client.timeout", cmd.PersistentFlags().Lookup("timeout"))
+
+	cmd.PersistentFlags().StringVarP(&o.Output, "output", "o", "table", "table or json")
+}
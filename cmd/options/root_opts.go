@@ -6,7 +6,8 @@ import (
 )
 
 type RootOptions struct {
-	Config string
+	Config            string
+	UnsafeShowSecrets bool
 }
 
 var _ Interface = (*RootOptions)(nil)
@@ -14,5 +15,6 @@ var _ Interface = (*RootOptions)(nil)
 // AddFlags implements Interface
 func (o *RootOptions) AddFlags(cmd *cobra.Command, v *viper.Viper) {
 	cmd.PersistentFlags().StringVar(&o.Config, "config", "", "config file (default is config/application.yaml)")
+	cmd.PersistentFlags().BoolVar(&o.UnsafeShowSecrets, "unsafe-show-secrets", false, "do not redact secrets in the config, logs and stored urls")
 	Load(cmd, v)
 }
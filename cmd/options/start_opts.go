@@ -30,10 +30,15 @@ func (o *StartOptions) AddFlags(cmd *cobra.Command, v *viper.Viper) {
 	viper.BindPFlag("server.cert", cmd.Flags().Lookup("cert"))
 
 	cmd.Flags().IntVarP(&o.MaxConcurrentDownloads, "max-conc", "m", 1, "max concurrent downloads")
-	viper.BindPFlag("download.max_concurrent", cmd.Flags().Lookup("max-conc"))
+	viper.BindPFlag("download.max-conc", cmd.Flags().Lookup("max-conc"))
 
 	cmd.Flags().StringVarP(&o.DownloadDirectory, "dir", "d", "/tmp", "directory to store temporary downloads")
 	viper.BindPFlag("download.directory", cmd.Flags().Lookup("dir"))
 
+	cmd.Flags().StringVar(&o.LogDirectory, "log-dir", "", "directory of the rotated log files, stderr only when empty")
+	viper.BindPFlag("log.directory", cmd.Flags().Lookup("log-dir"))
+
+	cmd.Flags().StringVar(&o.LogConfigFile, "log-config", "", "file with a log section merged over the config")
+
 	Load(cmd, v)
 }
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const barWidth = 30
+
+// progressBar redraws a single line with the bytes done, the speed
+// and the time left. Nothing is drawn when the writer is not a
+// terminal, a log or a pipe only gets the outcome.
+type progressBar struct {
+	w       io.Writer
+	enabled bool
+	// the speed is measured over the last few seconds
+	samples []sample
+	drawn   bool
+}
+
+type sample struct {
+	at    time.Time
+	bytes int
+}
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w, enabled: isTerminal(w)}
+}
+
+func (p *progressBar) Render(done int, total int) {
+	now := time.Now()
+	p.samples = append(p.samples, sample{at: now, bytes: done})
+	for len(p.samples) > 2 && now.Sub(p.samples[0].at) > 5*time.Second {
+		p.samples = p.samples[1:]
+	}
+	if !p.enabled {
+		return
+	}
+	speed := p.speed()
+	line := fmt.Sprintf("%s  %s/s", byteSize(done), byteSize(int(speed)))
+	if total > 0 {
+		filled := min(done*barWidth/total, barWidth)
+		eta := "--"
+		if speed > 0 {
+			eta = (time.Duration(float64(total-done)/speed) * time.Second).Round(time.Second).String()
+		}
+		line = fmt.Sprintf("[%s%s] %3d%%  %s of %s  %s/s  ETA %s",
+			strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled),
+			done*100/total, byteSize(done), byteSize(total), byteSize(int(speed)), eta)
+	}
+	// clear what is left of a longer line
+	fmt.Fprintf(p.w, "\r%-80s", line)
+	p.drawn = true
+}
+
+// Clear ends the line so the outcome starts on its own
+func (p *progressBar) Clear() {
+	if p.drawn {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// bytes a second over the samples kept
+func (p *progressBar) speed() float64 {
+	first, last := p.samples[0], p.samples[len(p.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+func byteSize(b int) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := unit, 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
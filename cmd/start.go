@@ -1,21 +1,34 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/codejago/polypully/downloader/api/generated/openapi"
 	"github.com/codejago/polypully/downloader/cmd/options"
+	"github.com/codejago/polypully/downloader/internal/app/config"
+	"github.com/codejago/polypully/downloader/internal/app/disk"
+	"github.com/codejago/polypully/downloader/internal/app/health"
+	"github.com/codejago/polypully/downloader/internal/app/inbound"
+	"github.com/codejago/polypully/downloader/internal/app/message"
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
+	"github.com/codejago/polypully/downloader/internal/app/outbox"
+	"github.com/codejago/polypully/downloader/internal/app/retention"
 	"github.com/codejago/polypully/downloader/internal/app/service"
 	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/codejago/polypully/downloader/internal/app/tracing"
 	appevents "github.com/matthogan/polypully-events"
 
+	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"golang.org/x/exp/slog"
 )
 
 func StartCmd() *cobra.Command {
@@ -25,14 +38,46 @@ func StartCmd() *cobra.Command {
 		Short: "start downloader service",
 		Run: func(cmd *cobra.Command, args []string) {
 
+			if o.LogConfigFile != "" {
+				if err := mergeConfigFile(o.LogConfigFile); err != nil {
+					slog.Error("failed to read the log config", "error", err)
+					os.Exit(1)
+				}
+			}
+
+			// refuse a bad config before anything starts, all at once
+			problems := validateConfig()
+			for _, p := range problems {
+				fmt.Fprintln(os.Stderr, p)
+			}
+			if config.Errors(problems) > 0 {
+				os.Exit(1)
+			}
+			if err := redaction(cmd); err != nil {
+				slog.Error("failed to set the redaction", "error", err)
+				os.Exit(1)
+			}
+			logger, err := serviceLogger()
+			if err != nil {
+				slog.Error("failed to set up the log", "error", err)
+				os.Exit(1)
+			}
+
+			tracer, err := tracing.NewTracing(tracingConfig())
+			if err != nil {
+				slog.Error("failed to init the tracing", "error", err)
+				os.Exit(-1)
+			}
+
 			// init the event producer
+			message.SetSource(viper.GetString("events.source"))
 			events, err := appevents.NewEvents(&appevents.EventsConfig{
-				Enabled:          viper.GetBool("events.enabled"),
+				Enabled:          viper.GetBool("events.enable"),
 				BootstrapServers: viper.GetString("events.kafka.bootstrap-servers"),
-				ClientId:         viper.GetString("events.kafka.client_id"),
-				Acks:             viper.GetString("kafka.acks"),
-				Topic:            viper.GetString("kafka.topic"),
-				ProducerId:       viper.GetString("kafka.producer_id"),
+				ClientId:         viper.GetString("events.kafka.client-id"),
+				Acks:             viper.GetString("events.kafka.acks"),
+				Topic:            viper.GetString("events.kafka.topic"),
+				ProducerId:       viper.GetString("events.kafka.producer-id"),
 				Config:           viper.GetStringMapString("events.kafka.config")})
 			if err != nil {
 				slog.Error("failed to init the event producer", "error", err)
@@ -40,43 +85,259 @@ func StartCmd() *cobra.Command {
 			}
 
 			// init the local storage
-			localStorage, err := storage.NewLocalStorage(&storage.LocalStorageConfig{
-				Path:        viper.GetString("storage.path"),
-				BufferMiB:   viper.GetInt("storage.buffer-mib"),
-				CacheMiB:    viper.GetInt("storage.cache-mib"),
-				Compression: viper.GetString("storage.compression"),
-				Recovery:    viper.GetBool("storage.recovery")})
+			localStorage, err := newLocalStorage()
 			if err != nil {
 				slog.Error("failed to init the local storage", "error", err)
 				os.Exit(-1)
 			}
 			storage := storage.NewStorage(localStorage)
 
-			// handle shutdown signals
+			// init the metrics
+			metrics := metrics.NewMetrics(metricsConfig())
+			metrics.Expose()
+
+			// publish the events stored with the downloads
+			relay := outbox.NewRelay(&outbox.RelayConfig{
+				Interval:   viper.GetDuration("events.outbox.interval"),
+				Backoff:    viper.GetDuration("events.outbox.backoff"),
+				MaxBackoff: viper.GetDuration("events.outbox.max-backoff"),
+				Batch:      viper.GetInt("events.outbox.batch"),
+				MaxLag:     viper.GetDuration("events.outbox.max-lag"),
+				Flush:      flusher(events, viper.GetDuration("events.outbox.delivery-timeout"))}, storage, events, metrics)
+			relay.Watch()
+
+			// watch the free space of the download directory
+			monitor := disk.NewMonitor(&disk.MonitorConfig{
+				Path:          viper.GetString("download.directory"),
+				LowWatermark:  uint64(viper.GetInt("download.disk.low-watermark-mib")) * disk.MiB,
+				HighWatermark: uint64(viper.GetInt("download.disk.high-watermark-mib")) * disk.MiB,
+				Interval:      viper.GetDuration("download.disk.interval")}, metrics)
+			monitor.Watch()
+
+			// liveness only needs the server to answer, readiness needs
+			// the dependencies and fails while draining
+			liveness := health.NewHealth(&health.HealthConfig{})
+			readiness := health.NewHealth(&health.HealthConfig{Timeout: viper.GetDuration("health.timeout")})
+			readiness.Register("disk", monitor.Check)
+			readiness.Register("download-directory", func() (interface{}, error) {
+				path := viper.GetString("download.directory")
+				return map[string]interface{}{"path": path}, disk.Writable(path)
+			})
+			readiness.Register("storage", func() (interface{}, error) {
+				version, err := localStorage.Version()
+				return map[string]interface{}{"type": viper.GetString("storage.type"), "version": version}, err
+			})
+			if viper.GetBool("events.enable") {
+				readiness.Register("events", health.Events(events, viper.GetDuration("health.timeout")))
+			}
+			readiness.Register("outbox", relay.Check)
+
+			events.Notify(appevents.NewServiceEvent("started"))
+			downloads := service.NewRegistry()
+			readiness.Register("scheduler", func() (interface{}, error) {
+				accepting := monitor.Accepting() && !downloads.Draining()
+				details := map[string]interface{}{"running": len(downloads.List()), "accepting": accepting}
+				if !accepting {
+					return details, errors.New("new downloads are refused")
+				}
+				return details, nil
+			})
+
+			// apply config changes that do not need a restart
+			watching, stopWatching := context.WithCancel(context.Background())
+			reloader, err := config.NewReloader(&config.ReloaderConfig{
+				Files:  configFiles,
+				Target: viper.GetViper(),
+				OnReload: func(changed []string) {
+					for _, key := range changed {
+						switch key {
+						case "log.level":
+							logger.SetLevel(config.Live().GetString(key))
+						case "download.retries":
+							// the rest apply to new downloads
+							for _, d := range downloads.List() {
+								d.SetRetries(config.Live().GetInt(key))
+							}
+						}
+					}
+					events.Notify(appevents.NewServiceEvent("config reloaded"))
+				},
+				OnReject: func(err error) {
+					events.Notify(appevents.NewServiceEvent("config reload rejected"))
+				}})
+			if err == nil {
+				err = reloader.Watch(watching)
+			}
+			if err != nil {
+				slog.Error("failed to watch the config", "error", err)
+				os.Exit(-1)
+			}
+
+			// remove downloads past the retention policy
+			var collector retention.CollectorApi
+			if viper.GetBool("retention.enable") {
+				collector = retention.NewCollector(&retention.CollectorConfig{
+					Policy:   retentionPolicy(),
+					Interval: viper.GetDuration("retention.interval")}, storage, downloads)
+				collector.Watch()
+			}
+
+			defaultApiService := service.NewApiService(events, storage, monitor, downloads, metrics)
+			// a full disk pauses the running downloads rather than failing them
+			guard := service.NewDiskGuard(&service.DiskGuardConfig{Timeout: closeTimeout}, defaultApiService, downloads)
+			monitor.OnChange(guard.Changed)
+
+			// take commands from the stream as well as the api
+			consuming, stopConsuming := context.WithCancel(context.Background())
+			consumed := make(chan struct{})
+			if viper.GetBool("events.commands.enable") {
+				consumer, err := inbound.NewKafka(&inbound.KafkaConfig{
+					BootstrapServers: viper.GetString("events.kafka.bootstrap-servers"),
+					ClientId:         viper.GetString("events.kafka.client-id"),
+					GroupId:          viper.GetString("events.commands.group-id"),
+					Topic:            viper.GetString("events.commands.topic"),
+					Backoff:          viper.GetDuration("events.commands.backoff"),
+					Config:           viper.GetStringMapString("events.commands.config")})
+				if err != nil {
+					slog.Error("failed to init the command consumer", "error", err)
+					os.Exit(-1)
+				}
+				go func() {
+					defer close(consumed)
+					if err := consumer.Consume(consuming, service.NewCommandHandler(defaultApiService, storage)); err != nil {
+						slog.Error("command consumer stopped", "error", err)
+					}
+					consumer.Close()
+				}()
+			} else {
+				close(consumed)
+			}
+			defaultApiController := openapi.NewDefaultApiController(defaultApiService)
+			router := openapi.NewRouter(defaultApiController)
+			router.Handle("/v1/downloads/{downloadId}/content",
+				openapi.Logger(service.NewContentHandler(storage, downloads), "DownloadsDownloadIdContentGet")).
+				Methods(http.MethodGet, http.MethodHead)
+			router.Handle("/healthz", liveness).Methods(http.MethodGet)
+			router.Handle("/readyz", readiness).Methods(http.MethodGet)
+			// a liveness probe, it does not fail during the drain
+			router.Handle("/health", liveness).Methods(http.MethodGet)
+
+			server := &http.Server{Addr: fmt.Sprintf(":%d", o.Port), Handler: tracing.Middleware(router)}
+
+			// on a signal stop taking work, give the running downloads
+			// the grace period, pause the rest with their progress saved
+			// and close the store once nothing can write to it
+			stopped := make(chan struct{})
 			sigs := make(chan os.Signal, 1)
 			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 			go func() {
+				defer close(stopped)
 				sig := <-sigs
 				slog.Info("shutdown", "signal", sig)
-				localStorage.Close()
-				os.Exit(0)
+				service.Shutdown(&service.ShutdownConfig{
+					Drain:        viper.GetDuration("shutdown.drain"),
+					GracePeriod:  viper.GetDuration("shutdown.grace-period"),
+					PauseTimeout: closeTimeout,
+					StopIntake: func() {
+						stopConsuming()
+						<-consumed
+					},
+					Unready: readiness.Drain,
+					StopServer: func(ctx context.Context) {
+						if err := server.Shutdown(ctx); err != nil {
+							slog.Warn("closing the connections left", "error", err)
+							server.Close()
+						}
+					},
+					Flush: func() {
+						stopWatching()
+						monitor.Stop()
+						if collector != nil {
+							collector.Stop()
+						}
+						// nothing stores events from here on
+						relay.Stop()
+						events.Notify(appevents.NewServiceEvent("stopped"))
+						closeEvents(events)
+						metrics.Close()
+						flush, cancelFlush := context.WithTimeout(context.Background(), closeTimeout)
+						defer cancelFlush()
+						if err := tracer.Shutdown(flush); err != nil {
+							slog.Error("failed to flush the spans", "error", err)
+						}
+					},
+					Close: localStorage.Close}, downloads)
+				slog.Info("stopped")
+				logger.Close()
 			}()
 
 			slog.Info("server starting", "port", o.Port)
-			events.Notify(appevents.NewServiceEvent("started"))
-			defaultApiService := service.NewApiService(events, storage)
-			defaultApiController := openapi.NewDefaultApiController(defaultApiService)
-			router := openapi.NewRouter(defaultApiController)
-
-			// start the server
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", o.Port), router); err != nil {
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 				events.Notify(appevents.NewServiceEvent("start failed"))
-				slog.Error("failed to start server", err)
+				slog.Error("failed to start server", "error", err)
 				os.Exit(-1)
 			}
-			events.Notify(appevents.NewServiceEvent("stopped"))
+			<-stopped
 		},
 	}
 	o.AddFlags(cmd, viper.GetViper())
 	return cmd
 }
+
+// how long pausing the downloads or flushing events and spans can
+// take on shutdown
+const closeTimeout = 10 * time.Second
+
+// closeEvents delivers the events still queued before closing the
+// producer
+func closeEvents(events appevents.EventsApi) {
+	if flush := flusher(events, closeTimeout); flush != nil {
+		if left := flush(); left > 0 {
+			slog.Warn("events not delivered", "count", left)
+		}
+	}
+	events.Close()
+}
+
+// flusher waits for the kafka producer to deliver the events queued
+// and returns how many were not, nil for a producer that does not queue
+func flusher(events appevents.EventsApi, timeout time.Duration) func() int {
+	if e, ok := events.(*appevents.Events); ok {
+		if producer, ok := e.Producer.(*kafka.Producer); ok {
+			return func() int { return producer.Flush(int(timeout.Milliseconds())) }
+		}
+	}
+	return nil
+}
+
+// metricsConfig from the prometheus keys, pushed metrics are grouped
+// under the host name unless an instance is set
+func metricsConfig() metrics.MetricsConfig {
+	instance := viper.GetString("prometheus.push.instance")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return metrics.MetricsConfig{
+		Port:   viper.GetInt("prometheus.port"),
+		Enable: viper.GetBool("prometheus.enable"),
+		Model:  viper.GetString("prometheus.model"),
+		Path:   viper.GetString("prometheus.path"),
+		Push: metrics.PushConfig{
+			Url:      viper.GetString("prometheus.push.url"),
+			Interval: viper.GetDuration("prometheus.push.interval"),
+			Job:      viper.GetString("prometheus.push.job"),
+			Instance: instance,
+			Username: viper.GetString("prometheus.push.username"),
+			Password: viper.GetString("prometheus.push.password")}}
+}
+
+func tracingConfig() *tracing.TracingConfig {
+	return &tracing.TracingConfig{
+		Enable:      viper.GetBool("tracing.enable"),
+		Exporter:    viper.GetString("tracing.exporter"),
+		Endpoint:    viper.GetString("tracing.endpoint"),
+		Insecure:    viper.GetBool("tracing.insecure"),
+		File:        viper.GetString("tracing.file"),
+		SampleRatio: viper.GetFloat64("tracing.sample-ratio"),
+		ServiceName: viper.GetString("tracing.service-name")}
+}
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/codejago/polypully/downloader/internal/app/rebuild"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// newLocalStorage opens the configured store. Only one process can
+// hold it at a time so commands working on the store offline fail
+// while the service is running.
+func newLocalStorage() (storage.LocalStorageApi, error) {
+	return storage.NewLocalStorage(localStorageConfig())
+}
+
+func localStorageConfig() *storage.LocalStorageConfig {
+	return &storage.LocalStorageConfig{
+		Type:        viper.GetString("storage.type"),
+		Path:        viper.GetString("storage.path"),
+		BufferMiB:   viper.GetInt("storage.buffer-mib"),
+		CacheMiB:    viper.GetInt("storage.cache-mib"),
+		Compression: viper.GetString("storage.compression"),
+		Recovery:    viper.GetBool("storage.recovery")}
+}
+
+// StorageCmd groups the offline maintenance of the store
+func StorageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "storage",
+		Short: "maintain the download store, the service must be stopped",
+	}
+	cmd.AddCommand(migrateCmd())
+	cmd.AddCommand(exportCmd())
+	cmd.AddCommand(importCmd())
+	cmd.AddCommand(compactCmd())
+	cmd.AddCommand(statsCmd())
+	cmd.AddCommand(verifyStorageCmd())
+	cmd.AddCommand(rebuildCmd())
+	return cmd
+}
+
+// withLocalStorage runs f against the opened store and closes it
+func withLocalStorage(f func(storage.LocalStorageApi) error) error {
+	localStorage, err := newLocalStorage()
+	if err != nil {
+		return err
+	}
+	defer localStorage.Close()
+	return f(localStorage)
+}
+
+func exportCmd() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "write every resource and index record as JSON lines",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withLocalStorage(func(s storage.LocalStorageApi) error {
+				if output == "" || output == "-" {
+					return s.Export(cmd.OutOrStdout())
+				}
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				if err := s.Export(f); err != nil {
+					f.Close()
+					return err
+				}
+				return f.Close()
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "file to write, stdout by default")
+	return cmd
+}
+
+func importCmd() *cobra.Command {
+	var input string
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "restore the records of an export",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withLocalStorage(func(s storage.LocalStorageApi) error {
+				existing, err := s.ListResources(storage.TimeIndex(), nil, 1)
+				if err != nil {
+					return err
+				}
+				if len(existing) > 0 && !force {
+					return fmt.Errorf("the store is not empty, use --force to import over it")
+				}
+				in := cmd.InOrStdin()
+				if input != "" && input != "-" {
+					f, err := os.Open(input)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					in = f
+				}
+				count, err := s.Import(in)
+				fmt.Fprintf(cmd.OutOrStdout(), "imported %d records\n", count)
+				return err
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&input, "input", "i", "", "file to read, stdin by default")
+	cmd.Flags().BoolVar(&force, "force", false, "import into a store that already has downloads")
+	return cmd
+}
+
+func compactCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "compact",
+		Short: "compact the store, reclaiming the space of removed downloads",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withLocalStorage(func(s storage.LocalStorageApi) error {
+				return s.Compact()
+			})
+		},
+	}
+}
+
+func statsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "stats",
+		Short: "show the size of the store and the records per key prefix",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withLocalStorage(func(s storage.LocalStorageApi) error {
+				stats, err := s.Stats()
+				if err != nil {
+					return err
+				}
+				prefixes := make([]string, 0, len(stats.Prefixes))
+				for prefix := range stats.Prefixes {
+					prefixes = append(prefixes, prefix)
+				}
+				sort.Strings(prefixes)
+				w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "PREFIX\tRECORDS\tBYTES")
+				for _, prefix := range prefixes {
+					fmt.Fprintf(w, "%s\t%d\t%d\n", prefix, stats.Prefixes[prefix].Records, stats.Prefixes[prefix].Bytes)
+				}
+				w.Flush()
+				fmt.Fprintf(cmd.OutOrStdout(), "%d bytes on disk\n", stats.DiskBytes)
+				return nil
+			})
+		},
+	}
+}
+
+func verifyStorageCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify",
+		Short: "check every index points at a resource, every resource is indexed and complete files exist",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withLocalStorage(func(s storage.LocalStorageApi) error {
+				problems, err := s.Verify()
+				if err != nil {
+					return err
+				}
+				for _, problem := range problems {
+					fmt.Fprintln(cmd.OutOrStdout(), problem)
+				}
+				if len(problems) > 0 {
+					return fmt.Errorf("%d problems found", len(problems))
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), "ok")
+				return nil
+			})
+		},
+	}
+}
+
+func migrateCmd() *cobra.Command {
+	var check bool
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "apply pending schema migrations, the store is backed up first",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := localStorageConfig()
+			config.SkipMigrations = true
+			localStorage, err := storage.NewLocalStorage(config)
+			if err != nil {
+				return err
+			}
+			version, err := localStorage.Version()
+			if err != nil {
+				localStorage.Close()
+				return err
+			}
+			pending, err := localStorage.PendingMigrations()
+			localStorage.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "schema version %d, current %d\n", version, storage.SchemaVersion())
+			for _, m := range pending {
+				fmt.Fprintf(cmd.OutOrStdout(), "pending %d: %s\n", m.Version, m.Description)
+			}
+			if check || len(pending) == 0 {
+				return nil
+			}
+			// opening with migrations enabled applies them
+			if localStorage, err = newLocalStorage(); err != nil {
+				return err
+			}
+			localStorage.Close()
+			fmt.Fprintf(cmd.OutOrStdout(), "migrated to %d\n", storage.SchemaVersion())
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&check, "check", false, "report pending migrations without applying them")
+	return cmd
+}
+
+func rebuildCmd() *cobra.Command {
+	var from string
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "rebuild",
+		Short: "recreate the records of downloads from the manifests in a download directory",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if from == "" {
+				from = viper.GetString("download.directory")
+			}
+			return withLocalStorage(func(s storage.LocalStorageApi) error {
+				results, err := rebuild.Rebuild(from, s, dryRun)
+				w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tOUTCOME\tMANIFEST\tDETAIL")
+				for _, r := range results {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Id, r.Outcome, r.Manifest, r.Detail)
+				}
+				w.Flush()
+				return err
+			})
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "download directory to walk, download.directory by default")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "report what would be rebuilt without storing it")
+	return cmd
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+
+	apphttp "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/pkg/manifest"
+
+	"github.com/spf13/cobra"
+)
+
+// VerifyCmd re-hashes downloaded files and compares them with their
+// manifests, it needs neither the service nor its store
+func VerifyCmd() *cobra.Command {
+	var file string
+	cmd := &cobra.Command{
+		Use:   "verify <manifest>...",
+		Short: "check downloaded files against their manifests",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if file != "" && len(args) > 1 {
+				return errors.New("--file applies to a single manifest")
+			}
+			argumentsChecked(cmd)
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			defer w.Flush()
+			failed := 0
+			for _, path := range args {
+				m, err := readManifest(path)
+				if err != nil {
+					return err
+				}
+				artefact := file
+				if artefact == "" {
+					if artefact, err = m.Locate(path); err != nil {
+						fmt.Fprintf(w, "%s\tFAILED\t%v\n", path, err)
+						failed++
+						continue
+					}
+				}
+				checks, err := m.Verify(artefact)
+				if err != nil {
+					fmt.Fprintf(w, "%s\tFAILED\t%v\n", artefact, err)
+					failed++
+					continue
+				}
+				for _, c := range checks {
+					if c.Ok() {
+						fmt.Fprintf(w, "%s\tok\t%s %s\n", artefact, c.Name, c.Actual)
+					} else {
+						fmt.Fprintf(w, "%s\tFAILED\t%s %s, expected %s\n", artefact, c.Name, c.Actual, c.Expected)
+						failed++
+					}
+				}
+			}
+			if failed > 0 {
+				w.Flush()
+				return fmt.Errorf("%d checks failed", failed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "file to check, found from the manifest by default")
+	return cmd
+}
+
+// readManifest reads either format, an unversioned manifest is
+// described as the current one would
+func readManifest(path string) (*manifest.Manifest, error) {
+	m, err := manifest.Read(path)
+	if !errors.Is(err, manifest.ErrUnversioned) {
+		return m, err
+	}
+	r, err := apphttp.ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	return apphttp.ToManifest(r), nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Settings are the live keys as they were last applied. A reload
+// publishes a new copy rather than setting them on viper, which is
+// not safe to write while the requests read it.
+type Settings struct {
+	values map[string]any
+}
+
+var live atomic.Pointer[Settings]
+
+// NewSettings copies the live keys from the config
+func NewSettings(v Getter) *Settings {
+	values := make(map[string]any)
+	for _, k := range schema {
+		if k.Live {
+			values[k.Name] = v.Get(k.Name)
+		}
+	}
+	return &Settings{values: values}
+}
+
+// Live settings as the reloader last published them, or as the global
+// viper has them when no reloader runs
+func Live() *Settings {
+	if s := live.Load(); s != nil {
+		return s
+	}
+	return NewSettings(viper.GetViper())
+}
+
+// with returns a copy with the keys changed
+func (s *Settings) with(v Getter, keys []string) *Settings {
+	values := make(map[string]any, len(s.values))
+	for k, value := range s.values {
+		values[k] = value
+	}
+	for _, k := range keys {
+		values[k] = v.Get(k)
+	}
+	return &Settings{values: values}
+}
+
+func (s *Settings) Get(key string) any {
+	return s.values[key]
+}
+
+func (s *Settings) GetString(key string) string {
+	return cast.ToString(s.values[key])
+}
+
+func (s *Settings) GetInt(key string) int {
+	return cast.ToInt(s.values[key])
+}
+
+func (s *Settings) GetUint32(key string) uint32 {
+	return cast.ToUint32(s.values[key])
+}
+
+func (s *Settings) GetDuration(key string) time.Duration {
+	return cast.ToDuration(s.values[key])
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/redact"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+var _ ReloaderApi = (*Reloader)(nil)
+
+// Reloader re-reads the config files when they change or on SIGHUP
+// and publishes the keys that can change while the service runs as
+// the Live settings. A reload that changes any other key is rejected
+// as a whole.
+//
+// viper's own WatchConfig re-reads only the last file it merged, which
+// would drop the base file under a profile, so the files are watched
+// here and merged again in order.
+type Reloader struct {
+	files     []string
+	onReload  func(changed []string)
+	onReject  func(err error)
+	lock      sync.Mutex
+	current   *viper.Viper   // the files and overrides as last applied
+	settings  *Settings      // the live keys as last applied
+	overrides map[string]any // the keys the flags and environment hold
+}
+
+type ReloaderConfig struct {
+	// config files in the order they are merged
+	Files []string
+	// the config the service started with, its live keys are the
+	// first settings published. The keys it has from flags and the
+	// environment rather than the files hold over every reload.
+	Target *viper.Viper
+	// called with the keys applied by a reload
+	OnReload func(changed []string)
+	// called when a reload is rejected
+	OnReject func(err error)
+}
+
+type ReloaderApi interface {
+	// Watch the files and SIGHUP until the context is done
+	Watch(ctx context.Context) error
+	// Reload the files now
+	Reload() error
+}
+
+func NewReloader(config *ReloaderConfig) (ReloaderApi, error) {
+	current, err := read(config.Files)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reloader{
+		files:     config.Files,
+		onReload:  config.OnReload,
+		onReject:  config.OnReject,
+		current:   current,
+		settings:  NewSettings(config.Target),
+		overrides: overrides(config.Target, current),
+	}
+	for k, v := range r.overrides {
+		current.Set(k, v)
+	}
+	live.Store(r.settings)
+	return r, nil
+}
+
+// overrides are the keys the target has a value for that the files do
+// not give it, set by a flag or the environment
+func overrides(target *viper.Viper, files *viper.Viper) map[string]any {
+	o := make(map[string]any)
+	for _, k := range schema {
+		if !target.IsSet(k.Name) {
+			continue
+		}
+		if files.IsSet(k.Name) && fmt.Sprint(files.Get(k.Name)) == fmt.Sprint(target.Get(k.Name)) {
+			continue
+		}
+		o[k.Name] = target.Get(k.Name)
+	}
+	return o
+}
+
+// read merges the files into a config of their own
+func read(files []string) (*viper.Viper, error) {
+	v := viper.New()
+	for _, file := range files {
+		v.SetConfigFile(file)
+		if err := v.MergeInConfig(); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return v, nil
+}
+
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.reload()
+	if err != nil {
+		slog.Error("config reload rejected", "error", err)
+		if r.onReject != nil {
+			r.onReject(err)
+		}
+	}
+	return err
+}
+
+func (r *Reloader) reload() error {
+	fresh, err := read(r.files)
+	if err != nil {
+		return err
+	}
+	// validated as the service sees it, a required key may come from a flag
+	for k, v := range r.overrides {
+		fresh.Set(k, v)
+	}
+	var messages []string
+	for _, p := range Validate(fresh) {
+		if !p.Warning {
+			messages = append(messages, p.Key+": "+p.Message)
+		}
+	}
+	if len(messages) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(messages, "; "))
+	}
+	var changed, restart []string
+	for _, k := range schema {
+		if reflect.DeepEqual(r.current.Get(k.Name), fresh.Get(k.Name)) {
+			continue
+		}
+		if k.Live {
+			changed = append(changed, k.Name)
+		} else {
+			restart = append(restart, k.Name)
+		}
+	}
+	if len(restart) > 0 {
+		return fmt.Errorf("%s only change on a restart, nothing was applied", strings.Join(restart, ", "))
+	}
+	for _, key := range changed {
+		if redact.Default().Sensitive(key) {
+			slog.Info("config reload", "setting", key)
+		} else {
+			slog.Info("config reload", "setting", key, "from", r.current.Get(key), "to", fresh.Get(key))
+		}
+	}
+	r.settings = r.settings.with(fresh, changed)
+	live.Store(r.settings)
+	r.current = fresh
+	if r.onReload != nil {
+		r.onReload(changed)
+	}
+	return nil
+}
+
+func (r *Reloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// the directories are watched, editors and config maps replace
+	// the file rather than write to it
+	dirs := make(map[string]bool)
+	for _, file := range r.files {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+		// a save is often several events, reload once they settle
+		settle := time.NewTimer(time.Hour)
+		settle.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("config reload", "signal", syscall.SIGHUP)
+				r.Reload()
+			case event := <-watcher.Events:
+				if r.watched(event.Name) && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					settle.Reset(200 * time.Millisecond)
+				}
+			case <-settle.C:
+				slog.Info("config reload", "reason", "file changed")
+				r.Reload()
+			case err := <-watcher.Errors:
+				slog.Error("config watch", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watched is a config file or, in a kubernetes config map, the link
+// its files point through
+func (r *Reloader) watched(name string) bool {
+	for _, file := range r.files {
+		if filepath.Clean(name) == filepath.Clean(file) || filepath.Base(name) == "..data" {
+			return true
+		}
+	}
+	return false
+}
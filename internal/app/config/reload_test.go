@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func writeConfig(t *testing.T, file string, dir string, retries int, storage string) {
+	data := fmt.Sprintf("download:\n  directory: %s\n  path-template: \"%%s/%%s\"\n  filemode: 0644\n"+
+		"  max-conc-fragments: 4\n  retries: %d\nstorage:\n  path: %s\n", dir, retries, storage)
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload_AppliesLiveKeysOnly(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "application.yaml")
+	writeConfig(t, file, dir, 1, dir)
+	target := viper.New()
+	var changed []string
+	rejected := 0
+	reloader, err := NewReloader(&ReloaderConfig{Files: []string{file}, Target: target,
+		OnReload: func(keys []string) { changed = keys },
+		OnReject: func(error) { rejected++ }})
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+
+	writeConfig(t, file, dir, 3, dir)
+	if err := reloader.Reload(); err != nil || Live().GetInt("download.retries") != 3 {
+		t.Fatalf("Reload() = %v, retries %d, expected 3", err, Live().GetInt("download.retries"))
+	}
+	if target.IsSet("download.retries") {
+		t.Errorf("Reload() set retries on the target, expected the live settings only")
+	}
+	if len(changed) != 1 || changed[0] != "download.retries" {
+		t.Errorf("Reload() changed %v, expected download.retries", changed)
+	}
+
+	// a key that needs a restart rejects the whole reload
+	writeConfig(t, file, dir, 5, filepath.Join(dir, "elsewhere"))
+	if err := reloader.Reload(); err == nil || rejected != 1 {
+		t.Fatalf("Reload() = %v, expected it to be rejected", err)
+	}
+	if Live().GetInt("download.retries") != 3 {
+		t.Errorf("Reload() applied retries %d from a rejected reload", Live().GetInt("download.retries"))
+	}
+}
+
+func TestReload_ValidatesWithTheFlags(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "application.yaml")
+	data := fmt.Sprintf("download:\n  path-template: \"%%s/%%s\"\n  filemode: 0644\n"+
+		"  max-conc-fragments: 4\n  retries: %d\nstorage:\n  path: %s\n", 1, dir)
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// the directory comes from --dir, as cmd/options binds it
+	target := viper.New()
+	target.SetConfigFile(file)
+	if err := target.MergeInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	target.Set("download.directory", dir)
+	reloader, err := NewReloader(&ReloaderConfig{Files: []string{file}, Target: target})
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+
+	if err := os.WriteFile(file, []byte(strings.Replace(data, "retries: 1", "retries: 2", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload() = %v, expected the flag to give the required directory", err)
+	}
+	if Live().GetInt("download.retries") != 2 {
+		t.Errorf("Reload() live retries %d, expected 2", Live().GetInt("download.retries"))
+	}
+}
@@ -0,0 +1,293 @@
+package config
+
+// The keys the service reads, with their types and limits. Keys
+// not listed here are reported as unknown.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/spf13/cast"
+)
+
+type Type string
+
+const (
+	String   Type = "string"
+	Int      Type = "integer"
+	Float    Type = "number"
+	Bool     Type = "boolean"
+	Duration Type = "duration"
+	FileMode Type = "file mode"
+	Map      Type = "map"
+	List     Type = "list"
+)
+
+// Key of the config, the keys under a map are free form and left
+// to its checks
+type Key struct {
+	Name string
+	Type Type
+	// checks of the value once it has the type
+	Checks []func(value any) error
+	// when set, the value only applies if this returns true
+	When func(v Getter) bool
+	// has to be set, the service cannot start without it
+	Required bool
+	// can change while the service runs, the rest need a restart
+	Live bool
+}
+
+// Getter is the part of viper the validation reads
+type Getter interface {
+	Get(key string) any
+	IsSet(key string) bool
+	GetString(key string) string
+}
+
+var schema = []Key{
+	{Name: "cert", Type: String},
+	{Name: "key", Type: String},
+	{Name: "ssl", Type: Bool},
+	{Name: "port", Type: Int, Checks: checks(between(1, 65535))},
+	{Name: "ip", Type: String},
+	{Name: "server.port", Type: Int, Checks: checks(between(1, 65535))},
+	{Name: "server.ip", Type: String},
+	{Name: "server.cert", Type: String},
+
+	{Name: "health.timeout", Type: Duration, Checks: checks(between(0, nil))},
+	{Name: "shutdown.drain", Type: Duration, Checks: checks(between(0, nil))},
+	{Name: "shutdown.grace-period", Type: Duration, Checks: checks(between(0, nil))},
+
+	{Name: "client.address", Live: true, Type: String},
+	{Name: "client.timeout", Live: true, Type: Duration, Checks: checks(between(0, nil))},
+
+	{Name: "log.directory", Type: String, Checks: checks(writableDirectory),
+		When: func(v Getter) bool { return v.GetString("log.directory") != "" }},
+	{Name: "log.file", Type: String},
+	{Name: "log.format", Type: String, Checks: checks(oneOf("text", "json"))},
+	{Name: "log.max-size-mib", Type: Int, Checks: checks(between(1, nil))},
+	{Name: "log.max-age", Type: Duration, Checks: checks(between(0, nil))},
+	{Name: "log.max-backups", Type: Int, Checks: checks(between(0, nil))},
+	{Name: "log.compress", Type: Bool},
+	{Name: "redact.patterns", Type: List, Checks: checks(patterns)},
+
+	{Name: "log.level", Live: true, Type: String, Checks: checks(oneOf("debug", "info", "warn", "error"))},
+
+	{Name: "download.max-conc", Type: Int, Checks: checks(between(1, nil))},
+	{Name: "download.max-conc-fragments", Required: true, Live: true, Type: Int, Checks: checks(between(1, 64))},
+	{Name: "download.max-fragment-size", Live: true, Type: Int, Checks: checks(between(1, nil))},
+	{Name: "download.min-fragment-size", Live: true, Type: Int, Checks: checks(between(0, nil))},
+	{Name: "download.retries", Live: true, Type: Int, Checks: checks(between(0, 100))},
+	{Name: "download.buffer-size", Live: true, Type: Int, Checks: checks(between(512, 64<<20))},
+	{Name: "download.timeout", Live: true, Type: Duration, Checks: checks(between(0, nil))},
+	{Name: "download.stall-after", Live: true, Type: Duration, Checks: checks(between(0, nil))},
+	{Name: "download.redirects", Live: true, Type: Int, Checks: checks(between(0, 100))},
+	{Name: "download.directory", Required: true, Type: String, Checks: checks(writableDirectory)},
+	{Name: "download.path-template", Required: true, Type: String, Checks: checks(pathTemplate)},
+	{Name: "download.filemode", Required: true, Live: true, Type: FileMode, Checks: checks(ownerReadWrite)},
+	{Name: "download.disk.reserve-mib", Live: true, Type: Int, Checks: checks(between(0, nil))},
+	{Name: "download.disk.low-watermark-mib", Type: Int, Checks: checks(between(0, nil))},
+	{Name: "download.disk.high-watermark-mib", Type: Int, Checks: checks(between(0, nil))},
+	{Name: "download.disk.interval", Type: Duration, Checks: checks(between(1, nil))},
+
+	{Name: "storage.type", Type: String, Checks: checks(oneOf("leveldb", "bbolt", "memory"))},
+	{Name: "storage.path", Required: true, Type: String, Checks: checks(writableDirectory),
+		When: func(v Getter) bool { return v.GetString("storage.type") != "memory" }},
+	{Name: "storage.buffer-mib", Type: Int, Checks: checks(between(0, 1024))},
+	{Name: "storage.cache-mib", Type: Int, Checks: checks(between(0, 1024))},
+	{Name: "storage.compression", Type: String, Checks: checks(oneOf("none", "snappy", ""))},
+	{Name: "storage.recovery", Type: Bool},
+
+	{Name: "retention.enable", Type: Bool},
+	{Name: "retention.interval", Type: Duration, Checks: checks(between(1, nil))},
+	{Name: "retention.max-age", Type: Map, Checks: checks(maxAges)},
+	{Name: "retention.max-total-mib", Type: Int, Checks: checks(between(0, nil))},
+	{Name: "retention.keep-last", Type: Int, Checks: checks(between(0, nil))},
+
+	{Name: "prometheus.enable", Type: Bool},
+	{Name: "prometheus.port", Type: Int, Checks: checks(between(1, 65535))},
+	{Name: "prometheus.model", Type: String, Checks: checks(oneOf("push", "pull"))},
+	{Name: "prometheus.path", Type: String},
+	{Name: "prometheus.push.url", Required: true, Type: String, Checks: checks(httpUrl),
+		When: func(v Getter) bool {
+			return cast.ToBool(v.Get("prometheus.enable")) && v.GetString("prometheus.model") == "push"
+		}},
+	{Name: "prometheus.push.interval", Type: Duration, Checks: checks(between(0, nil))},
+	{Name: "prometheus.push.job", Type: String},
+	{Name: "prometheus.push.instance", Type: String},
+	{Name: "prometheus.push.username", Type: String},
+	{Name: "prometheus.push.password", Type: String},
+
+	{Name: "tracing.enable", Type: Bool},
+	{Name: "tracing.exporter", Type: String, Checks: checks(oneOf("otlp", "stdout", "file"))},
+	{Name: "tracing.endpoint", Required: true, Type: String,
+		When: func(v Getter) bool {
+			return cast.ToBool(v.Get("tracing.enable")) && v.GetString("tracing.exporter") == "otlp"
+		}},
+	{Name: "tracing.insecure", Type: Bool},
+	{Name: "tracing.file", Required: true, Type: String,
+		When: func(v Getter) bool {
+			return cast.ToBool(v.Get("tracing.enable")) && v.GetString("tracing.exporter") == "file"
+		}},
+	{Name: "tracing.sample-ratio", Type: Float, Checks: checks(fraction)},
+	{Name: "tracing.service-name", Type: String},
+
+	{Name: "events.enable", Type: Bool},
+	{Name: "events.kafka.bootstrap-servers", Type: String},
+	{Name: "events.kafka.client-id", Type: String},
+	{Name: "events.kafka.acks", Type: String, Checks: checks(oneOf("all", "0", "1", "-1"))},
+	{Name: "events.kafka.topic", Type: String},
+	{Name: "events.kafka.producer-id", Type: String},
+	{Name: "events.kafka.config", Type: Map},
+	{Name: "events.source", Type: String},
+	{Name: "events.progress-interval", Type: Duration, Checks: checks(between(0, nil))},
+	{Name: "events.outbox.interval", Type: Duration, Checks: checks(between(1, nil))},
+	{Name: "events.outbox.backoff", Type: Duration, Checks: checks(between(1, nil))},
+	{Name: "events.outbox.max-backoff", Type: Duration, Checks: checks(between(1, nil))},
+	{Name: "events.outbox.batch", Type: Int, Checks: checks(between(1, nil))},
+	{Name: "events.outbox.max-lag", Type: Duration, Checks: checks(between(0, nil))},
+	{Name: "events.outbox.delivery-timeout", Type: Duration, Checks: checks(between(1, nil))},
+	{Name: "events.commands.enable", Type: Bool},
+	{Name: "events.commands.topic", Required: true, Type: String,
+		When: func(v Getter) bool { return cast.ToBool(v.Get("events.commands.enable")) }},
+	{Name: "events.commands.group-id", Required: true, Type: String,
+		When: func(v Getter) bool { return cast.ToBool(v.Get("events.commands.enable")) }},
+	{Name: "events.commands.backoff", Type: Duration, Checks: checks(between(1, nil))},
+	{Name: "events.commands.config", Type: Map},
+}
+
+// cross key rules, reported against the first key
+var relations = []struct {
+	keys  [2]string
+	check func(a, b any) error
+}{
+	{[2]string{"download.min-fragment-size", "download.max-fragment-size"}, notAbove},
+	{[2]string{"download.disk.low-watermark-mib", "download.disk.high-watermark-mib"}, notAbove},
+	{[2]string{"events.outbox.backoff", "events.outbox.max-backoff"}, notAbove},
+}
+
+func checks(c ...func(value any) error) []func(value any) error {
+	return c
+}
+
+// between is an inclusive range, a nil bound is open
+func between(min any, max any) func(value any) error {
+	return func(value any) error {
+		n := cast.ToInt64(value)
+		if min != nil && n < cast.ToInt64(min) {
+			return fmt.Errorf("%v is below %v", value, min)
+		}
+		if max != nil && n > cast.ToInt64(max) {
+			return fmt.Errorf("%v is above %v", value, max)
+		}
+		return nil
+	}
+}
+
+func fraction(value any) error {
+	if f := value.(float64); f < 0 || f > 1 {
+		return fmt.Errorf("%v is not between 0 and 1", value)
+	}
+	return nil
+}
+
+// writableDirectory is a directory that exists or can be created,
+// and can be written to
+func writableDirectory(value any) error {
+	dir := filepath.Clean(value.(string))
+	for d := dir; ; d = filepath.Dir(d) {
+		info, err := os.Stat(d)
+		if os.IsNotExist(err) && filepath.Dir(d) != d {
+			continue // created on the way
+		} else if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", d)
+		}
+		f, err := os.CreateTemp(d, ".downloader-*")
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %v", d, err)
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+}
+
+func httpUrl(value any) error {
+	u, err := url.Parse(value.(string))
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http url", value)
+	}
+	return nil
+}
+
+func oneOf(values ...string) func(value any) error {
+	return func(value any) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %q", value, values)
+	}
+}
+
+// the template takes the file name and the download id
+func pathTemplate(value any) error {
+	if s := fmt.Sprintf(value.(string), "f", "id"); s == "" || strings.Contains(s, "%!") {
+		return fmt.Errorf("%q does not take the file name and the id, as in %%s/%%s", value)
+	}
+	return nil
+}
+
+// fragments are reopened to be merged, the owner has to read and write
+func ownerReadWrite(value any) error {
+	mode := value.(fs.FileMode)
+	if mode&^fs.ModePerm != 0 {
+		return fmt.Errorf("%o is not a permission, write it in octal as in 0644", uint32(mode))
+	}
+	if mode&0o600 != 0o600 {
+		return fmt.Errorf("%#o does not let the owner read and write", uint32(mode))
+	}
+	return nil
+}
+
+func patterns(value any) error {
+	for _, p := range value.([]string) {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("%q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func maxAges(value any) error {
+	for status, age := range cast.ToStringMap(value) {
+		if _, err := model.ParseDownloadStatus(status); err != nil {
+			return err
+		}
+		if _, err := cast.ToDurationE(age); err != nil {
+			return fmt.Errorf("%s: %v is not a duration", status, age)
+		}
+	}
+	return nil
+}
+
+func notAbove(a, b any) error {
+	if cast.ToInt64(a) > cast.ToInt64(b) {
+		return errors.New("is above")
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Problem with a key, warnings do not stop the service
+type Problem struct {
+	Key     string
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", level, p.Key, p.Message)
+}
+
+// Errors counts the problems that are not warnings
+func Errors(problems []Problem) int {
+	n := 0
+	for _, p := range problems {
+		if !p.Warning {
+			n++
+		}
+	}
+	return n
+}
+
+// Validate checks every key against the schema and returns all the
+// problems found, not just the first
+func Validate(v Getter) []Problem {
+	var problems []Problem
+	values := make(map[string]any)
+	for _, k := range schema {
+		if k.When != nil && !k.When(v) {
+			continue
+		}
+		if !v.IsSet(k.Name) || v.Get(k.Name) == nil {
+			if k.Required {
+				problems = append(problems, Problem{Key: k.Name, Message: "is not set"})
+			}
+			continue
+		}
+		value, err := convert(k.Type, v.Get(k.Name))
+		if err != nil {
+			problems = append(problems, Problem{Key: k.Name, Message: err.Error()})
+			continue
+		}
+		failed := false
+		for _, check := range k.Checks {
+			if err := check(value); err != nil {
+				problems = append(problems, Problem{Key: k.Name, Message: err.Error()})
+				failed = true
+			}
+		}
+		if !failed {
+			values[k.Name] = value
+		}
+	}
+	for _, r := range relations {
+		a, okA := values[r.keys[0]]
+		b, okB := values[r.keys[1]]
+		if !okA || !okB {
+			continue
+		}
+		if err := r.check(a, b); err != nil {
+			problems = append(problems, Problem{Key: r.keys[0],
+				Message: fmt.Sprintf("%v %v %s %v", a, err, r.keys[1], b)})
+		}
+	}
+	return problems
+}
+
+// convert the value to the type of the key, durations become
+// nanoseconds so the range checks apply to every number alike
+func convert(t Type, value any) (any, error) {
+	// flags are set as their pflag value
+	if f, ok := value.(pflag.Value); ok {
+		value = f.String()
+	}
+	var (
+		converted any
+		err       error
+	)
+	switch t {
+	case String:
+		converted, err = cast.ToStringE(value)
+	case Int:
+		converted, err = cast.ToInt64E(value)
+	case Float:
+		converted, err = cast.ToFloat64E(value)
+	case Bool:
+		converted, err = cast.ToBoolE(value)
+	case Duration:
+		var d time.Duration
+		d, err = cast.ToDurationE(value)
+		converted = int64(d)
+	case FileMode:
+		var mode uint32
+		mode, err = cast.ToUint32E(value)
+		converted = fs.FileMode(mode)
+	case Map:
+		converted, err = cast.ToStringMapE(value)
+	case List:
+		converted, err = cast.ToStringSliceE(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v is not a %s", value, t)
+	}
+	return converted, nil
+}
+
+// Unknown warns of the keys of a config file the schema does not
+// have, with the closest known key as a hint
+func Unknown(file string) ([]Problem, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	for _, key := range v.AllKeys() {
+		if known(key) {
+			continue
+		}
+		message := "unknown key in " + file
+		if hint := closest(key); hint != "" {
+			message += fmt.Sprintf(", did you mean %s?", hint)
+		}
+		problems = append(problems, Problem{Key: key, Message: message, Warning: true})
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Key < problems[j].Key })
+	return problems, nil
+}
+
+func known(key string) bool {
+	for _, k := range schema {
+		if key == k.Name || k.Type == Map && strings.HasPrefix(key, k.Name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// closest known key within a couple of edits, mostly - for _
+func closest(key string) string {
+	best, distance := "", 3
+	for _, k := range schema {
+		if d := edits(key, k.Name); d < distance {
+			best, distance = k.Name, d
+		}
+	}
+	return best
+}
+
+// edits is the levenshtein distance
+func edits(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
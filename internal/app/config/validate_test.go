@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func keys(problems []Problem) map[string]bool {
+	keys := make(map[string]bool)
+	for _, p := range problems {
+		keys[p.Key] = true
+	}
+	return keys
+}
+
+func TestValidate_ReportsEveryProblem(t *testing.T) {
+	v := viper.New()
+	v.Set("download.directory", t.TempDir())
+	v.Set("download.path-template", "%s")
+	v.Set("download.filemode", 0o400)
+	v.Set("download.max-conc-fragments", 1)
+	v.Set("download.min-fragment-size", 10)
+	v.Set("download.max-fragment-size", 5)
+	v.Set("download.timeout", "soon")
+	v.Set("storage.type", "leveldb")
+	actual := keys(Validate(v))
+	for _, key := range []string{"download.path-template", "download.filemode", "download.min-fragment-size",
+		"download.timeout", "storage.path"} {
+		if !actual[key] {
+			t.Errorf("Validate() = %v, expected a problem with %s", actual, key)
+		}
+	}
+	if actual["download.max-conc-fragments"] || actual["download.directory"] {
+		t.Errorf("Validate() = %v, expected max-conc-fragments and directory to be valid", actual)
+	}
+}
+
+func TestValidate_StoragePathOnlyWhenStored(t *testing.T) {
+	v := viper.New()
+	v.Set("storage.type", "memory")
+	if actual := keys(Validate(v)); actual["storage.path"] {
+		t.Errorf("Validate() = %v, expected no storage.path for memory", actual)
+	}
+}
+
+func TestUnknown_Hints(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "application.yaml")
+	data := "events:\n  enabled: true\n  kafka:\n    config:\n      retries: 3\n"
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := Unknown(file)
+	if err != nil {
+		t.Fatalf("Unknown() error = %v", err)
+	}
+	if len(problems) != 1 || problems[0].Key != "events.enabled" || !problems[0].Warning {
+		t.Fatalf("Unknown() = %v, expected a warning for events.enabled only", problems)
+	}
+}
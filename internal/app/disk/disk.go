@@ -0,0 +1,203 @@
+package disk
+
+// Free space checks and admission control for the download directory
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
+)
+
+const MiB = 1024 * 1024
+
+// Usage is a point in time view of a filesystem
+type Usage struct {
+	// bytes available to the unprivileged app user
+	Free uint64 `json:"free"`
+	// size of the filesystem in bytes
+	Total uint64 `json:"total"`
+}
+
+// GetUsage statfs's the filesystem holding the path
+func GetUsage(path string) (*Usage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, fmt.Errorf("statfs %s: %v", path, err)
+	}
+	return &Usage{
+		Free:  uint64(stat.Bavail) * uint64(stat.Bsize),
+		Total: uint64(stat.Blocks) * uint64(stat.Bsize),
+	}, nil
+}
+
+// Writable creates and removes a file in the directory
+func Writable(path string) error {
+	f, err := os.CreateTemp(path, ".writable-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+var _ MonitorApi = (*Monitor)(nil)
+
+type MonitorConfig struct {
+	// directory to watch, normally download.directory
+	Path string
+	// stop accepting new downloads below this many free bytes
+	LowWatermark uint64
+	// accept new downloads again above this many free bytes
+	HighWatermark uint64
+	// time between checks
+	Interval time.Duration
+}
+
+// Monitor polls the free space of the download directory. Admission
+// flips off below the low watermark and only back on above the high
+// watermark so a directory hovering around one value does not flap.
+type Monitor struct {
+	config    *MonitorConfig
+	metrics   metrics.MetricsApi
+	lock      sync.RWMutex
+	usage     Usage
+	accepting bool
+	err       error
+	stop      chan struct{}
+	onChange  func(accepting bool)
+}
+
+type MonitorApi interface {
+	// Watch starts polling in the background
+	Watch()
+	// Stop polling
+	Stop()
+	// Accepting is false while free space is below the low watermark
+	Accepting() bool
+	// Usage is the most recent reading
+	Usage() Usage
+	// Check reports the disk state for the health endpoint
+	Check() (interface{}, error)
+	// OnChange calls fn each time admission flips, from the poll
+	OnChange(fn func(accepting bool))
+}
+
+func NewMonitor(config *MonitorConfig, metrics metrics.MetricsApi) MonitorApi {
+	if config.HighWatermark < config.LowWatermark {
+		config.HighWatermark = config.LowWatermark
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	m := &Monitor{
+		config:    config,
+		metrics:   metrics,
+		accepting: true,
+		stop:      make(chan struct{}),
+	}
+	m.poll()
+	return m
+}
+
+func (m *Monitor) Watch() {
+	go func() {
+		ticker := time.NewTicker(m.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.poll()
+			}
+		}
+	}()
+}
+
+func (m *Monitor) Stop() {
+	close(m.stop)
+}
+
+func (m *Monitor) Accepting() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.accepting
+}
+
+func (m *Monitor) Usage() Usage {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.usage
+}
+
+func (m *Monitor) Check() (interface{}, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	details := map[string]interface{}{
+		"path":      m.config.Path,
+		"free":      m.usage.Free,
+		"total":     m.usage.Total,
+		"accepting": m.accepting,
+	}
+	if m.err != nil {
+		return details, m.err
+	}
+	if !m.accepting {
+		return details, fmt.Errorf("free space below the low watermark of %d bytes", m.config.LowWatermark)
+	}
+	return details, nil
+}
+
+func (m *Monitor) OnChange(fn func(accepting bool)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.onChange = fn
+}
+
+// poll reads the usage and tells the listener outside of the lock, it
+// may take a while to pause or resume the downloads
+func (m *Monitor) poll() {
+	if !m.read() {
+		return
+	}
+	m.lock.RLock()
+	onChange, accepting := m.onChange, m.accepting
+	m.lock.RUnlock()
+	if onChange != nil {
+		onChange(accepting)
+	}
+}
+
+// read the usage and flip admission at the watermarks, true if it
+// flipped
+func (m *Monitor) read() bool {
+	usage, err := GetUsage(m.config.Path)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.err = err
+	if err != nil {
+		slog.Warn("disk", "path", m.config.Path, "error", err)
+		return false
+	}
+	m.usage = *usage
+	flipped := false
+	if m.accepting && usage.Free < m.config.LowWatermark {
+		slog.Warn("disk below low watermark, refusing new downloads",
+			"path", m.config.Path, "free", usage.Free, "low", m.config.LowWatermark)
+		m.accepting, flipped = false, true
+	} else if !m.accepting && usage.Free > m.config.HighWatermark {
+		slog.Info("disk above high watermark, accepting new downloads",
+			"path", m.config.Path, "free", usage.Free, "high", m.config.HighWatermark)
+		m.accepting, flipped = true, true
+	}
+	if m.metrics != nil {
+		m.metrics.DiskUsage(usage.Free, usage.Total)
+		m.metrics.DiskAccepting(m.accepting)
+	}
+	return flipped
+}
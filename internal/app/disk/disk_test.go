@@ -0,0 +1,21 @@
+package disk
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMonitor_TellsTheListenerWhenAdmissionFlips(t *testing.T) {
+	m := NewMonitor(&MonitorConfig{Path: t.TempDir()}, nil).(*Monitor)
+	var changes []bool
+	m.OnChange(func(accepting bool) { changes = append(changes, accepting) })
+
+	m.config.LowWatermark, m.config.HighWatermark = math.MaxUint64, math.MaxUint64
+	m.poll()
+	m.poll()
+	m.config.LowWatermark, m.config.HighWatermark = 0, 0
+	m.poll()
+	if len(changes) != 2 || changes[0] || !changes[1] {
+		t.Errorf("changes = %v, expected [false true]", changes)
+	}
+}
@@ -12,3 +12,18 @@ func (e *ValidationError) Error() string {
 func (e *ValidationError) Unwrap() error {
 	return e.Err
 }
+
+// InsufficientStorageError is returned when the download directory
+// does not have room for a download
+type InsufficientStorageError struct {
+	Msg string
+	Err error
+}
+
+func (e *InsufficientStorageError) Error() string {
+	return e.Msg
+}
+
+func (e *InsufficientStorageError) Unwrap() error {
+	return e.Err
+}
@@ -19,3 +19,18 @@ func TestValidationError_Unwrap(t *testing.T) {
 		t.Errorf("Expected inner error, got '%v'", err)
 	}
 }
+
+func TestInsufficientStorageError_Error(t *testing.T) {
+	err := &InsufficientStorageError{Msg: "insufficient storage"}
+	if err.Error() != "insufficient storage" {
+		t.Errorf("Expected 'insufficient storage', got '%s'", err.Error())
+	}
+}
+
+func TestInsufficientStorageError_Unwrap(t *testing.T) {
+	inner := errors.New("inner error")
+	err := &InsufficientStorageError{Err: inner}
+	if !errors.Is(err, inner) {
+		t.Errorf("Expected inner error, got '%v'", err)
+	}
+}
@@ -0,0 +1,31 @@
+package health
+
+import (
+	"errors"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	appevents "github.com/matthogan/polypully-events"
+)
+
+// Events checks that the event producer can reach the brokers
+func Events(events appevents.EventsApi, timeout time.Duration) Check {
+	return func() (interface{}, error) {
+		e, ok := events.(*appevents.Events)
+		if !ok {
+			return nil, nil // disabled
+		}
+		producer, ok := e.Producer.(*kafka.Producer)
+		if !ok {
+			return nil, errors.New("no kafka producer")
+		}
+		metadata, err := producer.GetMetadata(nil, false, int(timeout.Milliseconds()))
+		if err != nil {
+			return nil, err
+		}
+		if len(metadata.Brokers) == 0 {
+			return nil, errors.New("no brokers")
+		}
+		return map[string]interface{}{"brokers": len(metadata.Brokers)}, nil
+	}
+}
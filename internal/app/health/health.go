@@ -0,0 +1,145 @@
+package health
+
+// Health reports the state of the service's dependencies as JSON
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+var _ HealthApi = (*Health)(nil)
+
+// Check returns optional details about a dependency and an error
+// if the dependency is unhealthy
+type Check func() (interface{}, error)
+
+type HealthConfig struct {
+	// a check that takes longer is down, 0 waits for it
+	Timeout time.Duration
+}
+
+type Health struct {
+	config   *HealthConfig
+	lock     sync.RWMutex
+	checks   map[string]Check
+	draining atomic.Bool
+}
+
+type HealthApi interface {
+	// Register a named check, replacing any existing check of the same name
+	Register(name string, check Check)
+	// Run all of the checks
+	Report() *Report
+	// Drain fails the report from now on, the service is shutting down
+	Drain()
+	// ServeHTTP writes the report, 503 if any check is down
+	ServeHTTP(w http.ResponseWriter, r *http.Request)
+}
+
+type Report struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckReport `json:"checks,omitempty"`
+}
+
+type CheckReport struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+	// how long the check took
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+func NewHealth(config *HealthConfig) HealthApi {
+	return &Health{config: config, checks: make(map[string]Check)}
+}
+
+func (h *Health) Register(name string, check Check) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.checks[name] = check
+}
+
+// Report runs the checks at once, a slow dependency only holds up
+// the report for the timeout
+func (h *Health) Report() *Report {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	report := &Report{Status: StatusUp, Checks: make(map[string]*CheckReport)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, run := range h.checks {
+		wg.Add(1)
+		go func(name string, run Check) {
+			defer wg.Done()
+			check := h.run(run)
+			lock.Lock()
+			defer lock.Unlock()
+			report.Checks[name] = check
+			if check.Status == StatusDown {
+				report.Status = StatusDown
+			}
+		}(name, run)
+	}
+	wg.Wait()
+	if h.draining.Load() {
+		report.Status = StatusDown
+		report.Checks["shutdown"] = &CheckReport{Status: StatusDown, Error: "draining"}
+	}
+	return report
+}
+
+func (h *Health) run(check Check) *CheckReport {
+	type result struct {
+		details interface{}
+		err     error
+	}
+	start := time.Now()
+	done := make(chan result, 1) // the check can finish after the timeout
+	go func() {
+		details, err := check()
+		done <- result{details, err}
+	}()
+	var timeout <-chan time.Time
+	if h.config.Timeout > 0 {
+		timer := time.NewTimer(h.config.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var r result
+	select {
+	case r = <-done:
+	case <-timeout:
+		r.err = fmt.Errorf("timed out after %s", h.config.Timeout)
+	}
+	report := &CheckReport{Status: StatusUp, Details: r.details,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if r.err != nil {
+		report.Status = StatusDown
+		report.Error = r.err.Error()
+	}
+	return report
+}
+
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := h.Report()
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if report.Status == StatusUp {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
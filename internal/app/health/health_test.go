@@ -0,0 +1,58 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth_Report(t *testing.T) {
+	h := NewHealth(&HealthConfig{Timeout: 50 * time.Millisecond})
+	h.Register("fast", func() (interface{}, error) { return "ok", nil })
+	h.Register("slow", func() (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+	start := time.Now()
+	report := h.Report()
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("report waited %s for the slow check", time.Since(start))
+	}
+	if report.Status != StatusDown || report.Checks["fast"].Status != StatusUp || report.Checks["slow"].Status != StatusDown {
+		t.Errorf("got %+v", report)
+	}
+	if report.Checks["slow"].LatencyMs < 50 {
+		t.Errorf("slow check latency is %vms", report.Checks["slow"].LatencyMs)
+	}
+}
+
+func TestHealth_Drain(t *testing.T) {
+	h := NewHealth(&HealthConfig{})
+	h.Register("up", func() (interface{}, error) { return nil, nil })
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d before draining", w.Code)
+	}
+	h.Drain()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report Report
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || report.Checks["shutdown"] == nil || report.Checks["up"].Status != StatusUp {
+		t.Errorf("got %d %+v while draining", w.Code, report)
+	}
+}
+
+func TestHealth_CheckError(t *testing.T) {
+	h := NewHealth(&HealthConfig{})
+	h.Register("storage", func() (interface{}, error) { return nil, errors.New("leveldb: closed") })
+	if check := h.Report().Checks["storage"]; check.Status != StatusDown || check.Error != "leveldb: closed" {
+		t.Errorf("got %+v", check)
+	}
+}
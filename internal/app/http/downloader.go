@@ -1,8 +1,12 @@
 package http
 
 import (
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -10,13 +14,23 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/codejago/polypully/downloader/internal/app/disk"
 	apperrors "github.com/codejago/polypully/downloader/internal/app/errors"
+	"github.com/codejago/polypully/downloader/internal/app/message"
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
 	model "github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/redact"
 	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/codejago/polypully/downloader/internal/app/tracing"
+	"github.com/codejago/polypully/downloader/pkg/manifest"
 	appevents "github.com/matthogan/polypully-events"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Download represents a download with some runtime aspects
@@ -33,35 +47,167 @@ type Download struct {
 	Events appevents.EventsApi
 	// Local storage for the download
 	storage storage.StorageApi
+	metrics metrics.MetricsApi
+	// closed when the download routine exits
+	done chan struct{}
+	// set when the download is cancelled on request
+	aborted atomic.Bool
+	// set when the download is paused, the fragments stay on disk
+	paused atomic.Bool
+	// one off downloads leave only the file behind
+	NoManifest bool
+	// set when the retries are changed by a config reload
+	retries atomic.Pointer[int]
+	// holds the span of the running download routine
+	traced context.Context
+	// between progress events of the running download
+	progressInterval time.Duration
+}
+
+// Trace continues the trace of the request that started the
+// download, the download outlives the request so only the span is
+// taken from its context
+func (d *Download) Trace(ctx context.Context) {
+	d.Context = trace.ContextWithSpanContext(d.Context, trace.SpanContextFromContext(ctx))
+}
+
+// traceContext is the context of the spans of the download
+func (d *Download) traceContext() context.Context {
+	if d.traced != nil {
+		return d.traced
+	}
+	return d.Context
+}
+
+// SetRetries changes the retries of the running download, the attempt
+// in flight carries on
+func (d *Download) SetRetries(retries int) {
+	d.retries.Store(&retries)
+}
+
+func (d *Download) maxRetries() int {
+	if retries := d.retries.Load(); retries != nil {
+		return *retries
+	}
+	return d.Retries
+}
+
+// Done is closed once the download has stopped for any reason
+func (d *Download) Done() <-chan struct{} {
+	return d.done
+}
+
+// Abort cancels the download on request. Fragments in flight fail
+// with the context error and the download ends up cancelled.
+func (d *Download) Abort() {
+	d.aborted.Store(true)
+	d.Cancel()
+}
+
+// Pause stops the download and keeps the fragment files and their
+// progress so Resume can carry on from there
+func (d *Download) Pause() {
+	d.paused.Store(true)
+	d.Cancel()
 }
 
 func (d *Download) downloadRoutine() {
+	defer close(d.done)
 
-	d.Status = model.DownloadRunning
+	ctx, span := tracing.Start(d.Context, "Download",
+		attribute.String("download.id", d.Id),
+		attribute.String("download.url", redact.Url(d.Uri)),
+		attribute.Int("download.size", d.FileSize),
+		attribute.Int("download.fragments", len(d.Fragments)))
+	d.traced = ctx
+	defer func() {
+		span.SetAttributes(attribute.String("download.status", d.Status.String()))
+		var err error
+		if d.Status == model.DownloadError || d.Status == model.DownloadInitError {
+			err = fmt.Errorf("download %s", d.Status)
+			if front := d.Errors.Front(); front != nil {
+				if e, ok := front.Value.(error); ok {
+					err = e
+				}
+			}
+		}
+		tracing.End(span, err)
+	}()
+
+	run := time.Now()
+	d.metrics.DownloadStarted()
+	defer func() {
+		// one failure per download, of the class of the latest error
+		if d.Status == model.DownloadError || d.Status == model.DownloadInitError {
+			if front := d.Errors.Front(); front != nil {
+				if err, ok := front.Value.(error); ok {
+					d.metrics.DownloadFailed(ErrorClass(err))
+				}
+			}
+		}
+		d.metrics.DownloadStopped(d.Status.String(), time.Since(run))
+	}()
+	// a failed download is stored with its errors, it can be resumed
+	defer func() {
+		if d.Status == model.DownloadError || d.Status == model.DownloadInitError {
+			d.EndTime = time.Now()
+			if err := d.store(); err != nil {
+				slog.ErrorContext(d.Context, "failed", "error", err)
+			}
+		}
+	}()
+
+	d.SetStatus(model.DownloadRunning)
 
 	if err := d.UpdateResource(); err != nil {
 		d.Errors.PushFront(err)
-		d.Status = model.DownloadError
+		d.SetStatus(model.DownloadError)
 		return
 	}
 
 	if d.Status != model.DownloadError {
+		stop := d.progress()
 		d.download()
+		stop()
+	}
+
+	if d.aborted.Load() {
+		d.SetStatus(model.DownloadCancelled)
+		d.EndTime = time.Now()
+		if err := d.UpdateResource(); err != nil {
+			slog.ErrorContext(d.Context, "cancel", "error", err)
+		}
+		return
+	}
+
+	if d.paused.Load() && d.Status == model.DownloadRunning {
+		d.SetStatus(model.DownloadPaused)
+		if err := d.UpdateResource(); err != nil {
+			slog.ErrorContext(d.Context, "pause", "error", err)
+		}
+		return
 	}
 
 	if d.Status == model.DownloadRunning {
-		d.Status = model.DownloadComplete
+		d.SetStatus(model.DownloadComplete)
 		d.EndTime = time.Now()
 		if err := d.finalize(); err != nil {
-			d.Status = model.DownloadError
+			d.SetStatus(model.DownloadError)
 			d.Errors.PushFront(err)
 		}
 	}
 }
 
-func (d *Download) finalize() error {
-	if err := d.CreateManifest(); err != nil {
-		return fmt.Errorf("failed to create manifest: %v", err)
+func (d *Download) finalize() (err error) {
+	_, span := tracing.Start(d.traceContext(), "finalize")
+	defer func() { tracing.End(span, err) }()
+	if err := d.ComputeChecksum(); err != nil {
+		return fmt.Errorf("failed to compute checksum: %v", err)
+	}
+	if !d.NoManifest {
+		if err := d.CreateManifest(); err != nil {
+			return fmt.Errorf("failed to create manifest: %v", err)
+		}
 	}
 	if err := d.UpdateResource(); err != nil {
 		return fmt.Errorf("failed to update resource: %v", err)
@@ -73,75 +219,169 @@ func (d *Download) UpdateResource() error {
 	if d.Status == model.DownloadError {
 		return nil
 	}
-	if err := d.storage.UpdateResource(&d.Resource); err != nil {
+	if err := d.store(); err != nil {
 		d.Errors.PushFront(err)
-		d.Status = model.DownloadError
+		d.SetStatus(model.DownloadError)
 		return err
 	}
-	if err := d.Events.Notify(appevents.NewDownloadEvent(d.Status.String(), d.Id)); err != nil {
-		d.Errors.PushFront(err)
-		d.Status = model.DownloadError
+	return nil
+}
+
+// store the resource with the event of its status, the event is
+// published by the outbox relay so the broker being down does not
+// fail the download
+func (d *Download) store() error {
+	event, err := OutboxEvent(d.traceContext(), StatusEnvelope(&d.Resource, ""))
+	if err != nil {
 		return err
 	}
-	return nil
+	return d.storage.UpdateResource(&d.Resource, event)
+}
+
+// progress sends a progress event every interval while the download
+// moves on, until stopped
+func (d *Download) progress() (stop func()) {
+	if d.progressInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(d.progressInterval)
+		defer ticker.Stop()
+		last, at := int64(d.Snapshot().BytesDownloaded()), time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				snapshot := d.Snapshot()
+				bytes := int64(snapshot.BytesDownloaded())
+				if bytes == last {
+					continue
+				}
+				data := &message.ProgressData{
+					Id:             d.Id,
+					Bytes:          bytes,
+					Size:           int64(d.FileSize),
+					Progress:       snapshot.GetProgess(),
+					BytesPerSecond: int64(float64(bytes-last) / now.Sub(at).Seconds()),
+				}
+				last, at = bytes, now
+				d.enqueue(message.NewEnvelope(message.DownloadProgressType, d.Id, d.Id, data))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// retried sends an event for each fragment that failed the attempt
+func (d *Download) retried(attempt int) {
+	for i := 0; i < len(d.Fragments); i++ {
+		f := d.Fragments[i]
+		if f.Error == nil || errors.Is(f.Error, context.Canceled) {
+			continue
+		}
+		d.enqueue(message.NewEnvelope(message.FragmentRetryType, d.Id, d.Id, &message.FragmentRetryData{
+			Id:         d.Id,
+			Fragment:   f.Index,
+			Attempt:    attempt,
+			Retries:    d.maxRetries(),
+			Progress:   f.Progress,
+			ErrorClass: ErrorClass(f.Error),
+			Error:      errorMessage(f.Error),
+		}))
+	}
+}
+
+// enqueue an event that goes with no change of the resource, one that
+// is lost is only logged
+func (d *Download) enqueue(envelope *message.Envelope) {
+	event, err := OutboxEvent(d.traceContext(), envelope)
+	if err == nil {
+		err = d.storage.Enqueue(event)
+	}
+	if err != nil {
+		slog.WarnContext(d.Context, "event", "type", envelope.Type, "error", err)
+	}
 }
 
 func (d *Download) download() {
 
-	for r := 0; r <= d.Retries; r++ {
+	for r := 0; r <= d.maxRetries(); r++ {
 
 		if err := d.InitializeFile(); err != nil {
-			d.Status = model.DownloadInitError
+			d.SetStatus(model.DownloadInitError)
 			d.Errors.PushFront(err)
-			slog.Error("failed in initialize", "status", d.Status)
+			slog.ErrorContext(d.Context, "failed in initialize", "status", d.Status)
 			break
 		}
 
-		errorChannel := d.DownloadFragments()
-		for err := range errorChannel {
-			if err != nil {
-				slog.Error("download", "filename", d.File, "error", err)
-				if r < d.Retries {
-					slog.Info("retry", "filename", d.File, "retry", r, "retries", d.Retries)
-					continue
-				}
-				d.Status = model.DownloadError
+		errs := make([]error, 0)
+		for err := range d.DownloadFragments() {
+			slog.ErrorContext(d.Context, "download", "filename", d.File, "error", err)
+			errs = append(errs, err)
+		}
+		if d.paused.Load() || d.aborted.Load() {
+			return // the fragments keep their progress
+		}
+		if len(errs) > 0 {
+			if r < d.maxRetries() {
+				slog.InfoContext(d.Context, "retry", "filename", d.File, "retry", r, "retries", d.maxRetries())
+				d.metrics.DownloadRetried()
+				d.retried(r + 1)
+				continue
+			}
+			d.SetStatus(model.DownloadError)
+			for _, err := range causes(errs) {
 				d.Errors.PushFront(err)
-				slog.Error("failed in download", "status", model.DownloadError)
 			}
+			slog.ErrorContext(d.Context, "failed in download", "status", model.DownloadError)
+			return
 		}
 
 		if err := d.MergeFiles(d.File); err != nil {
-			slog.Debug("merge", "filename", d.File, "error", err)
-			if r < d.Retries {
-				slog.Info("retry", "filename", d.File, "retry", r, "retries", d.Retries)
+			slog.DebugContext(d.Context, "merge", "filename", d.File, "error", err)
+			if r < d.maxRetries() {
+				slog.InfoContext(d.Context, "retry", "filename", d.File, "retry", r, "retries", d.maxRetries())
+				d.metrics.DownloadRetried()
 				continue
 			}
-			d.Status = model.DownloadError
+			d.SetStatus(model.DownloadError)
 			d.Errors.PushFront(err)
-			slog.Error("failed in merge", "status", model.DownloadError)
+			slog.ErrorContext(d.Context, "failed in merge", "status", model.DownloadError)
+			return
 		}
 
-		slog.Info("complete", "filename", d.File)
-		break // success or failure
+		slog.InfoContext(d.Context, "complete", "filename", d.File)
+		return
 	}
 }
 
-// cleanup in case of error
-func (d *Download) CancelDownload(filename string) {
-	d.Cancel()
-	if d.Status == model.DownloadError {
-		if err := os.Remove(filename); err != nil {
-			slog.Error("remove failed", "filename", filename, "error", err)
+// causes drops the errors of fragments that were stopped because
+// another one failed, unless there is nothing else
+func causes(errs []error) []error {
+	failed := make([]error, 0, len(errs))
+	for _, err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			failed = append(failed, err)
 		}
 	}
+	if len(failed) == 0 {
+		return errs
+	}
+	return failed
 }
 
 func (d *Download) Validate() error {
 	if d.Destination == "" {
 		return &apperrors.ValidationError{Msg: "destination not set"}
 	}
-	if d.PathTemplate == "" {
+	if d.PathTemplate == "" && d.File == "" {
 		return &apperrors.ValidationError{Msg: "path template not set"}
 	}
 	if d.MaxConcFragments == 0 {
@@ -156,15 +396,43 @@ func (d *Download) Validate() error {
 	return nil
 }
 
+// Fragments are written alongside the file and then appended to it
+// so at the end of a download both copies are on disk at once.
+const mergeOverhead = 2
+
+// CheckDiskSpace fails if the destination cannot hold the download
+// and still leave the configured reserve free. An unknown file size
+// only checks the reserve.
+func (d *Download) CheckDiskSpace() error {
+	usage, err := disk.GetUsage(d.Destination)
+	if err != nil {
+		return err
+	}
+	required := uint64(d.FileSize)*mergeOverhead + uint64(d.DiskReserve)
+	if usage.Free < required {
+		return &apperrors.InsufficientStorageError{
+			Msg: fmt.Sprintf("insufficient disk space: %d bytes required, %d available", required, usage.Free)}
+	}
+	return nil
+}
+
 func (d *Download) GetFileSize() (int64, error) {
-	resp, err := http.Head(d.Uri)
+	req, err := http.NewRequestWithContext(d.traceContext(), http.MethodHead, d.Uri, nil)
+	if err != nil {
+		return 0, redactUrl(err)
+	}
+	resp, err := http.DefaultClient.Do(tracing.Request(req))
 	if err != nil {
-		return 0, err
+		return 0, redactUrl(err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return 0, fmt.Errorf("http request error: %s", resp.Status)
 	}
+	// kept for serving the content later
+	d.ContentType = resp.Header.Get("content-type")
+	d.ETag = resp.Header.Get("etag")
+	d.LastModified = resp.Header.Get("last-modified")
 	size, err := strconv.ParseInt(resp.Header.Get("content-length"), 10, 64)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse content-length header: %v", err)
@@ -179,7 +447,7 @@ func (d *Download) BurnDirectory(structure string) error {
 			err = os.MkdirAll(path, 0755)
 		}
 		if err != nil {
-			slog.Error("mkdir", "path", path, "error", err)
+			slog.ErrorContext(d.Context, "mkdir", "path", path, "error", err)
 		}
 		return err
 	}
@@ -219,11 +487,21 @@ func (d *Download) InitializeFile() error {
 	return nil
 }
 
-func (d *Download) InitializeFragmentFile(filename string) (*os.File, error) {
+// InitializeFragmentFile opens the fragment file for writing at the
+// offset, anything after it was not counted and is dropped
+func (d *Download) InitializeFragmentFile(filename string, offset int) (*os.File, error) {
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, d.FileMode)
 	if err != nil {
 		return nil, err
 	}
+	if err := file.Truncate(int64(offset)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
 	return file, nil
 }
 
@@ -257,7 +535,9 @@ func (d *Download) MergeFile(fragmentFilename string) error {
 	return err
 }
 
-func (d *Download) MergeFiles(filename string) error {
+func (d *Download) MergeFiles(filename string) (err error) {
+	_, span := tracing.Start(d.traceContext(), "MergeFiles", attribute.Int("download.fragments", len(d.Fragments)))
+	defer func() { tracing.End(span, err) }()
 	for i := 0; i < len(d.Fragments); i++ {
 		f := d.Fragments[i]
 		if err := d.MergeFile(f.Filename); err != nil {
@@ -270,70 +550,242 @@ func (d *Download) MergeFiles(filename string) error {
 	return nil
 }
 
-// download the fragments concurrently using channels rather than
-// a latch or a semaphore.
-
+// DownloadFragments downloads up to MaxConcFragments fragments at
+// once. The first failure stops the rest of the attempt, which keep
+// their progress for the next one.
 func (d *Download) DownloadFragments() chan error {
-	var wg sync.WaitGroup                                      // wait for all fragments to download
-	errChan := make(chan error, len(d.Fragments))              // collect errors
-	fragChan := make(chan *model.Fragment, d.MaxConcFragments) // control concurrent downloads
-	// push onto the channel
-	// push onto the channel
-	go func() {
-		for _, f := range d.Fragments {
-			fragChan <- f
-		}
-		close(fragChan) // close the channel here, after all fragments have been sent
-	}()
-	// pop off the channel
-	for f := range fragChan {
+	ctx, cancel := context.WithCancel(d.traceContext())
+	defer cancel()
+	var wg sync.WaitGroup                                    // wait for all fragments to download
+	errChan := make(chan error, len(d.Fragments))            // collect errors
+	slots := make(chan struct{}, max(d.MaxConcFragments, 1)) // control concurrent downloads
+	for i := 0; i < len(d.Fragments); i++ {
+		slots <- struct{}{}
 		wg.Add(1)
 		go func(f *model.Fragment) {
 			defer wg.Done()
-			if err := d.DownloadSingleFragment(f); err != nil {
+			defer func() { <-slots }()
+			if err := d.DownloadSingleFragment(ctx, f); err != nil {
 				errChan <- err
-				d.CancelDownload(d.File)
+				cancel()
 			}
-		}(f)
+		}(d.Fragments[i])
 	}
 	wg.Wait()
 	close(errChan)
 	return errChan
 }
 
-func (d *Download) DownloadSingleFragment(f *model.Fragment) error {
-	file, err := d.InitializeFragmentFile(f.Filename)
+func (d *Download) DownloadSingleFragment(ctx context.Context, f *model.Fragment) (err error) {
+	ctx, span := tracing.Start(ctx, "DownloadSingleFragment",
+		attribute.Int("fragment.index", f.Index),
+		attribute.Int("fragment.start", f.Start),
+		attribute.Int("fragment.end", f.End))
+	defer func() { tracing.End(span, err) }()
+	// the file is the truth, the last progress saved may be behind it
+	// or ahead of it. Without a size there is no range to resume.
+	d.FragLock.Lock()
+	if info, err := os.Stat(f.Filename); err != nil || f.Size() == 0 {
+		f.Progress = 0
+	} else if int(info.Size()) < f.Progress {
+		f.Progress = int(info.Size())
+	}
+	d.FragLock.Unlock()
+	span.SetAttributes(attribute.Int("fragment.progress", f.Progress))
+	if f.Complete() {
+		return nil
+	}
+	file, err := d.InitializeFragmentFile(f.Filename, f.Progress)
 	if err != nil {
-		slog.Error("initialize", "fragmentFilename", f.Filename, "error", err)
+		slog.ErrorContext(ctx, "initialize", "fragmentFilename", f.Filename, "error", err)
+		return err
 	}
 	defer file.Close()
+	d.FragLock.Lock()
 	f.StartTime = time.Now()
+	f.EndTime = time.Time{}
 	f.Destination = file
+	d.FragLock.Unlock()
 	// download through the configured channel
-	if err = d.Client.FetchData(d.Context, &d.Resource, f); err != nil {
-		slog.Error("fetch", "fragmentFilename", f.Filename, "error", err)
+	if err = d.Client.FetchData(ctx, &d.Resource, f); err != nil {
+		slog.ErrorContext(ctx, "fetch", "fragmentFilename", f.Filename, "error", err)
 	}
+	d.FragLock.Lock()
+	f.Error = err
 	f.EndTime = time.Now()
+	d.FragLock.Unlock()
 	return err
 }
 
+// ComputeChecksum hashes the completed file
+func (d *Download) ComputeChecksum() error {
+	file, err := os.Open(d.File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	d.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
 // Create a manifest of the download alongside
 // the file.
 func (d *Download) CreateManifest() error {
-	data, err := json.MarshalIndent(d.Resource, "", "    ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal manifest: %v", err)
+	file := d.Fqfn(path.Dir(d.File), "", "manifest.json")
+	d.Manifest = file
+	if err := ToManifest(&d.Resource).Write(file, d.FileMode); err != nil {
+		return fmt.Errorf("failed to write manifest file: %v", err)
 	}
-	manifest := d.Fqfn(path.Dir(d.File), "", "manifest.json")
-	file, err := os.OpenFile(manifest, os.O_CREATE|os.O_WRONLY, d.FileMode)
+	slog.DebugContext(d.Context, "manifest", "written", file)
+	return nil
+}
+
+// ToManifest describes a completed download
+func ToManifest(r *model.Resource) *manifest.Manifest {
+	size := r.FileSize
+	if size == 0 { // the origin did not say
+		size = r.BytesDownloaded()
+	}
+	m := &manifest.Manifest{
+		Id: r.Id,
+		Artefact: manifest.Artefact{
+			Name:        path.Base(r.File),
+			Path:        r.File,
+			Size:        int64(size),
+			ContentType: r.ContentType,
+		},
+		Source: manifest.Source{
+			Url:        redact.Url(r.Uri),
+			Validators: manifest.Validators{ETag: r.ETag, LastModified: r.LastModified},
+		},
+		Digests:   map[string]string{},
+		Fragments: make([]manifest.Fragment, 0, len(r.Fragments)),
+		Labels:    r.Labels,
+		StartTime: r.StartTime,
+		EndTime:   r.EndTime,
+	}
+	if r.Sha256 != "" {
+		m.Digests["sha256"] = r.Sha256
+	}
+	for _, f := range r.Fragments {
+		m.Fragments = append(m.Fragments, manifest.Fragment{Index: f.Index, Start: int64(f.Start), End: int64(f.End)})
+	}
+	return m
+}
+
+// ReadManifest parses a manifest written by CreateManifest into the
+// completed download it describes. Manifests from before the format
+// was versioned, and the state files of the get command, are the
+// resource itself.
+func ReadManifest(path string) (*model.Resource, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to open manifest file: %v", err)
+		return nil, err
 	}
-	defer file.Close()
-	_, err = file.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write manifest file: %v", err)
+	m, err := manifest.Parse(data)
+	if err == nil {
+		return fromManifest(m, path), nil
+	} else if !errors.Is(err, manifest.ErrUnversioned) {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", path, err)
 	}
-	slog.Debug("manifest", "written", manifest)
-	return nil
+	return readResource(data, path)
+}
+
+func fromManifest(m *manifest.Manifest, path string) *model.Resource {
+	r := &model.Resource{
+		Id:           m.Id,
+		Uri:          m.Source.Url,
+		File:         m.Artefact.Path,
+		FileSize:     int(m.Artefact.Size),
+		ContentType:  m.Artefact.ContentType,
+		ETag:         m.Source.Validators.ETag,
+		LastModified: m.Source.Validators.LastModified,
+		Sha256:       m.Digests["sha256"],
+		Labels:       m.Labels,
+		StartTime:    m.StartTime,
+		EndTime:      m.EndTime,
+		Status:       model.DownloadComplete,
+		Manifest:     path,
+		Errors:       list.New(),
+		Fragments:    make(map[int]*model.Fragment),
+		FragLock:     &sync.RWMutex{},
+	}
+	for _, f := range m.Fragments {
+		r.Fragments[f.Index] = &model.Fragment{Index: f.Index, Start: int(f.Start), End: int(f.End),
+			Progress: int(f.End - f.Start + 1)}
+	}
+	return r
+}
+
+func readResource(data []byte, path string) (*model.Resource, error) {
+	// early manifests marshalled the value, which keys the fragments by
+	// index and loses the errors
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", path, err)
+	}
+	if f := fields["fragments"]; len(f) > 0 && f[0] == '{' {
+		fragments := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(f, &fragments); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %s fragments: %v", path, err)
+		}
+		list := make([]json.RawMessage, 0, len(fragments))
+		for _, fragment := range fragments {
+			list = append(list, fragment)
+		}
+		fields["fragments"], _ = json.Marshal(list)
+	}
+	if e := fields["errors"]; len(e) > 0 && e[0] == '{' {
+		fields["errors"] = json.RawMessage("[]")
+	}
+	data, _ = json.Marshal(fields)
+	r := &model.Resource{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", path, err)
+	}
+	if r.Id == "" {
+		return nil, fmt.Errorf("manifest %s has no id", path)
+	}
+	return r, nil
+}
+
+// RemoveFiles deletes what a download wrote to disk: fragment files,
+// the manifest and, unless it is kept, the file. Directories left
+// empty are removed up to the destination.
+func RemoveFiles(r *model.Resource, keepFile bool) error {
+	files := make([]string, 0, len(r.Fragments)+2)
+	for _, f := range r.Fragments {
+		files = append(files, f.Filename)
+	}
+	manifest := r.Manifest
+	if manifest == "" && r.File != "" && strings.Contains(path.Dir(r.File), r.Id) {
+		// records older than the manifest field, in a directory of their own
+		manifest = path.Join(path.Dir(r.File), "manifest.json")
+	}
+	files = append(files, manifest)
+	if !keepFile {
+		files = append(files, r.File)
+	}
+	var err error
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if e := os.Remove(f); e != nil && !os.IsNotExist(e) && err == nil {
+			err = fmt.Errorf("failed to remove %s: %v", f, e)
+		}
+	}
+	if r.File == "" || r.Destination == "" {
+		return err
+	}
+	for dir := path.Dir(r.File); strings.HasPrefix(dir, r.Destination) && dir != path.Clean(r.Destination); dir = path.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty
+		}
+	}
+	return err
 }
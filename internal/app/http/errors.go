@@ -0,0 +1,80 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"syscall"
+
+	apperrors "github.com/codejago/polypully/downloader/internal/app/errors"
+	"github.com/codejago/polypully/downloader/internal/app/redact"
+)
+
+// StatusError is a response with a status the download cannot use
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// TruncatedError is a body shorter than the range asked for
+type TruncatedError struct {
+	Received int
+	Expected int
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("error downloading: %d of %d bytes received", e.Received, e.Expected)
+}
+
+// redactUrl takes the credentials out of the url of a failed request,
+// the error is kept with the resource and logged
+func redactUrl(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redact.Url(urlErr.URL)
+	}
+	return err
+}
+
+// ErrorClass groups the errors that fail downloads for the metrics
+func ErrorClass(err error) string {
+	var status *StatusError
+	var truncated *TruncatedError
+	var dns *net.DNSError
+	var netErr net.Error
+	var validation *apperrors.ValidationError
+	var storage *apperrors.InsufficientStorageError
+	var path *fs.PathError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.As(err, &status):
+		if status.Code >= 400 && status.Code < 600 {
+			return fmt.Sprintf("http_%dxx", status.Code/100)
+		}
+		return "http_unexpected"
+	case errors.As(err, &truncated), errors.Is(err, io.ErrUnexpectedEOF):
+		return "truncated"
+	case errors.As(err, &dns):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		return "connection"
+	case errors.As(err, &validation):
+		return "validation"
+	case errors.As(err, &storage), errors.Is(err, syscall.ENOSPC), errors.As(err, &path):
+		return "disk"
+	}
+	return "other"
+}
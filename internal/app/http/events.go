@@ -0,0 +1,79 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/message"
+	model "github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/redact"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/codejago/polypully/downloader/internal/app/tracing"
+)
+
+var encoder = message.NewEncoder()
+
+// StatusEnvelope reports the state of the resource, status is the
+// status of the resource when empty
+func StatusEnvelope(r *model.Resource, status string) *message.Envelope {
+	if status == "" {
+		status = r.Status.String()
+	}
+	data := &message.DownloadData{
+		Id:          r.Id,
+		Status:      status,
+		Uri:         redact.Url(r.Uri),
+		File:        r.File,
+		Size:        int64(r.FileSize),
+		ContentType: r.ContentType,
+		Labels:      r.Labels,
+	}
+	if r.Fragments != nil {
+		data.Bytes = int64(r.BytesDownloaded())
+	}
+	if r.Sha256 != "" {
+		data.Checksums = map[string]string{"sha256": r.Sha256}
+	}
+	if r.Errors != nil {
+		for e := r.Errors.Front(); e != nil; e = e.Next() {
+			err, ok := e.Value.(error)
+			if !ok {
+				continue
+			}
+			if data.ErrorClass == "" {
+				data.ErrorClass = ErrorClass(err)
+			}
+			data.Errors = append(data.Errors, errorMessage(err))
+		}
+	}
+	if !r.StartTime.IsZero() {
+		end := r.EndTime
+		if end.IsZero() {
+			end = time.Now()
+		}
+		data.DurationMs = end.Sub(r.StartTime).Milliseconds()
+	}
+	return message.NewEnvelope(message.DownloadStatusType, r.Id, r.Id, data)
+}
+
+// OutboxEvent is the envelope to store for the relay, in the trace of
+// the context
+func OutboxEvent(ctx context.Context, envelope *message.Envelope) (*storage.OutboxEvent, error) {
+	event, err := envelope.Event(encoder)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewOutboxEvent(event, tracing.Carrier(ctx)), nil
+}
+
+// errorMessage without the credentials of the url of a request
+func errorMessage(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return strings.ReplaceAll(err.Error(), urlErr.URL, redact.Url(urlErr.URL))
+	}
+	return err.Error()
+}
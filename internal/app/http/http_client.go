@@ -9,23 +9,36 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
 	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/tracing"
 )
 
 // static conversion check
 var _ model.CommunicationClient = (*HttpClient)(nil)
 
 type HttpClient struct {
-	client *http.Client
+	client     *http.Client
+	metrics    metrics.MetricsApi
+	stallAfter time.Duration
 }
 
 type HttpClientConfig struct {
 	Timeout   time.Duration
 	Redirects int
+	// a fetch that receives nothing for this long is counted as a
+	// stall, 0 does not watch
+	StallAfter time.Duration
+	Metrics    metrics.MetricsApi
 }
 
 func NewHttpClient(h *HttpClientConfig) *HttpClient {
+	if h.Metrics == nil {
+		h.Metrics = metrics.NewMetrics(metrics.MetricsConfig{})
+	}
 	return &HttpClient{
+		metrics:    h.Metrics,
+		stallAfter: h.StallAfter,
 		client: &http.Client{
 			Timeout: h.Timeout,
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -47,40 +60,108 @@ func NewHttpClient(h *HttpClientConfig) *HttpClient {
 // FetchData fetches a fragment of data from the resource
 // and writes it to the destination fragment file. The
 // context is used to enable cancellation of the fetch.
+// A fragment with progress continues after the bytes it has.
 func (h *HttpClient) FetchData(context context.Context, d *model.Resource, fragment *model.Fragment) error {
-	slog.Debug("download", "Fragment", fragment)
+	slog.DebugContext(context, "download", "Fragment", fragment)
 	req, err := http.NewRequestWithContext(context, "GET", d.Uri, nil)
 	if err != nil {
-		return fmt.Errorf("error creating request: %v", err)
+		return fmt.Errorf("error creating request: %v", redactUrl(err))
 	}
-	if len(d.Fragments) > 1 && fragment.End > fragment.Start {
-		rangeHeader := "bytes=" + strconv.FormatInt(int64(fragment.Start), 10) + "-" +
+	start := fragment.Start + fragment.Progress
+	ranged := fragment.Size() > 0 && (len(d.Fragments) > 1 || start > fragment.Start)
+	if ranged {
+		rangeHeader := "bytes=" + strconv.FormatInt(int64(start), 10) + "-" +
 			strconv.FormatInt(int64(fragment.End), 10)
 		req.Header.Add("Range", rangeHeader)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	req = tracing.Request(req)
+	sent := time.Now()
+	resp, err := h.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error downloading: %v", err)
+		return fmt.Errorf("error downloading: %w", redactUrl(err))
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-		return fmt.Errorf("error downloading: %v", err)
+	h.metrics.FirstByte(time.Since(sent))
+	// a whole body in answer to a range would corrupt the fragment
+	if ranged && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("error downloading range %d-%d: %w", start, fragment.End,
+			&StatusError{Code: resp.StatusCode, Status: resp.Status})
+	}
+	if !ranged && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading: %w", &StatusError{Code: resp.StatusCode, Status: resp.Status})
+	}
+	host := req.URL.Hostname()
+	progress := h.watchStalls(d, fragment)
+	defer close(progress)
+	size := d.BufferSize
+	if size <= 0 {
+		size = 32 * 1024
 	}
-	buf := make([]byte, d.BufferSize)
+	buf := make([]byte, size)
 	for {
 		read, err := resp.Body.Read(buf)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("error reading: %v", err)
+		if read > 0 {
+			if _, err := fragment.Destination.Write(buf[:read]); err != nil {
+				return fmt.Errorf("error writing: %w", err)
+			}
+			d.FragLock.Lock() // read by the status of a running download
+			fragment.Progress += read
+			d.FragLock.Unlock()
+			h.metrics.BytesDownloaded(host, read)
+			select {
+			case progress <- struct{}{}:
+			default:
+			}
 		}
-		if read == 0 {
+		if err == io.EOF {
 			break
 		}
-		_, err = fragment.Destination.Write(buf[:read])
 		if err != nil {
-			return fmt.Errorf("error writing: %v", err)
+			return fmt.Errorf("error reading: %w", err)
 		}
-		fragment.Progress += read
 	}
-	slog.Debug("write", "wrote", fragment.Progress, "from", fragment.End-fragment.Start)
+	slog.DebugContext(context, "write", "wrote", fragment.Progress, "from", fragment.Size())
+	if fragment.Size() > 0 && fragment.Progress != fragment.Size() {
+		return &TruncatedError{Received: fragment.Progress, Expected: fragment.Size()}
+	}
+	h.metrics.FragmentFetched(time.Since(sent))
 	return nil
 }
+
+// watchStalls counts a stall each time the fetch receives nothing for
+// stallAfter, until the returned channel is closed. The fetch carries
+// on, a timeout is for download.timeout.
+func (h *HttpClient) watchStalls(d *model.Resource, fragment *model.Fragment) chan struct{} {
+	progress := make(chan struct{}, 1)
+	if h.stallAfter <= 0 {
+		return progress // sends are dropped
+	}
+	go func() {
+		timer := time.NewTimer(h.stallAfter)
+		defer timer.Stop()
+		stalled := false
+		for {
+			select {
+			case _, ok := <-progress:
+				if !ok {
+					return
+				}
+				stalled = false
+			case <-timer.C:
+				if !stalled {
+					slog.Warn("stalled", "id", d.Id, "fragment", fragment.Index, "after", h.stallAfter)
+					h.metrics.DownloadStalled()
+					stalled = true
+				}
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(h.stallAfter)
+		}
+	}()
+	return progress
+}
@@ -0,0 +1,81 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+func TestFetchData_ResumesFromProgress(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "f", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	var written bytes.Buffer
+	f := &model.Fragment{Start: 10, End: 19, Progress: 4, Destination: &written}
+	r := &model.Resource{FragLock: &sync.RWMutex{}, Uri: origin.URL, BufferSize: 3, Fragments: map[int]*model.Fragment{0: {}, 1: f}}
+	if err := NewHttpClient(&HttpClientConfig{}).FetchData(context.Background(), r, f); err != nil {
+		t.Fatalf("FetchData() error = %v", err)
+	}
+	if written.String() != "efghij" || f.Progress != 10 || !f.Complete() {
+		t.Errorf("FetchData() wrote %q, progress %d, expected efghij and 10", written.String(), f.Progress)
+	}
+}
+
+func TestFetchData_RejectsIgnoredRange(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer origin.Close()
+
+	var written bytes.Buffer
+	f := &model.Fragment{Start: 0, End: 4, Destination: &written}
+	r := &model.Resource{FragLock: &sync.RWMutex{}, Uri: origin.URL, BufferSize: 3, Fragments: map[int]*model.Fragment{0: f, 1: {}}}
+	err := NewHttpClient(&HttpClientConfig{}).FetchData(context.Background(), r, f)
+	if err == nil || !strings.Contains(err.Error(), "200") || written.Len() != 0 {
+		t.Errorf("FetchData() error = %v, wrote %d bytes, expected the 200 rejected", err, written.Len())
+	}
+}
+
+func TestFetchData_ErrorClasses(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/short" {
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("01234"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer origin.Close()
+
+	for path, expected := range map[string]string{"/missing": "http_4xx", "/short": "truncated"} {
+		f := &model.Fragment{Start: 0, End: 9, Destination: &bytes.Buffer{}}
+		r := &model.Resource{FragLock: &sync.RWMutex{}, Uri: origin.URL + path, Fragments: map[int]*model.Fragment{0: f}}
+		err := NewHttpClient(&HttpClientConfig{}).FetchData(context.Background(), r, f)
+		if actual := ErrorClass(err); actual != expected {
+			t.Errorf("ErrorClass(%v) = %s, expected %s", err, actual, expected)
+		}
+	}
+}
+
+func TestFetchData_ErrorWithoutCredentials(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	uri := origin.URL + "/f?X-Amz-Signature=abc123"
+	origin.Close() // refused
+
+	f := &model.Fragment{Start: 0, End: 9, Destination: &bytes.Buffer{}}
+	r := &model.Resource{FragLock: &sync.RWMutex{}, Uri: uri, Fragments: map[int]*model.Fragment{0: f}}
+	err := NewHttpClient(&HttpClientConfig{}).FetchData(context.Background(), r, f)
+	if err == nil || strings.Contains(err.Error(), "abc123") {
+		t.Errorf("FetchData() error = %v, expected one without the signature", err)
+	}
+}
@@ -5,104 +5,182 @@ import (
 	"context"
 	"fmt"
 	"io/fs"
+	"log/slog"
+	"net/url"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/codejago/polypully/downloader/internal/app/config"
+	"github.com/codejago/polypully/downloader/internal/app/disk"
+	apperrors "github.com/codejago/polypully/downloader/internal/app/errors"
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
 	model "github.com/codejago/polypully/downloader/internal/app/model"
 	"github.com/codejago/polypully/downloader/internal/app/storage"
 	appevents "github.com/matthogan/polypully-events"
 
 	"github.com/google/uuid"
 	"github.com/spf13/viper"
-	"golang.org/x/exp/slog"
 )
 
 // ContextKey is a type for the context key in the Context
 type ContextKey string
 
 // Download represents a download and is cancellable
-func NewDownload(uri string, events appevents.EventsApi, storage storage.StorageApi) Download {
-	id := uuid.New().String()
+func NewDownload(uri string, events appevents.EventsApi, storage storage.StorageApi, metrics metrics.MetricsApi) Download {
+	settings := config.Live()
+	return newDownload(model.Resource{
+		Id:               uuid.New().String(),
+		Uri:              uri,
+		Destination:      viper.GetString("download.directory"),
+		PathTemplate:     viper.GetString("download.path-template"),
+		MaxConcFragments: settings.GetInt("download.max-conc-fragments"),
+		MaxFragmentSz:    settings.GetInt("download.max-fragment-size"),
+		MinFragmentSz:    settings.GetInt("download.min-fragment-size"),
+		Retries:          settings.GetInt("download.retries"),
+		FileMode:         fs.FileMode(settings.GetUint32("download.filemode")),
+		BufferSize:       settings.GetInt("download.buffer-size"),
+		DiskReserve:      settings.GetInt("download.disk.reserve-mib") * disk.MiB,
+		Errors:           list.New(),
+		Fragments:        make(map[int]*model.Fragment),
+		FragLock:         &sync.RWMutex{},
+	}, events, storage, metrics)
+}
+
+// RestoreDownload wraps a stored resource so it can be resumed
+func RestoreDownload(resource *model.Resource, events appevents.EventsApi, storage storage.StorageApi,
+	metrics metrics.MetricsApi) Download {
+	return newDownload(*resource, events, storage, metrics)
+}
+
+func newDownload(resource model.Resource, events appevents.EventsApi, storage storage.StorageApi,
+	metrics metrics.MetricsApi) Download {
 	ctx, cancel := context.WithCancel(context.Background())
-	ctx = context.WithValue(ctx, ContextKey("download_id"), id)
+	ctx = context.WithValue(ctx, ContextKey("download_id"), resource.Id)
+	settings := config.Live()
 	return Download{ // struct
-		Resource: model.Resource{
-			Id:               id,
-			Uri:              uri,
-			Destination:      viper.GetString("download.directory"),
-			PathTemplate:     viper.GetString("download.path-template"),
-			MaxConcFragments: viper.GetInt("download.max-conc-fragments"),
-			MaxFragmentSz:    viper.GetInt("download.max-fragment-size"),
-			MinFragmentSz:    viper.GetInt("download.min-fragment-size"),
-			Retries:          viper.GetInt("download.retries"),
-			FileMode:         fs.FileMode(viper.GetUint32("download.filemode")),
-			BufferSize:       viper.GetInt("download.buffer-size"),
-			Errors:           list.New(),
-			Fragments:        make(map[int]*model.Fragment),
-			FragLock:         &sync.RWMutex{},
-		},
+		Resource: resource,
 		Client: NewHttpClient(&HttpClientConfig{
-			Timeout:   viper.GetDuration("download.timeout"),
-			Redirects: viper.GetInt("download.redirects")}),
+			Timeout:    settings.GetDuration("download.timeout"),
+			Redirects:  settings.GetInt("download.redirects"),
+			StallAfter: settings.GetDuration("download.stall-after"),
+			Metrics:    metrics}),
 		Context: ctx,
 		Cancel: func() {
-			slog.Info("cancelling", "id", ctx.Value(ContextKey("download_id")))
+			slog.InfoContext(ctx, "cancelling")
 			cancel()
 		},
 		Events:  events,
 		storage: storage,
+		metrics: metrics,
+		done:    make(chan struct{}),
+		// 0 sends none
+		progressInterval: viper.GetDuration("events.progress-interval"),
 	}
 }
 
+// Download prepares a new download and starts it
 func (d *Download) Download() error {
+	if err := d.Prepare(); err != nil {
+		return err
+	}
+	d.Start()
+	return nil
+}
+
+// Prepare sizes and splits a new download without starting it, so it
+// can be stored first. The file is named after the URL under the path
+// template unless the caller has already set it.
+func (d *Download) Prepare() error {
 
-	d.Status = model.DownloadInitialising
+	d.SetStatus(model.DownloadInitialising)
 	d.StartTime = time.Now()
 	if err := d.Validate(); err != nil {
-		slog.Error("validate", "error", err)
-		d.Status = model.DownloadError
-		return err
+		slog.ErrorContext(d.Context, "validate", "error", err)
+		d.SetStatus(model.DownloadError)
+		return d.refused(err)
 	}
+	// named after the url path, the query can hold a signature
 	filename := path.Base(d.Uri)
+	if u, err := url.Parse(d.Uri); err == nil && path.Base(u.Path) != "." && path.Base(u.Path) != "/" {
+		filename = path.Base(u.Path)
+	}
 	dir := d.PathTemplate
-	if dir != "" {
+	if d.File != "" {
+		dir = strings.TrimPrefix(path.Dir(d.File), d.Destination)
+	} else if dir != "" {
 		dir = fmt.Sprintf(dir, filename, d.Id)
 	}
 	if err := d.BurnDirectory(dir); err != nil {
-		d.Status = model.DownloadError
-		return fmt.Errorf("burn directory: %w", err)
+		d.SetStatus(model.DownloadError)
+		return d.refused(fmt.Errorf("burn directory: %w", err))
 	}
 	size, err := d.GetFileSize()
 	if err != nil {
-		slog.Info("file size", "error", err) // content-length is not always present
+		slog.InfoContext(d.Context, "file size", "error", err) // content-length is not always present
 		err = nil
 	}
 	d.FileSize = int(size)
-	d.File = d.Fqfn(d.Destination, dir, filename) // fqfn
-	slog.Debug("download", "filename", d.File)
+	if err := d.CheckDiskSpace(); err != nil {
+		d.SetStatus(model.DownloadError)
+		return d.refused(err)
+	}
+	if d.File == "" {
+		d.File = d.Fqfn(d.Destination, dir, filename) // fqfn
+	}
+	slog.DebugContext(d.Context, "download", "filename", d.File)
 
 	d.Fragments = d.fragments()
-	slog.Debug("download", "fragments", len(d.Fragments))
+	slog.DebugContext(d.Context, "download", "fragments", len(d.Fragments))
+	return nil
+}
 
+// Start runs a prepared download, from then on the routine owns it
+func (d *Download) Start() {
 	go d.downloadRoutine()
+}
+
+// refused records a download that failed before it could run
+func (d *Download) refused(err error) error {
+	d.Errors.PushFront(err)
+	d.metrics.DownloadStarted()
+	d.metrics.DownloadFailed(ErrorClass(err))
+	d.metrics.DownloadStopped(d.Status.String(), time.Since(d.StartTime))
 	return err
 }
 
+// Resume carries on with a paused or failed download from the
+// progress of its fragments
+func (d *Download) Resume() error {
+	if d.Status != model.DownloadPaused && d.Status != model.DownloadError {
+		return &apperrors.ValidationError{Msg: fmt.Sprintf("a %s download cannot be resumed", d.Status)}
+	}
+	if d.File == "" || len(d.Fragments) == 0 {
+		return &apperrors.ValidationError{Msg: "download has no fragments to resume"}
+	}
+	d.Errors.Init()
+	d.EndTime = time.Time{}
+	go d.downloadRoutine()
+	return nil
+}
+
 // calculate the fragments based on the max concurrent downloads
 // and fragment size configuration parameters.
 func (d *Download) fragments() map[int]*model.Fragment {
 	fragments := make(map[int]*model.Fragment)
 	fragmentSize := d.MaxFragmentSz
-	nFragments := int(d.FileSize/fragmentSize) + 1
 	if d.FileSize <= d.MinFragmentSz {
 		d.MaxConcFragments = 1
-		nFragments = 1
 		fragmentSize = d.FileSize
 	} else if d.FileSize < d.MaxFragmentSz {
-		fragmentSize = int(d.FileSize / (d.MaxConcFragments - 1))
-		nFragments = int(d.FileSize/fragmentSize) + 1
+		fragmentSize = int(d.FileSize / max(d.MaxConcFragments-1, 1))
+	}
+	// round up, an exact multiple must not leave an empty last fragment
+	nFragments := 1
+	if fragmentSize > 0 {
+		nFragments = (d.FileSize + fragmentSize - 1) / fragmentSize
 	}
 	// create the fragments
 	// last one will be an odd size
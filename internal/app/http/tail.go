@@ -0,0 +1,101 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	model "github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+// how often a tail looks for new bytes
+const tailPoll = 250 * time.Millisecond
+
+// Tail reads the bytes of a running download in order as they
+// arrive. Bytes come from the fragment files while they are being
+// written and from the file once the fragments have been merged into
+// it. Reads block until bytes are available or the download stops.
+type Tail struct {
+	ctx      context.Context
+	download *Download
+	offset   int64
+}
+
+// Tail returns a reader over the download that follows it to the end
+func (d *Download) Tail(ctx context.Context) io.Reader {
+	return &Tail{ctx: ctx, download: d}
+}
+
+func (t *Tail) Read(p []byte) (int, error) {
+	for {
+		n, err := t.read(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		select {
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		case <-t.download.Done():
+			// the routine has exited so the file is final
+			if n, err := t.read(p); n > 0 || err != nil {
+				return n, err
+			}
+			if status := t.download.GetStatus(); status != model.DownloadComplete {
+				return 0, fmt.Errorf("download %s stopped: %s", t.download.Id, status)
+			}
+			return 0, io.EOF
+		case <-time.After(tailPoll):
+		}
+	}
+}
+
+// read whatever is available at the offset without blocking
+func (t *Tail) read(p []byte) (int, error) {
+	n, err := readAt(t.download.File, t.offset, p)
+	if n == 0 && err == nil {
+		if f := t.fragment(); f != nil {
+			start, end := int64(f.Start), int64(f.End)
+			if end >= start && int64(len(p)) > end-t.offset+1 {
+				p = p[:end-t.offset+1]
+			}
+			n, err = readAt(f.Filename, t.offset-start, p)
+		}
+	}
+	t.offset += int64(n)
+	return n, err
+}
+
+// fragment holding the offset, a copy taken under the lock
+func (t *Tail) fragment() *model.Fragment {
+	t.download.FragLock.RLock()
+	defer t.download.FragLock.RUnlock()
+	for _, f := range t.download.Fragments {
+		start, end := int64(f.Start), int64(f.End)
+		if t.offset < start || (end >= start && t.offset > end) {
+			continue
+		}
+		fragment := *f
+		return &fragment
+	}
+	return nil
+}
+
+// readAt treats a missing file or a short read as nothing to read yet
+func readAt(filename string, offset int64, p []byte) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+	n, err := file.ReadAt(p, offset)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,53 @@
+package inbound
+
+// Commands arrive on a stream as well as over the api. A consumer
+// hands the messages to a handler one at a time and commits each once
+// the handler has stored its outcome, a message whose handler fails is
+// delivered again. Delivery is at least once.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Command is the value of a message, JSON encoded
+type Command struct {
+	// the reply carries it as its correlation id
+	Id string `json:"id,omitempty"`
+	// download, cancel or pause
+	Action string `json:"action"`
+	// of the download to cancel or pause
+	DownloadId string `json:"download_id,omitempty"`
+	// to download
+	Url    string            `json:"url,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type Message struct {
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+}
+
+// Handler processes a message, an error leaves it uncommitted to be
+// delivered again
+type Handler func(ctx context.Context, message *Message) error
+
+type ConsumerApi interface {
+	// Consume hands the messages to the handler until the context is
+	// done
+	Consume(ctx context.Context, handler Handler) error
+	// Close leaves the stream, what is not committed is delivered to
+	// the next consumer
+	Close() error
+}
+
+// Decode the command of a message
+func Decode(message *Message) (*Command, error) {
+	command := &Command{}
+	if err := json.Unmarshal(message.Value, command); err != nil {
+		return nil, fmt.Errorf("not a command: %v", err)
+	}
+	return command, nil
+}
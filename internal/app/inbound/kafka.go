@@ -0,0 +1,102 @@
+package inbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+var _ ConsumerApi = (*Kafka)(nil)
+
+type KafkaConfig struct {
+	// comma separated list of brokers, as for the producer
+	BootstrapServers string
+	ClientId         string
+	// the consumers of a group share the partitions of the topic
+	GroupId string
+	Topic   string
+	// before a message whose handler failed is delivered again
+	Backoff time.Duration
+	// any other kafka consumer config
+	Config map[string]string
+}
+
+// Kafka consumes a topic with the offsets committed by hand, after
+// the handler
+type Kafka struct {
+	config   *KafkaConfig
+	consumer *kafka.Consumer
+}
+
+func NewKafka(config *KafkaConfig) (ConsumerApi, error) {
+	if config.BootstrapServers == "" || config.GroupId == "" || config.Topic == "" {
+		return nil, errors.New("bootstrap servers, group id and topic are required")
+	}
+	kafkaConfig := kafka.ConfigMap{
+		"bootstrap.servers":  config.BootstrapServers,
+		"client.id":          config.ClientId,
+		"group.id":           config.GroupId,
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": false}
+	for k, v := range config.Config {
+		kafkaConfig[k] = v
+	}
+	consumer, err := kafka.NewConsumer(&kafkaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %v", err)
+	}
+	if err := consumer.SubscribeTopics([]string{config.Topic}, nil); err != nil {
+		consumer.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %v", config.Topic, err)
+	}
+	slog.Info("consumer connected", "topic", config.Topic, "group", config.GroupId)
+	return &Kafka{config: config, consumer: consumer}, nil
+}
+
+func (k *Kafka) Consume(ctx context.Context, handler Handler) error {
+	for ctx.Err() == nil {
+		msg, err := k.consumer.ReadMessage(100 * time.Millisecond)
+		if err != nil {
+			var kafkaErr kafka.Error
+			if errors.As(err, &kafkaErr) && kafkaErr.IsFatal() {
+				return err
+			}
+			if !errors.As(err, &kafkaErr) || kafkaErr.Code() != kafka.ErrTimedOut {
+				slog.WarnContext(ctx, "consumer", "error", err)
+			}
+			continue
+		}
+		if err := handler(ctx, message(msg)); err != nil {
+			slog.WarnContext(ctx, "command", "offset", msg.TopicPartition.Offset.String(), "error", err)
+			// polling goes on so the group keeps the partition
+			if err := k.consumer.Seek(msg.TopicPartition, 0); err != nil {
+				return fmt.Errorf("failed to seek back to offset %s: %v", msg.TopicPartition.Offset, err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(k.config.Backoff):
+			}
+			continue
+		}
+		if _, err := k.consumer.CommitMessage(msg); err != nil {
+			slog.WarnContext(ctx, "consumer commit", "offset", msg.TopicPartition.Offset.String(), "error", err)
+		}
+	}
+	return nil
+}
+
+func (k *Kafka) Close() error {
+	return k.consumer.Close()
+}
+
+func message(msg *kafka.Message) *Message {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, h := range msg.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	return &Message{Key: msg.Key, Value: msg.Value, Headers: headers}
+}
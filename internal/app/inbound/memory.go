@@ -0,0 +1,104 @@
+package inbound
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var _ MemoryApi = (*Memory)(nil)
+
+// Memory is a stream held in memory, for tests and running offline.
+// Like a partition it is a log and an offset, what is not committed is
+// delivered again by the next Consume.
+type Memory struct {
+	backoff  time.Duration
+	lock     sync.Mutex
+	messages []*Message
+	offset   int
+	// signalled on a send
+	sent chan struct{}
+}
+
+type MemoryApi interface {
+	ConsumerApi
+	// Send a message to the stream
+	Send(message *Message)
+	// SendCommand sends a command as a message
+	SendCommand(command *Command) error
+	// Committed is the offset of the next message to consume
+	Committed() int
+}
+
+// NewMemory delivers a message whose handler fails again after the
+// backoff
+func NewMemory(backoff time.Duration) MemoryApi {
+	return &Memory{backoff: backoff, sent: make(chan struct{}, 1)}
+}
+
+func (m *Memory) Send(message *Message) {
+	m.lock.Lock()
+	m.messages = append(m.messages, message)
+	m.lock.Unlock()
+	select {
+	case m.sent <- struct{}{}:
+	default: // the consumer is already woken
+	}
+}
+
+func (m *Memory) SendCommand(command *Command) error {
+	value, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	m.Send(&Message{Value: value})
+	return nil
+}
+
+func (m *Memory) Committed() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.offset
+}
+
+// next message to consume, nil when there is none
+func (m *Memory) next() *Message {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.offset < len(m.messages) {
+		return m.messages[m.offset]
+	}
+	return nil
+}
+
+func (m *Memory) Consume(ctx context.Context, handler Handler) error {
+	for {
+		message := m.next()
+		if message == nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-m.sent:
+				continue
+			}
+		}
+		if err := handler(ctx, message); err != nil {
+			slog.WarnContext(ctx, "command", "error", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(m.backoff):
+				continue
+			}
+		}
+		m.lock.Lock()
+		m.offset++
+		m.lock.Unlock()
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
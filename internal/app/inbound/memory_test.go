@@ -0,0 +1,67 @@
+package inbound
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemory_CommitsAfterTheHandler(t *testing.T) {
+	stream := NewMemory(time.Millisecond)
+	stream.SendCommand(&Command{Id: "1", Action: "download", Url: "http://origin/a"})
+	stream.SendCommand(&Command{Id: "2", Action: "pause", DownloadId: "d"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	failures := 1
+	var handled []string
+	stream.Consume(ctx, func(ctx context.Context, message *Message) error {
+		command, err := Decode(message)
+		if err != nil {
+			t.Error(err)
+		}
+		if command.Id == "2" && failures > 0 {
+			failures--
+			return errors.New("store unavailable")
+		}
+		handled = append(handled, command.Id)
+		if command.Id == "2" {
+			cancel()
+		}
+		return nil
+	})
+	if stream.Committed() != 2 || len(handled) != 2 || handled[1] != "2" {
+		t.Errorf("committed %d, handled %v, expected both with the second again", stream.Committed(), handled)
+	}
+}
+
+func TestMemory_RedeliversWhatWasNotCommitted(t *testing.T) {
+	stream := NewMemory(time.Hour)
+	stream.Send(&Message{Value: []byte(`{"action":"download"}`)})
+	ctx, cancel := context.WithCancel(context.Background())
+	handled := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stream.Consume(ctx, func(ctx context.Context, message *Message) error {
+			close(handled)
+			return errors.New("store unavailable")
+		})
+	}()
+	<-handled
+	cancel()
+	<-done
+	if stream.Committed() != 0 {
+		t.Fatalf("committed %d, expected nothing", stream.Committed())
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stream.Consume(ctx, func(ctx context.Context, message *Message) error {
+		cancel()
+		return nil
+	})
+	if stream.Committed() != 1 {
+		t.Errorf("committed %d, expected the message again", stream.Committed())
+	}
+}
@@ -0,0 +1,157 @@
+package logging
+
+// The service log, text or json to stderr and to a file in the log
+// directory that is rotated by size and age
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var _ LoggerApi = (*Logger)(nil)
+
+type LoggerConfig struct {
+	Level string
+	// text or json
+	Format string
+	// the log is written to a file here as well as to stderr, empty
+	// for stderr only
+	Directory string
+	// name of the file in the directory
+	File string
+	// the file is rotated above this size
+	MaxSizeMiB int
+	// rotated files older than this are removed, rounded up to days,
+	// 0 keeps them
+	MaxAge time.Duration
+	// rotated files kept, 0 keeps them all
+	MaxBackups int
+	// gzip rotated files
+	Compress bool
+	// attributes added to each record from the values of its context,
+	// by attribute name
+	Context map[string]any
+	// rewrites the attributes, e.g. to redact them
+	ReplaceAttr func(groups []string, a slog.Attr) slog.Attr
+	// os.Stderr when nil
+	Stderr io.Writer
+}
+
+type Logger struct {
+	level  *slog.LevelVar
+	logger *slog.Logger
+	file   *lumberjack.Logger
+}
+
+type LoggerApi interface {
+	// Logger writes at the current level to stderr and the file
+	Logger() *slog.Logger
+	// SetLevel changes the level of the records logged from now on
+	SetLevel(level string) error
+	// Level the records are logged at
+	Level() slog.Level
+	// Close the file
+	Close() error
+}
+
+func NewLogger(config *LoggerConfig) (LoggerApi, error) {
+	l := &Logger{level: new(slog.LevelVar)}
+	if err := l.SetLevel(config.Level); err != nil {
+		return nil, err
+	}
+	var w io.Writer = config.Stderr
+	if w == nil {
+		w = os.Stderr
+	}
+	if config.Directory != "" {
+		if err := os.MkdirAll(config.Directory, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create the log directory: %v", err)
+		}
+		l.file = &lumberjack.Logger{
+			Filename:   filepath.Join(config.Directory, config.File),
+			MaxSize:    config.MaxSizeMiB,
+			MaxAge:     int((config.MaxAge + 24*time.Hour - 1) / (24 * time.Hour)),
+			MaxBackups: config.MaxBackups,
+			Compress:   config.Compress,
+		}
+		w = io.MultiWriter(w, l.file)
+	}
+	options := &slog.HandlerOptions{Level: l.level, ReplaceAttr: config.ReplaceAttr}
+	var handler slog.Handler
+	switch config.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", config.Format)
+	}
+	if len(config.Context) > 0 {
+		handler = newContextHandler(handler, config.Context)
+	}
+	l.logger = slog.New(handler)
+	return l, nil
+}
+
+func (l *Logger) Logger() *slog.Logger {
+	return l.logger
+}
+
+func (l *Logger) SetLevel(level string) error {
+	return l.level.UnmarshalText([]byte(level))
+}
+
+func (l *Logger) Level() slog.Level {
+	return l.level.Level()
+}
+
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// contextHandler adds the values of the record's context as attributes
+type contextHandler struct {
+	slog.Handler
+	names []string
+	keys  map[string]any
+}
+
+func newContextHandler(handler slog.Handler, keys map[string]any) *contextHandler {
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &contextHandler{Handler: handler, names: names, keys: keys}
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	for _, name := range h.names {
+		if ctx == nil {
+			break // logged without one
+		}
+		if value := ctx.Value(h.keys[name]); value != nil {
+			r.AddAttrs(slog.Any(name, value))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs), names: h.names, keys: h.keys}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name), names: h.names, keys: h.keys}
+}
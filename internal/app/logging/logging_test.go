@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type key string
+
+func TestLogger_JsonWithContext(t *testing.T) {
+	var stderr bytes.Buffer
+	dir := t.TempDir()
+	logger, err := NewLogger(&LoggerConfig{
+		Level:     "info",
+		Format:    "json",
+		Directory: dir,
+		File:      "test.log",
+		Context:   map[string]any{"download_id": key("download_id")},
+		Stderr:    &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	ctx := context.WithValue(context.Background(), key("download_id"), "d1")
+	logger.Logger().DebugContext(ctx, "hidden")
+	logger.Logger().With("fragment", 2).InfoContext(ctx, "fetch")
+	logger.Logger().Info("plain")
+
+	file, err := os.ReadFile(filepath.Join(dir, "test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file, stderr.Bytes()) {
+		t.Errorf("file and stderr differ:\n%s\n%s", file, stderr.Bytes())
+	}
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d records, expected 2: %s", len(lines), stderr.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "fetch" || record["download_id"] != "d1" || record["fragment"] != 2.0 {
+		t.Errorf("got %v", record)
+	}
+	if strings.Contains(lines[1], "download_id") {
+		t.Errorf("record without a download has an id: %s", lines[1])
+	}
+}
+
+func TestLogger_ChangeLevel(t *testing.T) {
+	var stderr bytes.Buffer
+	logger, err := NewLogger(&LoggerConfig{Level: "warn", Stderr: &stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logger.SetLevel("debug"); err != nil || logger.Level() != slog.LevelDebug {
+		t.Errorf("SetLevel(debug) = %v, level %s", err, logger.Level())
+	}
+	logger.Logger().Debug("shown")
+	if !strings.Contains(stderr.String(), "msg=shown") {
+		t.Errorf("debug record not logged: %q", stderr.String())
+	}
+	if err := logger.SetLevel("loud"); err == nil {
+		t.Errorf("SetLevel(loud) succeeded, expected an unknown level")
+	}
+}
+
+func TestNewLogger_UnknownFormat(t *testing.T) {
+	if _, err := NewLogger(&LoggerConfig{Level: "info", Format: "xml"}); err == nil {
+		t.Error("expected an error")
+	}
+}
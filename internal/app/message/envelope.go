@@ -0,0 +1,132 @@
+package message
+
+// Events are CloudEvents 1.0 in the structured JSON mode. The version
+// of the data is the last part of the type, a change that would break
+// a consumer comes with a new type.
+
+import (
+	"mime"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	appevents "github.com/matthogan/polypully-events"
+)
+
+const (
+	SpecVersion = "1.0"
+	ContentType = "application/cloudevents+json"
+	// a download changed status, DownloadData
+	DownloadStatusType = "io.polypully.download.status.v1"
+	// a running download moved on, ProgressData
+	DownloadProgressType = "io.polypully.download.progress.v1"
+	// the fragments of a failed attempt are tried again, FragmentRetryData
+	FragmentRetryType = "io.polypully.download.fragment.retry.v1"
+	// the outcome of an inbound command
+	CommandReplyType = "io.polypully.command.reply.v1"
+)
+
+var source atomic.Value
+
+func init() {
+	source.Store("/polypully/downloader")
+}
+
+// SetSource names the service in the events from now on, empty
+// keeps the name
+func SetSource(s string) {
+	if s != "" {
+		source.Store(s)
+	}
+}
+
+type Envelope struct {
+	SpecVersion string `json:"specversion"`
+	// unique per event, a repeat has the same id
+	Id     string `json:"id"`
+	Source string `json:"source"`
+	Type   string `json:"type"`
+	// the download
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	// extension, the download or the command the event is about
+	CorrelationId string      `json:"correlationid,omitempty"`
+	Data          interface{} `json:"data"`
+}
+
+func NewEnvelope(eventType string, subject string, correlationId string, data interface{}) *Envelope {
+	return &Envelope{
+		SpecVersion:     SpecVersion,
+		Id:              uuid.New().String(),
+		Source:          source.Load().(string),
+		Type:            eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		CorrelationId:   correlationId,
+		Data:            data,
+	}
+}
+
+// Event with the encoded envelope as its value, the id is the
+// event-id of the content type as well
+func (e *Envelope) Event(encoder EncoderAPI) (*appevents.Event, error) {
+	value, err := encoder.Encode(e)
+	if err != nil {
+		return nil, err
+	}
+	return &appevents.Event{
+		Type:          e.Type,
+		Value:         string(value),
+		CorrelationId: e.CorrelationId,
+		ContentType:   mime.FormatMediaType(ContentType, map[string]string{"event-id": e.Id}),
+	}, nil
+}
+
+// DownloadData is the state of a download
+type DownloadData struct {
+	Id string `json:"id"`
+	// a download status, or deleted
+	Status string `json:"status"`
+	// without its credentials
+	Uri         string `json:"uri"`
+	File        string `json:"file,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Bytes       int64  `json:"bytes_downloaded"`
+	ContentType string `json:"content_type,omitempty"`
+	// hex digests of the complete file by algorithm
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// of the error that failed the download
+	ErrorClass string   `json:"error_class,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+	// from the start to the end, or to now while it runs
+	DurationMs int64             `json:"duration_ms"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// ProgressData of a running download
+type ProgressData struct {
+	Id    string `json:"id"`
+	Bytes int64  `json:"bytes_downloaded"`
+	// 0 when unknown
+	Size int64 `json:"size"`
+	// percent, 0 when the size is unknown
+	Progress int `json:"progress"`
+	// since the previous progress event
+	BytesPerSecond int64 `json:"bytes_per_second"`
+}
+
+// FragmentRetryData is a fragment that failed an attempt that is made
+// again
+type FragmentRetryData struct {
+	Id       string `json:"id"`
+	Fragment int    `json:"fragment"`
+	// the attempt that failed, from 1
+	Attempt int `json:"attempt"`
+	// attempts after the first the download is allowed
+	Retries    int    `json:"retries"`
+	Progress   int    `json:"progress"`
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error"`
+}
@@ -1,83 +1,313 @@
 package metrics
 
-// Prometheus metrics
+// Prometheus metrics, on a registry of their own so nothing else in
+// the process adds to them
 
 import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 )
 
+var _ MetricsApi = (*Metrics)(nil)
+
 type MetricsConfig struct {
 	Port   int
 	Enable bool
-	Model  string
-	Path   string
+	// pull serves the metrics on Port and Path, push sends them to
+	// a Pushgateway for runs too short to be scraped
+	Model string
+	Path  string
+	Push  PushConfig
+}
+
+type PushConfig struct {
+	// of the Pushgateway
+	Url      string
+	Interval time.Duration
+	// grouping labels
+	Job      string
+	Instance string
+	// basic auth, optional
+	Username string
+	Password string
 }
 
 type Metrics struct {
-	config    MetricsConfig
-	started   prometheus.Counter
-	completed prometheus.Counter
-	failed    prometheus.Counter
+	config           MetricsConfig
+	registry         *prometheus.Registry
+	started          prometheus.Counter
+	finished         *prometheus.CounterVec
+	errors           *prometheus.CounterVec
+	active           prometheus.Gauge
+	bytes            *prometheus.CounterVec
+	duration         *prometheus.HistogramVec
+	fragmentDuration prometheus.Histogram
+	timeToFirstByte  prometheus.Histogram
+	retries          prometheus.Counter
+	stalls           prometheus.Counter
+	diskFree         prometheus.Gauge
+	diskTotal        prometheus.Gauge
+	accepting        prometheus.Gauge
+	outboxPending    prometheus.Gauge
+	outboxLag        prometheus.Gauge
+	published        *prometheus.CounterVec
+	stop             chan struct{}
+	stopped          chan struct{}
 }
 
 type MetricsApi interface {
-	// Expose the metrics endpoint for the prometheus scraper
+	// Expose the metrics endpoint for the prometheus scraper or, in
+	// push mode, start pushing them
 	Expose()
+	// Close pushes the metrics one last time in push mode
+	Close()
+	// Registry the metrics are registered on
+	Registry() *prometheus.Registry
+	// a download starts or resumes running
 	DownloadStarted()
-	DownloadCompleted()
-	DownloadFailed()
+	// a download stops running with this status
+	DownloadStopped(status string, duration time.Duration)
+	// an error that failed a download, by class
+	DownloadFailed(class string)
+	// another attempt at a download
+	DownloadRetried()
+	// no bytes arrived for a while
+	DownloadStalled()
+	// bytes received from a host
+	BytesDownloaded(host string, n int)
+	// a fragment fetched in full
+	FragmentFetched(duration time.Duration)
+	// from sending a request to its response
+	FirstByte(duration time.Duration)
+	// free and total bytes of the download directory filesystem
+	DiskUsage(free uint64, total uint64)
+	// whether free space admits new downloads
+	DiskAccepting(accepting bool)
+	// events waiting in the outbox and the age of the oldest
+	OutboxLag(pending int, lag time.Duration)
+	// an attempt to publish an event from the outbox
+	EventPublished(err error)
 }
 
 func NewMetrics(config MetricsConfig) MetricsApi {
-	return &Metrics{
-		config: config,
+	m := &Metrics{
+		config:   config,
+		registry: prometheus.NewRegistry(),
 	}
+	m.registerMetrics()
+	return m
 }
 
 func (m *Metrics) Expose() {
+	if m.config.Enable && m.config.Model == "push" {
+		m.stop = make(chan struct{})
+		m.stopped = make(chan struct{})
+		go m.pushEvery(m.config.Push.Interval)
+		return
+	}
 	if m.config.Enable {
 		go func() {
 			port := fmt.Sprintf(":%d", m.config.Port)
 			slog.Info("exposing metrics", "port", port)
-			// register the metrics
-			m.registerMetrics()
 			// endpoint
-			http.Handle(m.config.Path, promhttp.Handler())
-			if err := http.ListenAndServe(port, nil); err != nil {
+			mux := http.NewServeMux()
+			mux.Handle(m.config.Path, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry}))
+			if err := http.ListenAndServe(port, mux); err != nil {
 				slog.Error("failed to expose metrics", "error", err)
 			}
 		}()
 	}
 }
 
+func (m *Metrics) pushEvery(interval time.Duration) {
+	defer close(m.stopped)
+	slog.Info("pushing metrics", "url", m.config.Push.Url, "interval", interval)
+	if interval <= 0 {
+		<-m.stop // on close only
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if err := m.push(); err != nil {
+				slog.Warn("failed to push metrics", "error", err)
+			}
+		}
+	}
+}
+
+// push replaces the metrics of the job and instance on the gateway
+func (m *Metrics) push() error {
+	p := push.New(m.config.Push.Url, m.config.Push.Job).
+		Gatherer(m.registry).
+		Client(&http.Client{Timeout: 10 * time.Second})
+	if m.config.Push.Instance != "" {
+		p = p.Grouping("instance", m.config.Push.Instance)
+	}
+	if m.config.Push.Username != "" {
+		p = p.BasicAuth(m.config.Push.Username, m.config.Push.Password)
+	}
+	return p.Push()
+}
+
+func (m *Metrics) Close() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.stopped
+	m.stop = nil
+	if err := m.push(); err != nil {
+		slog.Error("failed to push metrics", "error", err)
+	}
+}
+
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
 func (m *Metrics) DownloadStarted() {
 	m.started.Inc()
+	m.active.Inc()
 }
 
-func (m *Metrics) DownloadCompleted() {
-	m.started.Inc()
+func (m *Metrics) DownloadStopped(status string, duration time.Duration) {
+	m.active.Dec()
+	m.finished.WithLabelValues(status).Inc()
+	m.duration.WithLabelValues(status).Observe(duration.Seconds())
+}
+
+func (m *Metrics) DownloadFailed(class string) {
+	m.errors.WithLabelValues(class).Inc()
+}
+
+func (m *Metrics) DownloadRetried() {
+	m.retries.Inc()
 }
 
-func (m *Metrics) DownloadFailed() {
-	m.failed.Inc()
+func (m *Metrics) DownloadStalled() {
+	m.stalls.Inc()
+}
+
+func (m *Metrics) BytesDownloaded(host string, n int) {
+	m.bytes.WithLabelValues(host).Add(float64(n))
+}
+
+func (m *Metrics) FragmentFetched(duration time.Duration) {
+	m.fragmentDuration.Observe(duration.Seconds())
+}
+
+func (m *Metrics) FirstByte(duration time.Duration) {
+	m.timeToFirstByte.Observe(duration.Seconds())
+}
+
+func (m *Metrics) DiskUsage(free uint64, total uint64) {
+	m.diskFree.Set(float64(free))
+	m.diskTotal.Set(float64(total))
+}
+
+func (m *Metrics) DiskAccepting(accepting bool) {
+	if accepting {
+		m.accepting.Set(1)
+	} else {
+		m.accepting.Set(0)
+	}
+}
+
+func (m *Metrics) OutboxLag(pending int, lag time.Duration) {
+	m.outboxPending.Set(float64(pending))
+	m.outboxLag.Set(lag.Seconds())
+}
+
+func (m *Metrics) EventPublished(err error) {
+	if err != nil {
+		m.published.WithLabelValues("failed").Inc()
+	} else {
+		m.published.WithLabelValues("published").Inc()
+	}
 }
 
 func (m *Metrics) registerMetrics() {
 	m.started = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "downloads_started",
-		Help: "The total number of downloads started",
+		Name: "downloads_started_total",
+		Help: "Downloads started or resumed",
+	})
+	m.finished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "downloads_finished_total",
+		Help: "Downloads that stopped running, by status",
+	}, []string{"status"})
+	m.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "download_errors_total",
+		Help: "Errors that failed downloads, by class",
+	}, []string{"class"})
+	m.active = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "downloads_active",
+		Help: "Downloads running",
+	})
+	m.bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "download_bytes_total",
+		Help: "Bytes received, by origin host",
+	}, []string{"host"})
+	m.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "download_duration_seconds",
+		Help:    "How long downloads ran, by the status they stopped with",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 10), // 0.1s to ~7h
+	}, []string{"status"})
+	m.fragmentDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "download_fragment_duration_seconds",
+		Help:    "How long fragments took to fetch",
+		Buckets: prometheus.ExponentialBuckets(0.05, 4, 10),
+	})
+	m.timeToFirstByte = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "download_time_to_first_byte_seconds",
+		Help:    "From sending a request to its response",
+		Buckets: prometheus.ExponentialBuckets(0.005, 3, 10),
+	})
+	m.retries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "download_retries_total",
+		Help: "Downloads attempted again after a failure",
+	})
+	m.stalls = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "download_stalls_total",
+		Help: "Fragments that received nothing for download.stall-after",
+	})
+	m.diskFree = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "download_disk_free_bytes",
+		Help: "Free bytes on the download directory filesystem",
+	})
+	m.diskTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "download_disk_total_bytes",
+		Help: "Total bytes on the download directory filesystem",
+	})
+	m.accepting = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "download_disk_accepting",
+		Help: "1 if free space admits new downloads, 0 below the low watermark",
 	})
-	m.completed = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "downloads_completed",
-		Help: "The total number of downloads completed",
+	m.outboxPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "events_outbox_pending",
+		Help: "Events stored and not yet published",
 	})
-	m.failed = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "downloads_failed",
-		Help: "The total number of downloads failed",
+	m.outboxLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "events_outbox_lag_seconds",
+		Help: "Age of the oldest event not yet published",
 	})
+	m.published = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_published_total",
+		Help: "Attempts to publish events from the outbox, by result",
+	}, []string{"result"})
+	m.registry.MustRegister(m.started, m.finished, m.errors, m.active, m.bytes, m.duration,
+		m.fragmentDuration, m.timeToFirstByte, m.retries, m.stalls, m.diskFree, m.diskTotal, m.accepting,
+		m.outboxPending, m.outboxLag, m.published,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 }
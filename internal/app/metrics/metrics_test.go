@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPush_PeriodicallyAndOnClose(t *testing.T) {
+	var lock sync.Mutex
+	var paths, bodies []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		if r.Method != http.MethodPut || user != "u" || password != "p" {
+			t.Errorf("push %s as %s:%s, expected a PUT with basic auth", r.Method, user, password)
+		}
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		bodies = append(bodies, string(body))
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	m := NewMetrics(MetricsConfig{Enable: true, Model: "push", Push: PushConfig{
+		Url: gateway.URL, Interval: 20 * time.Millisecond, Job: "downloader", Instance: "host-1",
+		Username: "u", Password: "p"}})
+	m.Expose()
+	m.DownloadStarted()
+	time.Sleep(70 * time.Millisecond)
+	m.DownloadStopped("complete", time.Second)
+	m.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(paths) < 2 {
+		t.Fatalf("pushed %d times, expected periodic pushes and one on close", len(paths))
+	}
+	if paths[0] != "/metrics/job/downloader/instance/host-1" {
+		t.Errorf("pushed to %s, expected the job and instance grouping", paths[0])
+	}
+	// the protobuf body names the metrics
+	if last := bodies[len(bodies)-1]; !strings.Contains(last, "downloads_finished_total") {
+		t.Error("the push on close is missing downloads_finished_total")
+	}
+}
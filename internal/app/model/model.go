@@ -26,11 +26,23 @@ const (
 	DownloadComplete
 	DownloadError
 	DownloadInitError
+	DownloadCancelled
+	DownloadPaused
 )
 
 // String method is automatically called when we try to print the value of the model.DownloadStatus
 func (d DownloadStatus) String() string {
-	return [...]string{"undefined", "initializing", "running", "complete", "error", "init_error"}[d]
+	return [...]string{"undefined", "initializing", "running", "complete", "error", "init_error", "cancelled", "paused"}[d]
+}
+
+// ParseDownloadStatus is the inverse of String
+func ParseDownloadStatus(s string) (DownloadStatus, error) {
+	for d := DownloadUndefined; d <= DownloadPaused; d++ {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return DownloadUndefined, fmt.Errorf("unknown download status %q", s)
 }
 
 // CommunicationClient is an interface for fetching a fragment of data
@@ -71,9 +83,31 @@ type Resource struct {
 	BufferSize       int               `json:"buffer_size"`
 	Fragments        map[int]*Fragment `json:"fragments"`
 	FileSize         int               `json:"file_size"`
-	FragLock         *sync.RWMutex     `json:"-"` // FragLock is a lock for the Fragments map
+	FragLock         *sync.RWMutex     `json:"-"` // FragLock is a lock for the Fragments map and the status
 	StartTime        time.Time         `json:"start_time"`
 	EndTime          time.Time         `json:"end_time"`
+	DiskReserve      int               `json:"disk_reserve"` // bytes to leave free on the destination
+	Manifest         string            `json:"manifest"`
+	ContentType      string            `json:"content_type"` // as reported by the origin
+	ETag             string            `json:"etag"`         // validators reported by the origin
+	LastModified     string            `json:"last_modified"`
+	Sha256           string            `json:"sha256"`        // hex digest of the completed file
+	LastAccessed     time.Time         `json:"last_accessed"` // when the content was last served
+	Labels           map[string]string `json:"labels"`        // free form, supplied with the request
+	CommandId        string            `json:"command_id"`    // of the stream command that started it
+}
+
+// Size of the fragment, 0 if the file size is unknown
+func (f *Fragment) Size() int {
+	if f.End < f.Start {
+		return 0
+	}
+	return f.End - f.Start + 1
+}
+
+// Complete when every byte of a known size has been written
+func (f *Fragment) Complete() bool {
+	return f.Size() > 0 && f.Progress == f.Size()
 }
 
 func (r Resource) Identifier() string {
@@ -119,8 +153,10 @@ func (r *Resource) MarshalJSON() ([]byte, error) {
 	type Alias Resource
 	// losing some information here
 	errors := make([]string, 0)
-	for e := r.Errors.Front(); e != nil; e = e.Next() {
-		errors = append(errors, fmt.Sprintf("%v", e.Value))
+	if r.Errors != nil {
+		for e := r.Errors.Front(); e != nil; e = e.Next() {
+			errors = append(errors, fmt.Sprintf("%v", e.Value))
+		}
 	}
 	fragments := make([]*Fragment, 0, len(r.Fragments))
 	for _, f := range r.Fragments {
@@ -177,6 +213,9 @@ func (r *Resource) GetElapsedMS() int64 {
 	now := time.Now()
 
 	for _, v := range r.Fragments {
+		if v.StartTime.IsZero() { // waiting for a slot
+			continue
+		}
 		if v.EndTime.IsZero() { // uninitialized
 			elapsedMS += now.Sub(v.StartTime).Milliseconds()
 		} else {
@@ -187,15 +226,52 @@ func (r *Resource) GetElapsedMS() int64 {
 	return elapsedMS
 }
 
+// GetStatus of a download that may be running
+func (r *Resource) GetStatus() DownloadStatus {
+	r.FragLock.RLock()
+	defer r.FragLock.RUnlock()
+	return r.Status
+}
+
+// SetStatus of a running download, read elsewhere with GetStatus
+func (r *Resource) SetStatus(status DownloadStatus) {
+	r.FragLock.Lock()
+	defer r.FragLock.Unlock()
+	r.Status = status
+}
+
+// Snapshot copies a download that may be running, with its fragments,
+// under the lock
+func (r *Resource) Snapshot() *Resource {
+	r.FragLock.RLock()
+	defer r.FragLock.RUnlock()
+	snapshot := *r
+	snapshot.FragLock = &sync.RWMutex{}
+	snapshot.Fragments = make(map[int]*Fragment, len(r.Fragments))
+	for i, f := range r.Fragments {
+		fragment := *f
+		snapshot.Fragments[i] = &fragment
+	}
+	return &snapshot
+}
+
 // Calculated progress percentage as a function of the downloaded bytes and the
-// total size. If the total size is unknown, return 0.
+// total size. If the total size is unknown, return 0. Same locking as
+// BytesDownloaded.
 func (r *Resource) GetProgess() int {
 	if r.FileSize == 0 {
 		return 0
 	}
+	return r.BytesDownloaded() * 100 / r.FileSize
+}
+
+// Bytes written to the fragment files so far. The fragments of a
+// running download change under FragLock, read them from a Snapshot
+// or with the lock held.
+func (r *Resource) BytesDownloaded() int {
 	var progress int
 	for _, v := range r.Fragments {
 		progress += v.Progress
 	}
-	return int(progress / r.FileSize * 100)
+	return progress
 }
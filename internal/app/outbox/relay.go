@@ -0,0 +1,238 @@
+package outbox
+
+// The relay publishes the events stored in the outbox, in the order
+// they were stored. An event that cannot be published holds back the
+// later events of its download and is tried again after a backoff, the
+// downloads carry on regardless. Delivery is at least once, consumers
+// drop repeats by the event-id of the content type.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/codejago/polypully/downloader/internal/app/tracing"
+	appevents "github.com/matthogan/polypully-events"
+)
+
+var _ RelayApi = (*Relay)(nil)
+
+type RelayConfig struct {
+	// between passes while the outbox keeps up
+	Interval time.Duration
+	// after a failure, doubled on each failure up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// events read per pass
+	Batch int
+	// the check fails when the oldest event waits longer, 0 never
+	MaxLag time.Duration
+	// waits for the events handed to the producer to be delivered and
+	// returns how many were not, nil when Notify delivers
+	Flush func() int
+}
+
+type Relay struct {
+	config  *RelayConfig
+	storage storage.StorageApi
+	events  appevents.EventsApi
+	metrics metrics.MetricsApi
+	// serialises the passes
+	pass sync.Mutex
+	// published and not yet removed, they are not sent again
+	published map[string]bool
+	// the producer still holds events of an earlier pass
+	queued   bool
+	lock     sync.RWMutex
+	failures int
+	err      error
+	stats    storage.OutboxStats
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+type RelayApi interface {
+	// Watch publishes in the background
+	Watch()
+	// Stop the background publishing after a last pass
+	Stop()
+	// Relay makes one pass over the outbox and returns how many events
+	// were published
+	Relay() (int, error)
+	// Check reports the lag, down above the max lag
+	Check() (interface{}, error)
+}
+
+func NewRelay(config *RelayConfig, storage storage.StorageApi, events appevents.EventsApi, metrics metrics.MetricsApi) RelayApi {
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = config.Interval
+	}
+	if config.MaxBackoff < config.Backoff {
+		config.MaxBackoff = config.Backoff
+	}
+	if config.Batch <= 0 {
+		config.Batch = 100
+	}
+	return &Relay{
+		config:    config,
+		storage:   storage,
+		events:    events,
+		metrics:   metrics,
+		published: make(map[string]bool),
+		stop:      make(chan struct{}),
+	}
+}
+
+func (r *Relay) Watch() {
+	r.stopped = make(chan struct{})
+	go func() {
+		defer close(r.stopped)
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-timer.C:
+				n, err := r.Relay()
+				if err != nil {
+					slog.Warn("outbox", "error", err)
+				}
+				timer.Reset(r.wait(n))
+			}
+		}
+	}()
+}
+
+// wait before the next pass, none while whole batches go out
+func (r *Relay) wait(published int) time.Duration {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.failures > 0 {
+		backoff := r.config.Backoff << (r.failures - 1)
+		if backoff <= 0 || backoff > r.config.MaxBackoff { // shifted past the max
+			return r.config.MaxBackoff
+		}
+		return backoff
+	}
+	if published >= r.config.Batch {
+		return 0
+	}
+	return r.config.Interval
+}
+
+func (r *Relay) Stop() {
+	close(r.stop)
+	if r.stopped != nil {
+		<-r.stopped
+	}
+	if _, err := r.Relay(); err != nil {
+		slog.Warn("outbox events left", "error", err)
+	}
+}
+
+func (r *Relay) Relay() (int, error) {
+	r.pass.Lock()
+	defer r.pass.Unlock()
+	// the broker has to take what is queued before it gets more
+	if r.queued {
+		if left := r.config.Flush(); left > 0 {
+			return 0, r.result(fmt.Errorf("%d events not delivered", left))
+		}
+		r.queued = false
+	}
+	pending, err := r.storage.PendingEvents(r.config.Batch)
+	if err != nil {
+		return 0, r.result(err)
+	}
+	sent := make([]*storage.OutboxEvent, 0, len(pending))
+	// a download whose event failed sends nothing after it
+	held := make(map[string]bool)
+	var failed error
+	for _, e := range pending {
+		if r.published[e.Key] {
+			sent = append(sent, e)
+			continue
+		}
+		if e.CorrelationId != "" && held[e.CorrelationId] {
+			continue
+		}
+		err := tracing.Notify(tracing.Resume(context.Background(), e.Trace), r.events, e.Event())
+		r.metrics.EventPublished(err)
+		if err != nil {
+			failed = fmt.Errorf("event %d of %s: %v", e.Seq, e.CorrelationId, err)
+			held[e.CorrelationId] = true
+			continue
+		}
+		sent = append(sent, e)
+	}
+	if r.config.Flush != nil && len(sent) > 0 {
+		if left := r.config.Flush(); left > 0 {
+			// which were delivered is unknown, all of them go again
+			// once the producer is through with them
+			r.queued = true
+			return 0, r.result(fmt.Errorf("%d events not delivered", left))
+		}
+	}
+	for _, e := range sent {
+		r.published[e.Key] = true
+	}
+	if len(sent) > 0 {
+		if err := r.storage.RemoveEvents(sent...); err != nil {
+			return len(sent), r.result(err)
+		}
+	}
+	for _, e := range sent {
+		delete(r.published, e.Key)
+	}
+	return len(sent), r.result(failed)
+}
+
+// result of a pass, updating the lag
+func (r *Relay) result(err error) error {
+	stats, statsErr := r.storage.Outbox()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if statsErr == nil {
+		r.stats = *stats
+		r.metrics.OutboxLag(stats.Pending, lag(stats))
+	}
+	r.err = err
+	if err != nil {
+		r.failures++
+	} else {
+		r.failures = 0
+	}
+	return err
+}
+
+func (r *Relay) Check() (interface{}, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	lag := lag(&r.stats)
+	details := map[string]interface{}{
+		"pending":     r.stats.Pending,
+		"lag_seconds": lag.Seconds(),
+	}
+	if r.err != nil {
+		details["error"] = r.err.Error()
+	}
+	if r.config.MaxLag > 0 && lag > r.config.MaxLag {
+		return details, fmt.Errorf("events wait longer than %s to be published", r.config.MaxLag)
+	}
+	return details, nil
+}
+
+func lag(stats *storage.OutboxStats) time.Duration {
+	if stats.Pending == 0 {
+		return 0
+	}
+	return time.Since(stats.Oldest)
+}
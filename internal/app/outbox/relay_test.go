@@ -0,0 +1,120 @@
+package outbox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	appevents "github.com/matthogan/polypully-events"
+)
+
+// broker fails the events of the ids that are down
+type broker struct {
+	appevents.Dummy
+	down map[string]bool
+	sent []string
+}
+
+func (b *broker) Notify(event *appevents.Event) error {
+	if b.down[event.CorrelationId] {
+		return errors.New("broker unavailable")
+	}
+	b.sent = append(b.sent, event.CorrelationId+":"+event.Value)
+	return nil
+}
+
+func newStorage(t *testing.T) storage.StorageApi {
+	local, err := storage.NewLocalStorage(&storage.LocalStorageConfig{Type: storage.MemoryBackend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(local.Close)
+	return storage.NewStorage(local)
+}
+
+func put(t *testing.T, s storage.StorageApi, id string, status model.DownloadStatus) {
+	r := &model.Resource{Id: id, Status: status}
+	if err := s.UpdateResource(r, storage.NewOutboxEvent(appevents.NewDownloadEvent(status.String(), id), nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelay_HoldsBackTheDownloadThatFailed(t *testing.T) {
+	s := newStorage(t)
+	b := &broker{down: map[string]bool{"a": true}}
+	relay := NewRelay(&RelayConfig{MaxLag: time.Nanosecond}, s, b, metrics.NewMetrics(metrics.MetricsConfig{}))
+	put(t, s, "a", model.DownloadRunning)
+	put(t, s, "b", model.DownloadRunning)
+	put(t, s, "a", model.DownloadComplete)
+	put(t, s, "b", model.DownloadComplete)
+
+	if n, err := relay.Relay(); n != 2 || err == nil {
+		t.Errorf("Relay() = %d, %v, expected the 2 events of b and an error", n, err)
+	}
+	if _, err := relay.Check(); err == nil {
+		t.Error("Check() is up with the events of a waiting")
+	}
+	// the download itself is untouched by the outage
+	if r, _ := s.GetResource("a"); r.Status != model.DownloadComplete {
+		t.Errorf("status is %s, expected complete", r.Status)
+	}
+
+	delete(b.down, "a")
+	if n, err := relay.Relay(); n != 2 || err != nil {
+		t.Errorf("Relay() = %d, %v, expected the 2 events of a", n, err)
+	}
+	expected := []string{"b:running", "b:complete", "a:running", "a:complete"}
+	for i, e := range expected {
+		if i >= len(b.sent) || b.sent[i] != e {
+			t.Fatalf("sent %v, expected %v", b.sent, expected)
+		}
+	}
+	if details, err := relay.Check(); err != nil {
+		t.Errorf("Check() = %v, %v, expected up once published", details, err)
+	}
+}
+
+func TestRelay_KeepsWhatWasNotDelivered(t *testing.T) {
+	s := newStorage(t)
+	b := &broker{}
+	left := 1
+	relay := NewRelay(&RelayConfig{Flush: func() int { return left }}, s, b, metrics.NewMetrics(metrics.MetricsConfig{}))
+	put(t, s, "a", model.DownloadComplete)
+
+	if n, err := relay.Relay(); n != 0 || err == nil {
+		t.Errorf("Relay() = %d, %v, expected nothing delivered", n, err)
+	}
+	// nothing more is queued while the producer holds the event
+	relay.Relay()
+	if len(b.sent) != 1 {
+		t.Errorf("sent %v while the first was queued", b.sent)
+	}
+	left = 0
+	if n, err := relay.Relay(); n != 1 || err != nil {
+		t.Errorf("Relay() = %d, %v, expected the event again", n, err)
+	}
+	if len(b.sent) != 2 {
+		t.Errorf("sent %v, expected the event twice", b.sent)
+	}
+	if pending, _ := s.PendingEvents(0); len(pending) != 0 {
+		t.Errorf("%d events left", len(pending))
+	}
+}
+
+func TestRelay_BacksOff(t *testing.T) {
+	r := NewRelay(&RelayConfig{Interval: time.Second, Backoff: time.Second, MaxBackoff: 5 * time.Second, Batch: 10},
+		nil, nil, nil).(*Relay)
+	for failures, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		r.failures = failures
+		if wait := r.wait(1); wait != expected {
+			t.Errorf("wait after %d failures = %s, expected %s", failures, wait, expected)
+		}
+	}
+	r.failures = 0
+	if wait := r.wait(10); wait != 0 {
+		t.Errorf("wait after a full batch = %s, expected none", wait)
+	}
+}
@@ -0,0 +1,141 @@
+package rebuild
+
+// Rebuilds the download records from the manifests written next to
+// each completed download, for when the store has been lost.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	http_downloads "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+)
+
+// manifest.json, or manifest.json.N when Fqfn found one already there
+var manifestName = regexp.MustCompile(`^manifest\.json(\.\d+)?$`)
+
+// Outcome of a manifest
+type Outcome string
+
+const (
+	Added Outcome = "added"
+	// the file was found next to the manifest rather than where it was written
+	Relocated Outcome = "relocated"
+	// the file is missing or has the wrong size, recorded as an error
+	Broken Outcome = "broken"
+	// the store already has the download
+	Exists Outcome = "exists"
+	// an older manifest of a download seen already
+	Superseded Outcome = "superseded"
+	Unreadable Outcome = "unreadable"
+)
+
+// Result of one manifest
+type Result struct {
+	Manifest string
+	Id       string
+	Outcome  Outcome
+	Detail   string
+}
+
+// Rebuild walks root for manifests and stores a record for each
+// download the store does not have. Nothing is written if dry is set.
+func Rebuild(root string, s storage.LocalStorageApi, dry bool) ([]*Result, error) {
+	results := make([]*Result, 0)
+	found := make(map[string]*model.Resource)
+	manifests := make(map[string]*Result)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !manifestName.MatchString(d.Name()) {
+			return nil
+		}
+		r, err := http_downloads.ReadManifest(path)
+		if err != nil {
+			results = append(results, &Result{Manifest: path, Outcome: Unreadable, Detail: err.Error()})
+			return nil
+		}
+		result := &Result{Manifest: path, Id: r.Id}
+		results = append(results, result)
+		// a download written twice keeps the manifest of the last run
+		if previous, ok := found[r.Id]; ok {
+			if !r.EndTime.After(previous.EndTime) {
+				result.Outcome = Superseded
+				return nil
+			}
+			manifests[r.Id].Outcome = Superseded
+		}
+		r.Manifest = path
+		if r.Destination == "" { // versioned manifests leave it out
+			r.Destination = filepath.Clean(root)
+		}
+		found[r.Id] = r
+		manifests[r.Id] = result
+		return nil
+	})
+	if err != nil {
+		return results, fmt.Errorf("rebuild walking %s: %v", root, err)
+	}
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		r, result := found[id], manifests[id]
+		existing, err := s.GetResource(id)
+		if err != nil {
+			return results, err
+		}
+		if existing != nil {
+			result.Outcome = Exists
+			continue
+		}
+		result.Outcome, result.Detail = reconcile(r, root)
+		if dry {
+			continue
+		}
+		if err := s.PutResource(r); err != nil {
+			return results, err
+		}
+		slog.Info("rebuild", "id", id, "outcome", result.Outcome, "manifest", result.Manifest)
+	}
+	return results, nil
+}
+
+// reconcile checks the manifest against the file on disk. A tree that
+// has been moved keeps its layout, so a missing file is looked for
+// next to the manifest.
+func reconcile(r *model.Resource, root string) (Outcome, string) {
+	outcome := Added
+	if _, err := os.Stat(r.File); errors.Is(err, fs.ErrNotExist) {
+		moved := filepath.Join(filepath.Dir(r.Manifest), filepath.Base(r.File))
+		if _, err := os.Stat(moved); err == nil {
+			r.File = moved
+			r.Destination = filepath.Clean(root)
+			outcome = Relocated
+		}
+	}
+	info, err := os.Stat(r.File)
+	if err != nil {
+		return broken(r, fmt.Sprintf("file missing: %v", err))
+	}
+	if r.FileSize > 0 && info.Size() != int64(r.FileSize) {
+		return broken(r, fmt.Sprintf("file is %d bytes, expected %d", info.Size(), r.FileSize))
+	}
+	return outcome, r.File
+}
+
+func broken(r *model.Resource, detail string) (Outcome, string) {
+	r.Status = model.DownloadError
+	r.Errors.PushBack(errors.New("rebuild: " + detail))
+	return Broken, detail
+}
@@ -0,0 +1,75 @@
+package rebuild
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+)
+
+func write(t *testing.T, file string, content string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	root := t.TempDir()
+	// written by the current CreateManifest
+	write(t, filepath.Join(root, "a/id-a/a.bin"), "aaaa")
+	write(t, filepath.Join(root, "a/id-a/manifest.json"), `{"manifestVersion":1,"id":"id-a",
+		"artefact":{"name":"a.bin","path":"`+filepath.Join(root, "a/id-a/a.bin")+`","size":4},
+		"fragments":[{"index":0,"start":0,"end":3}]}`)
+	// the resource itself, before the manifest was versioned
+	write(t, filepath.Join(root, "e/id-e/e.bin"), "eeeee")
+	write(t, filepath.Join(root, "e/id-e/manifest.json"), `{"id":"id-e","status":3,"file_size":5,
+		"file":"`+filepath.Join(root, "e/id-e/e.bin")+`","errors":[],"fragments":[{"index":0}]}`)
+	// written before, fragments keyed by index and the errors lost, and
+	// from a tree that has since moved
+	write(t, filepath.Join(root, "b/id-b/b.bin"), "bb")
+	write(t, filepath.Join(root, "b/id-b/manifest.json.1"), `{"id":"id-b","status":3,"file_size":2,
+		"file":"/elsewhere/b/id-b/b.bin","errors":{},"fragments":{"0":{"index":0}}}`)
+	// the file is gone
+	write(t, filepath.Join(root, "c/manifest.json"), `{"id":"id-c","status":3,"file":"/gone/c.bin"}`)
+	write(t, filepath.Join(root, "d/manifest.json"), `not json`)
+
+	s, err := storage.NewLocalStorage(&storage.LocalStorageConfig{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	results, err := Rebuild(root, s, false)
+	if err != nil {
+		t.Fatalf("Rebuild() error = %v", err)
+	}
+	outcomes := make(map[string]Outcome)
+	for _, r := range results {
+		outcomes[r.Id] = r.Outcome
+	}
+	expected := map[string]Outcome{"id-a": Added, "id-b": Relocated, "id-c": Broken, "id-e": Added, "": Unreadable}
+	for id, outcome := range expected {
+		if outcomes[id] != outcome {
+			t.Errorf("Rebuild() %q = %s, expected %s", id, outcomes[id], outcome)
+		}
+	}
+	b, _ := s.GetResource("id-b")
+	if b == nil || b.File != filepath.Join(root, "b/id-b/b.bin") || len(b.Fragments) != 1 {
+		t.Errorf("GetResource(id-b) = %+v, expected the relocated file and one fragment", b)
+	}
+	complete, _ := s.ListResources(storage.StatusIndex(model.DownloadComplete), nil, 0)
+	if len(complete) != 3 {
+		t.Errorf("complete = %d, expected 3", len(complete))
+	}
+	// a second run finds them all stored
+	results, _ = Rebuild(root, s, false)
+	for _, r := range results {
+		if r.Id != "" && r.Outcome != Exists {
+			t.Errorf("Rebuild() again %q = %s, expected %s", r.Id, r.Outcome, Exists)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package redact hides secrets in the config, the service's logs and
+// the urls it keeps. Names of config keys, log attributes and query
+// parameters are matched against a list of patterns.
+package redact
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Placeholder replaces a secret
+const Placeholder = "REDACTED"
+
+// DefaultPatterns of sensitive names, matched case insensitively
+// anywhere in the name. The query parameters of signed urls from
+// S3, GCS and Azure are covered.
+var DefaultPatterns = []string{
+	`password`, `passwd`, `secret`, `token`, `credential`, `signature`, `private`,
+	`api-?key`, `(^|[._-])key([._-]|$)`, `(^|[._-])sig$`,
+}
+
+var _ RedactorApi = (*Redactor)(nil)
+
+type Redactor struct {
+	patterns []*regexp.Regexp
+	disabled bool
+}
+
+type RedactorConfig struct {
+	// patterns of sensitive names
+	Patterns []string
+	// shows everything, for debugging
+	Disabled bool
+}
+
+type RedactorApi interface {
+	// Sensitive is true if the name matches a pattern
+	Sensitive(name string) bool
+	// Url without its userinfo or sensitive query parameters
+	Url(uri string) string
+	// Settings copies the nested settings with sensitive keys replaced
+	Settings(settings map[string]any) map[string]any
+	// Attr redacts a log attribute, see slog.HandlerOptions.ReplaceAttr
+	Attr(groups []string, a slog.Attr) slog.Attr
+}
+
+func NewRedactor(config *RedactorConfig) (RedactorApi, error) {
+	r := &Redactor{disabled: config.Disabled}
+	for _, p := range config.Patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %v", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+var std atomic.Value
+
+func init() {
+	r, _ := NewRedactor(&RedactorConfig{Patterns: DefaultPatterns})
+	SetDefault(r)
+}
+
+// SetDefault replaces the redactor used by the package functions
+func SetDefault(r RedactorApi) {
+	std.Store(&r)
+}
+
+func Default() RedactorApi {
+	return *std.Load().(*RedactorApi)
+}
+
+// Url redacts with the default redactor
+func Url(uri string) string {
+	return Default().Url(uri)
+}
+
+// Redacted is true if the url has lost a secret, it cannot be
+// fetched as it is
+func Redacted(uri string) bool {
+	return strings.Contains(uri, Placeholder)
+}
+
+func (r *Redactor) Sensitive(name string) bool {
+	if r.disabled {
+		return false
+	}
+	for _, p := range r.patterns {
+		if p.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactor) Url(uri string) string {
+	if r.disabled {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	changed := false
+	if u.User != nil {
+		u.User = url.User(Placeholder)
+		changed = true
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			if r.Sensitive(name) {
+				query.Set(name, Placeholder)
+				changed = true
+			}
+		}
+		if changed {
+			u.RawQuery = query.Encode()
+		}
+	}
+	if !changed {
+		return uri // as it was written
+	}
+	return u.String()
+}
+
+func (r *Redactor) Settings(settings map[string]any) map[string]any {
+	return r.settings("", settings)
+}
+
+func (r *Redactor) settings(prefix string, settings map[string]any) map[string]any {
+	redacted := make(map[string]any, len(settings))
+	for key, value := range settings {
+		name := prefix + key
+		switch {
+		case r.Sensitive(name):
+			redacted[key] = Placeholder
+		case isMap(value):
+			redacted[key] = r.settings(name+".", toMap(value))
+		default:
+			redacted[key] = value
+		}
+	}
+	return redacted
+}
+
+func isMap(value any) bool {
+	switch value.(type) {
+	case map[string]any, map[any]any:
+		return true
+	}
+	return false
+}
+
+func toMap(value any) map[string]any {
+	if m, ok := value.(map[string]any); ok {
+		return m
+	}
+	m := make(map[string]any)
+	for k, v := range value.(map[any]any) {
+		m[fmt.Sprint(k)] = v
+	}
+	return m
+}
+
+func (r *Redactor) Attr(groups []string, a slog.Attr) slog.Attr {
+	if r.disabled || a.Key == slog.MessageKey {
+		return a
+	}
+	if r.Sensitive(a.Key) {
+		return slog.String(a.Key, Placeholder)
+	}
+	if a.Value.Kind() == slog.KindString && strings.Contains(a.Value.String(), "://") {
+		return slog.String(a.Key, r.Url(a.Value.String()))
+	}
+	return a
+}
@@ -0,0 +1,253 @@
+package retention
+
+// Retention rules for downloads and a collector that enforces them by
+// removing the files and the records together.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	http_downloads "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+)
+
+// Policy is the set of retention rules, the zero value keeps everything
+type Policy struct {
+	// max age by status name measured from when the download ended
+	MaxAge map[string]time.Duration
+	// least recently used completed files are evicted above this total
+	MaxTotalBytes int64
+	// only the most recent downloads of each url are kept, 0 keeps all.
+	// Paused and failed downloads can be resumed and are left out.
+	KeepLast int
+}
+
+// Candidate is a download the policy would remove and why
+type Candidate struct {
+	Resource *model.Resource
+	Reason   string
+}
+
+// Plan works out which of the resources break the policy. Nothing is
+// removed. The rules are applied in order: age, keep last per url and
+// then total size, so the size rule only evicts what is left over.
+// A download that can be resumed only goes by the max age of its
+// status, when one is set.
+func (p *Policy) Plan(resources []*model.Resource, now time.Time) []*Candidate {
+	candidates := make([]*Candidate, 0)
+	kept := make([]*model.Resource, 0, len(resources))
+	// age
+	for _, r := range resources {
+		if maxAge, ok := p.MaxAge[r.Status.String()]; ok && maxAge > 0 && now.Sub(ended(r)) > maxAge {
+			candidates = append(candidates, &Candidate{Resource: r,
+				Reason: fmt.Sprintf("%s for longer than %s", r.Status, maxAge)})
+			continue
+		}
+		kept = append(kept, r)
+	}
+	// keep last per url, most recent first
+	if p.KeepLast > 0 {
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].StartTime.After(kept[j].StartTime) })
+		seen := make(map[string]int)
+		remaining := make([]*model.Resource, 0, len(kept))
+		for _, r := range kept {
+			if resumable(r) {
+				remaining = append(remaining, r)
+				continue
+			}
+			seen[r.Uri]++
+			if seen[r.Uri] > p.KeepLast {
+				candidates = append(candidates, &Candidate{Resource: r,
+					Reason: fmt.Sprintf("more than %d downloads of the url", p.KeepLast)})
+				continue
+			}
+			remaining = append(remaining, r)
+		}
+		kept = remaining
+	}
+	// total size of the completed files, least recently used first
+	if p.MaxTotalBytes > 0 {
+		completed := make([]*model.Resource, 0, len(kept))
+		var total int64
+		for _, r := range kept {
+			if r.Status == model.DownloadComplete {
+				completed = append(completed, r)
+				total += int64(r.FileSize)
+			}
+		}
+		sort.SliceStable(completed, func(i, j int) bool { return accessed(completed[i]).Before(accessed(completed[j])) })
+		for _, r := range completed {
+			if total <= p.MaxTotalBytes {
+				break
+			}
+			candidates = append(candidates, &Candidate{Resource: r,
+				Reason: fmt.Sprintf("total size above %d bytes", p.MaxTotalBytes)})
+			total -= int64(r.FileSize)
+		}
+	}
+	return candidates
+}
+
+// resumable is a paused or failed download the api can resume
+func resumable(r *model.Resource) bool {
+	return r.Status == model.DownloadPaused || r.Status == model.DownloadError
+}
+
+// when the download stopped, or started if it never did
+func ended(r *model.Resource) time.Time {
+	if r.EndTime.IsZero() {
+		return r.StartTime
+	}
+	return r.EndTime
+}
+
+// when the content was last served, or the download ended
+func accessed(r *model.Resource) time.Time {
+	if r.LastAccessed.IsZero() {
+		return ended(r)
+	}
+	return r.LastAccessed
+}
+
+var _ CollectorApi = (*Collector)(nil)
+
+// Downloads running in this process
+type Downloads interface {
+	// Get a running download or nil
+	Get(id string) *http_downloads.Download
+	// IfAbsent runs fn unless the download is running, none can start
+	// until fn returns. False if it is running.
+	IfAbsent(id string, fn func() error) (bool, error)
+	// Forget the url of a paused download once it has been removed
+	Forget(id string)
+}
+
+type CollectorConfig struct {
+	Policy *Policy
+	// time between collections
+	Interval time.Duration
+}
+
+type Collector struct {
+	config    *CollectorConfig
+	storage   storage.StorageApi
+	downloads Downloads
+	stop      chan struct{}
+	// closed when the background collection has returned
+	stopped chan struct{}
+}
+
+type CollectorApi interface {
+	// Watch collects in the background on the configured interval
+	Watch()
+	// Stop the background collection
+	Stop()
+	// Collect applies the policy once, removing nothing if dry is set
+	Collect(dry bool) ([]*Candidate, error)
+}
+
+// NewCollector removes downloads from the storage, downloads is nil
+// when none run in this process
+func NewCollector(config *CollectorConfig, storage storage.StorageApi, downloads Downloads) CollectorApi {
+	if config.Interval <= 0 {
+		config.Interval = time.Hour
+	}
+	return &Collector{
+		config:    config,
+		storage:   storage,
+		downloads: downloads,
+		stop:      make(chan struct{}),
+	}
+}
+
+func (c *Collector) Watch() {
+	c.stopped = make(chan struct{})
+	go func() {
+		defer close(c.stopped)
+		ticker := time.NewTicker(c.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				if _, err := c.Collect(false); err != nil {
+					slog.Error("retention", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for a collection under way to finish
+func (c *Collector) Stop() {
+	close(c.stop)
+	if c.stopped != nil {
+		<-c.stopped
+	}
+}
+
+func (c *Collector) Collect(dry bool) ([]*Candidate, error) {
+	resources, err := c.storage.ListResources(func(r *model.Resource) bool {
+		return c.downloads == nil || c.downloads.Get(r.Id) == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	candidates := c.config.Policy.Plan(resources, time.Now())
+	if dry {
+		return candidates, nil
+	}
+	// one download that cannot be removed does not stop the rest
+	failed := 0
+	for _, candidate := range candidates {
+		removed := false
+		remove := func() (err error) {
+			removed, err = c.remove(candidate)
+			return err
+		}
+		if c.downloads == nil {
+			err = remove()
+		} else {
+			// a download resumed since the listing is left alone
+			_, err = c.downloads.IfAbsent(candidate.Resource.Id, remove)
+			if removed {
+				c.downloads.Forget(candidate.Resource.Id)
+			}
+		}
+		if err != nil {
+			failed++
+			slog.Error("retention", "id", candidate.Resource.Id, "error", err)
+		}
+	}
+	if failed > 0 {
+		return candidates, fmt.Errorf("%d of %d downloads could not be removed", failed, len(candidates))
+	}
+	return candidates, nil
+}
+
+// remove a candidate unless it has changed since it was planned
+func (c *Collector) remove(candidate *Candidate) (bool, error) {
+	r, err := c.storage.GetResource(candidate.Resource.Id)
+	if err != nil || r == nil || r.Status != candidate.Resource.Status {
+		return false, err
+	}
+	// the event is published by the service, later for a one off run
+	event, err := http_downloads.OutboxEvent(context.Background(), http_downloads.StatusEnvelope(r, "deleted"))
+	if err != nil {
+		return false, err
+	}
+	// the record goes first, a failed delete leaves the files it points to
+	if err := c.storage.DeleteResource(r.Id, event); err != nil {
+		return false, err
+	}
+	slog.Info("retention removed", "id", r.Id, "reason", candidate.Reason)
+	if err := http_downloads.RemoveFiles(r, false); err != nil {
+		return true, err
+	}
+	return true, nil
+}
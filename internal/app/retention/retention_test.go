@@ -0,0 +1,122 @@
+package retention
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+)
+
+var now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func resource(id string, uri string, status model.DownloadStatus, ago time.Duration, size int) *model.Resource {
+	return &model.Resource{Id: id, Uri: uri, Status: status, FileSize: size,
+		StartTime: now.Add(-ago - time.Minute), EndTime: now.Add(-ago)}
+}
+
+func ids(candidates []*Candidate) map[string]bool {
+	ids := make(map[string]bool)
+	for _, c := range candidates {
+		ids[c.Resource.Id] = true
+	}
+	return ids
+}
+
+func TestPlan_ZeroPolicyKeepsEverything(t *testing.T) {
+	p := &Policy{}
+	actual := p.Plan([]*model.Resource{resource("a", "u", model.DownloadComplete, 1000*time.Hour, 1)}, now)
+	if len(actual) != 0 {
+		t.Errorf("Plan() = %d candidates, expected 0", len(actual))
+	}
+}
+
+func TestPlan_MaxAgeByStatus(t *testing.T) {
+	p := &Policy{MaxAge: map[string]time.Duration{"error": time.Hour}}
+	actual := ids(p.Plan([]*model.Resource{
+		resource("old-error", "u1", model.DownloadError, 2*time.Hour, 0),
+		resource("new-error", "u2", model.DownloadError, time.Minute, 0),
+		resource("old-complete", "u3", model.DownloadComplete, 2*time.Hour, 0),
+	}, now))
+	if !actual["old-error"] || actual["new-error"] || actual["old-complete"] {
+		t.Errorf("Plan() = %v, expected only old-error", actual)
+	}
+}
+
+func TestPlan_KeepLastPerUrl(t *testing.T) {
+	p := &Policy{KeepLast: 1}
+	actual := ids(p.Plan([]*model.Resource{
+		resource("older", "u1", model.DownloadComplete, 2*time.Hour, 0),
+		resource("newer", "u1", model.DownloadComplete, time.Hour, 0),
+		resource("other", "u2", model.DownloadComplete, 3*time.Hour, 0),
+	}, now))
+	if !actual["older"] || actual["newer"] || actual["other"] {
+		t.Errorf("Plan() = %v, expected only older", actual)
+	}
+}
+
+func TestPlan_MaxTotalBytesEvictsLeastRecentlyUsed(t *testing.T) {
+	p := &Policy{MaxTotalBytes: 250}
+	served := resource("served", "u1", model.DownloadComplete, 3*time.Hour, 100)
+	served.LastAccessed = now.Add(-time.Minute)
+	actual := ids(p.Plan([]*model.Resource{
+		served,
+		resource("stale", "u2", model.DownloadComplete, 2*time.Hour, 100),
+		resource("recent", "u3", model.DownloadComplete, time.Hour, 100),
+		resource("failed", "u4", model.DownloadError, 4*time.Hour, 1000),
+	}, now))
+	if len(actual) != 1 || !actual["stale"] {
+		t.Errorf("Plan() = %v, expected only stale", actual)
+	}
+}
+
+func TestPlan_KeepLastLeavesResumableDownloads(t *testing.T) {
+	p := &Policy{KeepLast: 1}
+	actual := ids(p.Plan([]*model.Resource{
+		resource("paused", "u1", model.DownloadPaused, 3*time.Hour, 0),
+		resource("failed", "u1", model.DownloadError, 2*time.Hour, 0),
+		resource("older", "u1", model.DownloadComplete, 2*time.Hour, 0),
+		resource("newer", "u1", model.DownloadComplete, time.Hour, 0),
+	}, now))
+	if len(actual) != 1 || !actual["older"] {
+		t.Errorf("Plan() = %v, expected only older", actual)
+	}
+}
+
+// failingDelete is a store that cannot delete one of its downloads
+type failingDelete struct {
+	storage.StorageApi
+	id string
+}
+
+func (s failingDelete) DeleteResource(id string, events ...*storage.OutboxEvent) error {
+	if id == s.id {
+		return errors.New("the record is locked")
+	}
+	return s.StorageApi.DeleteResource(id, events...)
+}
+
+func TestCollect_CarriesOnPastAFailure(t *testing.T) {
+	local, err := storage.NewLocalStorage(&storage.LocalStorageConfig{Type: storage.MemoryBackend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewStorage(local)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := local.PutResource(resource(id, "u"+id, model.DownloadCancelled, 2*time.Hour, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := &Policy{MaxAge: map[string]time.Duration{"cancelled": time.Hour}}
+	collector := NewCollector(&CollectorConfig{Policy: policy}, failingDelete{store, "a"}, nil)
+	candidates, err := collector.Collect(false)
+	if err == nil || len(candidates) != 3 {
+		t.Fatalf("Collect() = %d, %v, expected 3 and an error", len(candidates), err)
+	}
+	for id, kept := range map[string]bool{"a": true, "b": false, "c": false} {
+		if r, _ := store.GetResource(id); (r != nil) != kept {
+			t.Errorf("GetResource(%s) = %v, expected kept %v", id, r, kept)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+// Commands from the inbound stream go through the api service, with
+// the validation of a request. Each gets a reply event correlated by
+// the command id. A command the service cannot take now, shutting down,
+// out of disk or failing to store, is left to be delivered again. The
+// download a command starts is stored with its id, so a command
+// delivered again gets the same reply rather than a second download.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/codejago/polypully/downloader/api/generated/openapi"
+	apperrors "github.com/codejago/polypully/downloader/internal/app/errors"
+	http_downloads "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/inbound"
+	"github.com/codejago/polypully/downloader/internal/app/message"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/codejago/polypully/downloader/internal/app/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Reply to a command
+type Reply struct {
+	Action string `json:"action"`
+	// accepted or rejected
+	Result     string `json:"result"`
+	DownloadId string `json:"download_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NewCommandHandler runs the commands of the stream through the api
+func NewCommandHandler(api openapi.DefaultApiServicer, store storage.StorageApi) inbound.Handler {
+	return func(ctx context.Context, m *inbound.Message) (err error) {
+		ctx, span := tracing.Start(tracing.Resume(ctx, m.Headers), "Command")
+		defer func() { tracing.End(span, err) }()
+		command, err := inbound.Decode(m)
+		if err != nil {
+			command = &inbound.Command{}
+		} else {
+			span.SetAttributes(attribute.String("command.id", command.Id), attribute.String("command.action", command.Action))
+			var response openapi.ImplResponse
+			response, err = replay(store, command)
+			if response.Code == 0 {
+				response, err = runCommand(withCommand(ctx, command.Id), api, command)
+			}
+			if response.Code >= http.StatusInternalServerError {
+				return err // delivered again
+			}
+			if status, ok := response.Body.(openapi.DownloadStatus); ok {
+				command.DownloadId = status.DownloadId
+			}
+		}
+		reply := &Reply{Action: command.Action, Result: "accepted", DownloadId: command.DownloadId}
+		if err != nil {
+			reply.Result, reply.Error = "rejected", err.Error()
+			slog.WarnContext(ctx, "command rejected", "command", command.Id, "error", err)
+		}
+		span.SetAttributes(attribute.String("command.result", reply.Result))
+		event, err := http_downloads.OutboxEvent(ctx,
+			message.NewEnvelope(message.CommandReplyType, command.DownloadId, command.Id, reply))
+		if err != nil {
+			return err
+		}
+		// the command is done, a reply that is not stored is only logged
+		if err := store.Enqueue(event); err != nil {
+			slog.ErrorContext(ctx, "command reply", "command", command.Id, "error", err)
+		}
+		return nil
+	}
+}
+
+type commandKey struct{}
+
+// withCommand marks the request of a stream command, the download it
+// starts is stored with the command id
+func withCommand(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, commandKey{}, id)
+}
+
+// commandId of the stream command the request is for, empty for one
+// over http
+func commandId(ctx context.Context) string {
+	id, _ := ctx.Value(commandKey{}).(string)
+	return id
+}
+
+// replay answers a download command delivered again after it started
+// its download, no response if it has not
+func replay(store storage.StorageApi, command *inbound.Command) (openapi.ImplResponse, error) {
+	if command.Action != "download" || command.Id == "" {
+		return openapi.ImplResponse{}, nil
+	}
+	resource, err := store.CommandResource(command.Id)
+	if err != nil {
+		return openapi.Response(http.StatusInternalServerError, nil), err
+	}
+	if resource == nil {
+		return openapi.ImplResponse{}, nil
+	}
+	return openapi.Response(http.StatusOK, openapi.DownloadStatus{DownloadId: resource.Id}), nil
+}
+
+// runCommand answers as the api would answer the request
+func runCommand(ctx context.Context, api openapi.DefaultApiServicer, command *inbound.Command) (openapi.ImplResponse, error) {
+	switch command.Action {
+	case "download":
+		request := openapi.DownloadRequest{Url: command.Url, Labels: command.Labels}
+		if err := openapi.AssertDownloadRequestRequired(request); err != nil {
+			return openapi.Response(http.StatusBadRequest, nil), err
+		}
+		return api.DownloadsPost(ctx, request)
+	case "cancel", "pause":
+		if command.DownloadId == "" {
+			return openapi.Response(http.StatusBadRequest, nil), &apperrors.ValidationError{Msg: "download_id is required"}
+		}
+		response, err := api.DownloadsDownloadIdPatch(ctx, command.DownloadId, openapi.DownloadUpdate{Action: command.Action})
+		if err == nil && response.Code == http.StatusNotFound {
+			err = fmt.Errorf("download %s not found", command.DownloadId)
+		}
+		return response, err
+	}
+	return openapi.Response(http.StatusBadRequest, nil),
+		&apperrors.ValidationError{Msg: fmt.Sprintf("invalid action %q, expected download, cancel or pause", command.Action)}
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/codejago/polypully/downloader/api/generated/openapi"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/gorilla/mux"
+)
+
+// ContentHandler serves the bytes of a download. It is not part of
+// the generated controller because http.ServeContent needs the raw
+// request and response writer to honour Range and If-None-Match.
+type ContentHandler struct {
+	storage   storage.StorageApi
+	downloads RegistryApi
+}
+
+func NewContentHandler(storage storage.StorageApi, downloads RegistryApi) http.Handler {
+	return &ContentHandler{storage: storage, downloads: downloads}
+}
+
+// ServeHTTP - Get the content of a download
+func (h *ContentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	downloadId := mux.Vars(r)["downloadId"]
+	follow := false
+	if param := r.URL.Query().Get("follow"); param != "" {
+		var err error
+		if follow, err = strconv.ParseBool(param); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid follow parameter: %v", err))
+			return
+		}
+	}
+	var resource *model.Resource
+	if download := h.downloads.Get(downloadId); download != nil {
+		if follow {
+			h.follow(w, r, &download.Resource, download.Tail(r.Context()))
+			return
+		}
+		// one that has just completed has its file, it is served
+		if resource = download.Snapshot(); resource.Status != model.DownloadComplete {
+			writeError(w, http.StatusConflict, fmt.Sprintf("download is %s", resource.Status))
+			return
+		}
+	}
+	if resource == nil {
+		var err error
+		if resource, err = h.storage.GetResource(downloadId); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if resource == nil {
+		writeError(w, http.StatusNotFound, "download not found")
+		return
+	}
+	if resource.Status != model.DownloadComplete {
+		writeError(w, http.StatusConflict, fmt.Sprintf("download is %s", resource.Status))
+		return
+	}
+	file, err := os.Open(resource.File)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "downloaded file has been removed")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer file.Close()
+	if resource.ContentType != "" {
+		w.Header().Set("Content-Type", resource.ContentType)
+	}
+	if resource.Sha256 != "" {
+		w.Header().Set("ETag", strconv.Quote(resource.Sha256))
+	}
+	served := &statusWriter{ResponseWriter: w}
+	http.ServeContent(served, r, path.Base(resource.File), resource.EndTime, file)
+	// least recently used files go first when retention is size bound,
+	// a HEAD or a 304 has not read the file
+	if r.Method == http.MethodHead || (served.status != http.StatusOK && served.status != http.StatusPartialContent) {
+		return
+	}
+	accessed := time.Now()
+	if _, err := h.storage.ChangeResource(resource.Id, func(r *model.Resource) { r.LastAccessed = accessed }); err != nil {
+		slog.Warn("last accessed", "id", resource.Id, "error", err)
+	}
+}
+
+// follow streams a running download as the bytes arrive. Ranges do
+// not apply. A download that fails part way aborts the response so
+// the client sees a truncated body rather than a complete one.
+func (h *ContentHandler) follow(w http.ResponseWriter, r *http.Request, resource *model.Resource, tail io.Reader) {
+	if resource.ContentType != "" {
+		w.Header().Set("Content-Type", resource.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if resource.FileSize > 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(resource.FileSize))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(&flushWriter{w: w}, tail); err != nil {
+		slog.Warn("follow", "id", resource.Id, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// flushWriter pushes each chunk to the client as it is tailed
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// statusWriter records the status the response was sent with
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	openapi.EncodeJSONResponse(openapi.Error{Message: message}, &status, nil, w)
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codejago/polypully/downloader/api/generated/openapi"
+
+	http_downloads "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/gorilla/mux"
+)
+
+func TestContentHandler_ServesADownloadThatHasJustCompleted(t *testing.T) {
+	_, store, downloads := newApi(t)
+	file := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(file, []byte("polypully"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// complete, its routine has not returned yet
+	downloads.Add(&http_downloads.Download{Resource: model.Resource{Id: "a", Status: model.DownloadComplete,
+		File: file, FragLock: &sync.RWMutex{}}})
+
+	router := mux.NewRouter()
+	router.Handle("/v1/downloads/{downloadId}/content", NewContentHandler(store, downloads))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/v1/downloads/a/content", nil))
+	if response.Code != http.StatusOK || response.Body.String() != "polypully" {
+		t.Errorf("GET content = %d %q, expected the file", response.Code, response.Body.String())
+	}
+}
+
+// newContent serves the content of a stored complete download
+func newContent(t *testing.T) (http.Handler, storage.StorageApi) {
+	_, store, downloads := newApi(t)
+	file := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(file, []byte("polypully"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resource := &model.Resource{Id: "a", Status: model.DownloadComplete, File: file, Sha256: "5ca1ab1e"}
+	if err := store.UpdateResource(resource); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.Handle("/v1/downloads/{downloadId}/content", NewContentHandler(store, downloads))
+	return router, store
+}
+
+func lastAccessed(t *testing.T, store storage.StorageApi) time.Time {
+	t.Helper()
+	r, err := store.GetResource("a")
+	if err != nil || r == nil {
+		t.Fatalf("GetResource() = %v, %v", r, err)
+	}
+	return r.LastAccessed
+}
+
+func TestContentHandler_ServesARange(t *testing.T) {
+	handler, store := newContent(t)
+	request := httptest.NewRequest(http.MethodGet, "/v1/downloads/a/content", nil)
+	request.Header.Set("Range", "bytes=4-7")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusPartialContent || response.Body.String() != "pull" {
+		t.Errorf("GET range = %d %q, expected 206 \"pull\"", response.Code, response.Body.String())
+	}
+	if response.Header().Get("Content-Range") != "bytes 4-7/9" {
+		t.Errorf("Content-Range = %q, expected bytes 4-7/9", response.Header().Get("Content-Range"))
+	}
+	if lastAccessed(t, store).IsZero() {
+		t.Errorf("LastAccessed is not set after serving a range")
+	}
+}
+
+func TestContentHandler_NotModifiedIsNotAnAccess(t *testing.T) {
+	handler, store := newContent(t)
+	request := httptest.NewRequest(http.MethodGet, "/v1/downloads/a/content", nil)
+	request.Header.Set("If-None-Match", `"5ca1ab1e"`)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusNotModified || response.Body.Len() != 0 {
+		t.Errorf("GET If-None-Match = %d %q, expected 304", response.Code, response.Body.String())
+	}
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodHead, "/v1/downloads/a/content", nil))
+	if response.Code != http.StatusOK {
+		t.Errorf("HEAD = %d, expected 200", response.Code)
+	}
+	if accessed := lastAccessed(t, store); !accessed.IsZero() {
+		t.Errorf("LastAccessed = %v after a 304 and a HEAD, expected it unset", accessed)
+	}
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/v1/downloads/a/content", nil))
+	if response.Code != http.StatusOK || lastAccessed(t, store).IsZero() {
+		t.Errorf("GET = %d, LastAccessed %v, expected it set", response.Code, lastAccessed(t, store))
+	}
+}
+
+// gated content stops half way until it is released
+type gated struct {
+	*bytes.Reader
+	w       http.ResponseWriter
+	half    int64
+	release chan struct{}
+}
+
+func (g *gated) Read(p []byte) (int, error) {
+	if position, _ := g.Seek(0, io.SeekCurrent); position < g.half {
+		if int64(len(p)) > g.half-position {
+			p = p[:g.half-position]
+		}
+	} else {
+		g.w.(http.Flusher).Flush()
+		<-g.release
+	}
+	return g.Reader.Read(p)
+}
+
+func TestContentHandler_FollowsARunningDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("polypully"), 100)
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.ServeContent(w, r, "f.bin", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		http.ServeContent(w, r, "f.bin", time.Time{}, &gated{Reader: bytes.NewReader(content), w: w,
+			half: int64(len(content) / 2), release: release})
+	}))
+	defer origin.Close()
+	api, _, downloads := newApi(t)
+	response, err := api.DownloadsPost(context.Background(), openapi.DownloadRequest{Url: origin.URL + "/f.bin"})
+	if err != nil || response.Code != http.StatusOK {
+		t.Fatalf("DownloadsPost() = %d, %v", response.Code, err)
+	}
+	id := response.Body.(openapi.DownloadStatus).DownloadId
+	eventually(t, "the first half", func() bool {
+		d := downloads.Get(id)
+		return d != nil && d.Snapshot().BytesDownloaded() > 0
+	})
+
+	router := mux.NewRouter()
+	router.Handle("/v1/downloads/{downloadId}/content", NewContentHandler(nil, downloads))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	followed, err := http.Get(server.URL + "/v1/downloads/" + id + "/content?follow=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer followed.Body.Close()
+	close(release)
+	body, err := io.ReadAll(followed.Body)
+	if err != nil || followed.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("follow = %d, %d bytes, %v, expected the %d bytes of the download", followed.StatusCode, len(body), err, len(content))
+	}
+}
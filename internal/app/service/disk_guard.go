@@ -0,0 +1,118 @@
+package service
+
+// A download directory that fills up would fail every running download
+// at once, the merge of the fragments needs room for a second copy.
+// Below the low watermark the guard pauses them with their progress
+// saved, and above the high watermark it resumes the ones it paused.
+// Downloads paused by a user stay paused, also when the user paused
+// them while they were waiting for space.
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codejago/polypully/downloader/api/generated/openapi"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+var _ DiskGuardApi = (*DiskGuard)(nil)
+
+type DiskGuard struct {
+	config    *DiskGuardConfig
+	api       openapi.DefaultApiServicer
+	downloads RegistryApi
+	lock      sync.Mutex
+	// ids of the downloads the guard has paused
+	paused []string
+}
+
+type DiskGuardConfig struct {
+	// how long the downloads have to pause
+	Timeout time.Duration
+}
+
+type DiskGuardApi interface {
+	// Changed follows the admission of the disk monitor
+	Changed(accepting bool)
+	// Paused lists the downloads waiting for space
+	Paused() []string
+}
+
+func NewDiskGuard(config *DiskGuardConfig, api openapi.DefaultApiServicer, downloads RegistryApi) DiskGuardApi {
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &DiskGuard{config: config, api: api, downloads: downloads}
+}
+
+func (g *DiskGuard) Changed(accepting bool) {
+	if accepting {
+		g.resume()
+	} else {
+		g.pause()
+	}
+}
+
+func (g *DiskGuard) Paused() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return append([]string(nil), g.paused...)
+}
+
+// pause the running downloads and wait for them to save their progress.
+// They are recorded before the wait, one slow to pause is still resumed.
+// The wait is without the lock, a resume is not held up by it.
+func (g *DiskGuard) pause() {
+	running := g.downloads.List()
+	slog.Warn("pausing downloads for lack of space", "count", len(running))
+	g.lock.Lock()
+	for _, d := range running {
+		d.Pause()
+		if !slices.Contains(g.paused, d.Id) {
+			g.paused = append(g.paused, d.Id)
+		}
+	}
+	g.lock.Unlock()
+	finished := make([]string, 0)
+	timeout := time.After(g.config.Timeout)
+wait:
+	for _, d := range running {
+		select {
+		case <-d.Done():
+		case <-timeout:
+			slog.Error("downloads did not pause in time", "timeout", g.config.Timeout)
+			break wait
+		}
+		// finished before the pause got to it
+		if d.GetStatus() != model.DownloadPaused {
+			finished = append(finished, d.Id)
+		}
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.paused = slices.DeleteFunc(g.paused, func(id string) bool { return slices.Contains(finished, id) })
+}
+
+// resume the downloads paused for lack of space, through the api so a
+// download deleted or cancelled since is left alone
+func (g *DiskGuard) resume() {
+	g.lock.Lock()
+	paused := g.paused
+	g.paused = nil
+	g.lock.Unlock()
+	for _, id := range paused {
+		if g.downloads.Held(id) {
+			slog.Info("left paused by the user after lack of space", "id", id)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), g.config.Timeout)
+		_, err := g.api.DownloadsDownloadIdPatch(ctx, id, openapi.DownloadUpdate{Action: "resume"})
+		cancel()
+		if err != nil {
+			slog.Warn("resume after lack of space", "id", id, "error", err)
+		}
+	}
+}
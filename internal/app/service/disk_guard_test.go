@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codejago/polypully/downloader/api/generated/openapi"
+	http_downloads "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+func TestDiskGuard_PausesRunningDownloadsAndResumesThem(t *testing.T) {
+	origin := newOrigin(t)
+	api, store, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	guard := NewDiskGuard(&DiskGuardConfig{}, api, downloads)
+
+	guard.Changed(false)
+	if status := stored(t, store, id); status != model.DownloadPaused {
+		t.Fatalf("stored %s below the low watermark, expected paused", status)
+	}
+	if paused := guard.Paused(); len(paused) != 1 || paused[0] != id {
+		t.Errorf("Paused() = %v, expected %s", paused, id)
+	}
+
+	origin.stalled.Store(false)
+	guard.Changed(true)
+	eventually(t, "the resumed download to complete", func() bool {
+		return stored(t, store, id) == model.DownloadComplete
+	})
+	if paused := guard.Paused(); len(paused) != 0 {
+		t.Errorf("Paused() = %v after resuming, expected none", paused)
+	}
+}
+
+func TestDiskGuard_LeavesADownloadTheUserPausedMeanwhile(t *testing.T) {
+	origin := newOrigin(t)
+	api, store, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	guard := NewDiskGuard(&DiskGuardConfig{}, api, downloads)
+
+	guard.Changed(false)
+	pause := openapi.DownloadUpdate{Action: "pause"}
+	if response, err := api.DownloadsDownloadIdPatch(context.Background(), id, pause); err != nil || response.Code != http.StatusAccepted {
+		t.Fatalf("pause = %d, %v", response.Code, err)
+	}
+	fetches := origin.fetches.Load()
+	guard.Changed(true)
+	time.Sleep(50 * time.Millisecond) // time for a resume to show
+	if origin.fetches.Load() != fetches || stored(t, store, id) != model.DownloadPaused {
+		t.Errorf("the guard resumed a download the user paused")
+	}
+}
+
+func TestDiskGuard_ResumesADownloadSlowToPause(t *testing.T) {
+	origin := newOrigin(t)
+	api, store, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	guard := NewDiskGuard(&DiskGuardConfig{Timeout: time.Nanosecond}, api, downloads)
+
+	guard.Changed(false)
+	if paused := guard.Paused(); len(paused) != 1 || paused[0] != id {
+		t.Fatalf("Paused() = %v after the wait timed out, expected %s", paused, id)
+	}
+	eventually(t, "the pause", func() bool { return downloads.Get(id) == nil })
+	origin.stalled.Store(false)
+	guard.Changed(true)
+	eventually(t, "the resumed download to complete", func() bool {
+		return stored(t, store, id) == model.DownloadComplete
+	})
+}
+
+func TestDiskGuard_AnswersWhileWaitingForAPause(t *testing.T) {
+	_, _, downloads := newApi(t)
+	// never stops, the guard waits out its timeout
+	downloads.Add(&http_downloads.Download{Resource: model.Resource{Id: "a", Status: model.DownloadRunning,
+		FragLock: &sync.RWMutex{}}, Cancel: func() {}})
+	guard := NewDiskGuard(&DiskGuardConfig{Timeout: time.Second}, nil, downloads)
+
+	waited := make(chan struct{})
+	go func() {
+		defer close(waited)
+		guard.Changed(false)
+	}()
+	eventually(t, "the pause to be recorded", func() bool {
+		paused := make(chan []string, 1)
+		go func() { paused <- guard.Paused() }()
+		select {
+		case ids := <-paused:
+			return len(ids) == 1 && ids[0] == "a"
+		case <-time.After(100 * time.Millisecond):
+			t.Fatalf("Paused() blocked while the guard waits for the downloads")
+			return false
+		}
+	})
+	<-waited
+	if paused := guard.Paused(); len(paused) != 1 {
+		t.Errorf("Paused() = %v after the wait timed out, expected a", paused)
+	}
+}
@@ -13,13 +13,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/codejago/polypully/downloader/api/generated/openapi"
+	"github.com/codejago/polypully/downloader/internal/app/disk"
 	apperrors "github.com/codejago/polypully/downloader/internal/app/errors"
 	http_downloads "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/redact"
 	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/codejago/polypully/downloader/internal/app/tracing"
 	appevents "github.com/matthogan/polypully-events"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
 )
 
 type ServiceConfig struct {
@@ -30,79 +46,393 @@ type ServiceConfig struct {
 // This service should implement the business logic for every endpoint for the DefaultApi API.
 // Include any external packages or services that will be required by this service.
 type DownloaderApiService struct {
-	storage storage.StorageApi
-	events  appevents.EventsApi
+	storage   storage.StorageApi
+	events    appevents.EventsApi
+	disk      disk.MonitorApi
+	downloads RegistryApi
+	metrics   metrics.MetricsApi
 }
 
 // NewApiService creates a downloader api service
-func NewApiService(events appevents.EventsApi, storage storage.StorageApi) openapi.DefaultApiServicer {
+func NewApiService(events appevents.EventsApi, storage storage.StorageApi, disk disk.MonitorApi,
+	downloads RegistryApi, metrics metrics.MetricsApi) openapi.DefaultApiServicer {
 	return &DownloaderApiService{
-		events:  events,
-		storage: storage,
+		events:    events,
+		storage:   storage,
+		disk:      disk,
+		downloads: downloads,
+		metrics:   metrics,
 	}
 }
 
+// DownloadsDownloadIdDelete - Delete a download
+func (s *DownloaderApiService) DownloadsDownloadIdDelete(ctx context.Context, downloadId string, keepFile bool) (openapi.ImplResponse, error) {
+	// a running download is stopped before its files are touched, it
+	// stores its state on the way out
+	if download := s.downloads.Get(downloadId); download != nil {
+		download.Abort()
+		select {
+		case <-download.Done():
+		case <-ctx.Done():
+			return openapi.Response(http.StatusServiceUnavailable, nil), ctx.Err()
+		}
+	}
+	response := openapi.Response(http.StatusNoContent, nil)
+	// read and removed before a resume can start it again
+	absent, err := s.downloads.IfAbsent(downloadId, func() error {
+		resource, err := s.storage.GetResource(downloadId)
+		if err != nil {
+			response = openapi.Response(http.StatusInternalServerError, nil)
+			return err
+		}
+		if resource == nil {
+			response = openapi.Response(http.StatusNotFound, nil)
+			return nil
+		}
+		// the record goes first, a failed delete leaves the files it
+		// points to in place
+		event, err := downloadEvent(ctx, resource, "deleted")
+		if err == nil {
+			err = s.storage.DeleteResource(downloadId, event)
+		}
+		if err != nil {
+			response = openapi.Response(http.StatusInternalServerError, nil)
+			return err
+		}
+		if err := http_downloads.RemoveFiles(resource, keepFile); err != nil {
+			response = openapi.Response(http.StatusInternalServerError, nil)
+			return fmt.Errorf("the download was deleted but not all of its files: %w", err)
+		}
+		return nil
+	})
+	if !absent {
+		return openapi.Response(http.StatusConflict, nil), errors.New("the download was resumed while it was deleted")
+	}
+	if err == nil {
+		s.downloads.Forget(downloadId)
+	}
+	return response, err
+}
+
 // DownloadsDownloadIdGet - Get the current status of a download
 func (s *DownloaderApiService) DownloadsDownloadIdGet(ctx context.Context, downloadId string) (openapi.ImplResponse, error) {
-	download, _, err := s.storage.GetResource(downloadId)
+	// the store only changes with the status, a running download has the progress
+	if download := s.downloads.Get(downloadId); download != nil {
+		return openapi.Response(http.StatusOK, toDownloadStatus(download.Snapshot())), nil
+	}
+	download, err := s.storage.GetResource(downloadId)
 	if err == nil && download == nil {
 		return openapi.Response(http.StatusNotFound, nil), nil
 	} else if err != nil {
-		return openapi.Response(http.StatusInternalServerError, nil), nil
+		return openapi.Response(http.StatusInternalServerError, nil), err
 	}
-	return openapi.Response(http.StatusOK, openapi.DownloadStatus{
-		DownloadId: download.Id,
-		Url:        download.Uri,
-		Status:     fmt.Sprintf("%s", download.Status),
-		ElapsedMS:  download.GetElapsedMS(),
-	}), nil
+	return openapi.Response(http.StatusOK, toDownloadStatus(download)), nil
 }
 
-// DownloadsDownloadIdPatch - Update a download
+// DownloadsDownloadIdPatch - Pause, resume or cancel a download. Asking
+// for the state a download is already in is accepted.
 func (s *DownloaderApiService) DownloadsDownloadIdPatch(ctx context.Context, downloadId string, downloadUpdate openapi.DownloadUpdate) (openapi.ImplResponse, error) {
-	return openapi.Response(http.StatusNotImplemented, nil), errors.New("DownloadsDownloadIdPatch method not implemented")
+	accepted := openapi.ResponseWithHeaders(http.StatusAccepted, map[string][]string{
+		"Location": {"/v1/downloads/" + neturl.PathEscape(downloadId)},
+	}, nil)
+	conflict := func(resource *model.Resource) (openapi.ImplResponse, error) {
+		return openapi.Response(http.StatusConflict, nil),
+			fmt.Errorf("a %s download cannot be %s", resource.Status, pastTense[downloadUpdate.Action])
+	}
+	if _, ok := pastTense[downloadUpdate.Action]; !ok {
+		return openapi.Response(http.StatusBadRequest, nil),
+			&apperrors.ValidationError{Msg: fmt.Sprintf("invalid action %q, expected pause, resume or cancel", downloadUpdate.Action)}
+	}
+	// a running download stops itself and records its status
+	if download := s.downloads.Get(downloadId); download != nil {
+		switch downloadUpdate.Action {
+		case "pause":
+			s.downloads.Hold(downloadId)
+			download.Pause()
+		case "cancel":
+			download.Abort()
+		case "resume":
+			return accepted, nil
+		}
+		select {
+		case <-download.Done():
+		case <-ctx.Done():
+			return openapi.Response(http.StatusServiceUnavailable, nil), ctx.Err()
+		}
+		return accepted, nil
+	}
+	resource, err := s.storage.GetResource(downloadId)
+	if err != nil {
+		return openapi.Response(http.StatusInternalServerError, nil), err
+	}
+	if resource == nil {
+		return openapi.Response(http.StatusNotFound, nil), nil
+	}
+	switch downloadUpdate.Action {
+	case "pause":
+		if resource.Status != model.DownloadPaused {
+			return conflict(resource)
+		}
+		// paused by the disk guard, the user wants it to stay paused
+		s.downloads.Hold(downloadId)
+	case "cancel":
+		if resource.Status == model.DownloadCancelled {
+			return accepted, nil
+		}
+		if resource.Status != model.DownloadPaused {
+			return conflict(resource)
+		}
+		resource.Status = model.DownloadCancelled
+		resource.EndTime = time.Now()
+		event, err := downloadEvent(ctx, resource, "")
+		if err != nil {
+			return openapi.Response(http.StatusInternalServerError, nil), err
+		}
+		if err := s.storage.UpdateResource(resource, event); err != nil {
+			return openapi.Response(http.StatusInternalServerError, nil), err
+		}
+		s.downloads.Forget(downloadId)
+	case "resume":
+		if resource.Status != model.DownloadPaused && resource.Status != model.DownloadError {
+			return conflict(resource)
+		}
+		if s.downloads.Draining() {
+			return openapi.Response(http.StatusServiceUnavailable, nil), errShuttingDown
+		}
+		if !s.disk.Accepting() {
+			return openapi.Response(http.StatusInsufficientStorage, nil),
+				&apperrors.InsufficientStorageError{Msg: "download directory is below the free space low watermark"}
+		}
+		// the store only has the url without its credentials
+		if uri, ok := s.downloads.PausedUri(resource.Id); ok {
+			resource.Uri = uri
+		} else if redact.Redacted(resource.Uri) {
+			return openapi.Response(http.StatusConflict, nil),
+				errors.New("the url was stored without its credentials, post the download again")
+		}
+		download := http_downloads.RestoreDownload(resource, s.events, s.storage, s.metrics)
+		download.Trace(ctx)
+		response := accepted
+		err := s.downloads.AddIfAbsent(&download, func() error {
+			// a delete, the collector or another resume may have got
+			// in since the record was read
+			current, err := s.storage.GetResource(downloadId)
+			if err != nil {
+				response = openapi.Response(http.StatusInternalServerError, nil)
+				return err
+			}
+			if current == nil {
+				response = openapi.Response(http.StatusNotFound, nil)
+				return errDeleted
+			}
+			if current.Status != model.DownloadPaused && current.Status != model.DownloadError {
+				response, err = conflict(current)
+				return err
+			}
+			if err := download.Resume(); err != nil {
+				response = openapi.Response(http.StatusConflict, nil)
+				return err
+			}
+			return nil
+		})
+		if errors.Is(err, ErrRunning) || errors.Is(err, errDeleted) {
+			return response, nil
+		}
+		return response, err
+	}
+	return accepted, nil
 }
 
-// DownloadsGet - List all ongoing downloads
-func (s *DownloaderApiService) DownloadsGet(ctx context.Context) (openapi.ImplResponse, error) {
-	var statuses []openapi.DownloadStatus
-	resources, err := s.storage.ListResources(nil)
+// errDeleted is a download removed while it was being resumed
+var errDeleted = errors.New("the download has been deleted")
+
+var errShuttingDown = errors.New("the service is shutting down")
+
+var pastTense = map[string]string{"pause": "paused", "resume": "resumed", "cancel": "cancelled"}
+
+// DownloadsGet - List downloads, newest first unless sorted otherwise
+func (s *DownloaderApiService) DownloadsGet(ctx context.Context, status string, url string, since string, until string,
+	label []string, sort string, limit int32, cursor string) (openapi.ImplResponse, error) {
+	query, err := downloadsQuery(status, url, since, until, label, sort, limit, cursor)
 	if err != nil {
+		return openapi.Response(http.StatusBadRequest, nil), err
+	}
+	page, err := s.storage.QueryResources(query)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		return openapi.Response(http.StatusBadRequest, nil), &apperrors.ValidationError{Msg: err.Error(), Err: err}
+	} else if err != nil {
 		return openapi.Response(http.StatusInternalServerError, nil), err
 	}
-	for _, resource := range resources {
-		statuses = append(statuses, openapi.DownloadStatus{
-			DownloadId: resource.Id,
-			Url:        resource.Uri,
-			Status:     fmt.Sprintf("%s", resource.Status),
-			ElapsedMS:  resource.GetElapsedMS(),
-			Progress:   resource.GetProgess(),
-		})
+	statuses := make([]openapi.DownloadStatus, 0, len(page.Resources))
+	for _, resource := range page.Resources {
+		// the store only changes with the status, a running download has the progress
+		if download := s.downloads.Get(resource.Id); download != nil {
+			resource = download.Snapshot()
+		}
+		statuses = append(statuses, toDownloadStatus(resource))
+	}
+	if page.Next == "" {
+		return openapi.Response(http.StatusOK, statuses), nil
+	}
+	// the next link repeats the filters so the client only follows it
+	params := neturl.Values{}
+	for k, v := range map[string]string{"status": status, "url": url, "since": since, "until": until, "sort": sort} {
+		if v != "" {
+			params.Set(k, v)
+		}
+	}
+	for _, l := range label {
+		if l != "" {
+			params.Add("label", l)
+		}
+	}
+	params.Set("limit", strconv.Itoa(query.Limit))
+	params.Set("cursor", page.Next)
+	return openapi.ResponseWithHeaders(http.StatusOK, map[string][]string{
+		"Link": {fmt.Sprintf("</v1/downloads?%s>; rel=\"next\"", params.Encode())},
+	}, statuses), nil
+}
+
+// downloadsQuery validates the list parameters
+func downloadsQuery(status string, url string, since string, until string,
+	label []string, sort string, limit int32, cursor string) (*storage.Query, error) {
+	invalid := func(format string, a ...any) error {
+		return &apperrors.ValidationError{Msg: fmt.Sprintf(format, a...)}
+	}
+	filters := make([]storage.FilterResources, 0)
+	if status != "" {
+		s, err := model.ParseDownloadStatus(status)
+		if err != nil {
+			return nil, invalid("invalid status: %v", err)
+		}
+		filters = append(filters, storage.ByStatus(s))
+	}
+	if url != "" {
+		filters = append(filters, storage.ByUrlPrefix(url))
+	}
+	if since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, invalid("invalid since: %v", err)
+		}
+		filters = append(filters, storage.StartedSince(t))
+	}
+	if until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, invalid("invalid until: %v", err)
+		}
+		filters = append(filters, storage.StartedUntil(t))
 	}
-	if len(statuses) == 0 {
-		return openapi.Response(http.StatusNoContent, nil), nil
+	labels := make(map[string]string)
+	for _, l := range label {
+		if l == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(l, ":")
+		if !ok || k == "" {
+			return nil, invalid("invalid label %q, expected key:value", l)
+		}
+		labels[k] = v
+	}
+	if len(labels) > 0 {
+		filters = append(filters, storage.ByLabels(labels))
+	}
+	query := &storage.Query{Filter: storage.All(filters...), Descending: true, Limit: defaultPageSize, Cursor: cursor}
+	switch sort {
+	case "", "-startTime":
+	case "startTime":
+		query.Descending = false
+	default:
+		return nil, invalid("invalid sort %q, expected startTime or -startTime", sort)
+	}
+	// the controller passes an absent limit as 0, the spec allows it
+	if limit < 0 || limit > maxPageSize {
+		return nil, invalid("invalid limit %d, expected 0 to %d", limit, maxPageSize)
+	} else if limit > 0 {
+		query.Limit = int(limit)
 	}
-	return openapi.Response(http.StatusOK, statuses), nil
+	return query, nil
 }
 
 // DownloadsPost - Request a new download
 func (s *DownloaderApiService) DownloadsPost(ctx context.Context, downloadRequest openapi.DownloadRequest) (openapi.ImplResponse, error) {
-	download := http_downloads.NewDownload(downloadRequest.Url, s.events, s.storage)
-	err := download.Download()
-	s.events.Notify(appevents.NewDownloadEvent(download.Status.String(), download.Id))
+	ctx, span := tracing.Start(ctx, "DownloadsPost", attribute.String("download.url", redact.Url(downloadRequest.Url)))
+	response, err := s.downloadsPost(ctx, downloadRequest)
+	span.SetAttributes(attribute.Int("http.status_code", response.Code))
+	if status, ok := response.Body.(openapi.DownloadStatus); ok {
+		span.SetAttributes(attribute.String("download.id", status.DownloadId))
+	}
+	tracing.End(span, err)
+	return response, err
+}
+
+func (s *DownloaderApiService) downloadsPost(ctx context.Context, downloadRequest openapi.DownloadRequest) (openapi.ImplResponse, error) {
+	if s.downloads.Draining() {
+		return openapi.Response(http.StatusServiceUnavailable, nil), errShuttingDown
+	}
+	if !s.disk.Accepting() {
+		return openapi.Response(http.StatusInsufficientStorage, nil),
+			&apperrors.InsufficientStorageError{Msg: "download directory is below the free space low watermark"}
+	}
+	download := http_downloads.NewDownload(downloadRequest.Url, s.events, s.storage, s.metrics)
+	download.Labels = downloadRequest.Labels
+	download.CommandId = commandId(ctx)
+	download.Trace(ctx)
+	err := download.Prepare()
+	event, eventErr := downloadEvent(ctx, &download.Resource, "")
+	if eventErr != nil {
+		return openapi.Response(http.StatusInternalServerError, nil), eventErr
+	}
 	if err != nil {
+		// nothing else is stored for a download refused up front
+		if err := s.storage.Enqueue(event); err != nil {
+			slog.ErrorContext(ctx, "outbox", "error", err)
+		}
 		if e, ok := err.(*apperrors.ValidationError); ok { // this idiom can be hard to read
 			return openapi.Response(http.StatusBadRequest, nil), e
 		}
+		if e, ok := err.(*apperrors.InsufficientStorageError); ok {
+			return openapi.Response(http.StatusInsufficientStorage, nil), e
+		}
 		return openapi.Response(http.StatusInternalServerError, nil), err
 	}
-	err = s.storage.UpdateResource(&download.Resource)
-	if err != nil {
+	// stored with its first event before the routine can store later
+	// ones, and before it is registered, a delete in between would find
+	// nothing to wait for and the put would bring the record back
+	if err := s.storage.UpdateResource(&download.Resource, event); err != nil {
 		return openapi.Response(http.StatusInternalServerError, nil), err
 	}
-	return openapi.Response(http.StatusOK, openapi.DownloadStatus{
+	status := openapi.DownloadStatus{
 		DownloadId: download.Id,
-		Url:        download.Uri,
+		Url:        redact.Url(download.Uri),
 		Status:     fmt.Sprintf("%s", download.Status),
-	}), nil
+		StartTime:  download.StartTime,
+		Labels:     download.Labels,
+	}
+	s.downloads.Add(&download)
+	download.Start() // the routine owns the download from here
+	return openapi.Response(http.StatusOK, status), nil
+}
+
+// downloadEvent is stored with the change it reports and published
+// in the trace of the request, status is the status of the resource
+// when empty
+func downloadEvent(ctx context.Context, resource *model.Resource, status string) (*storage.OutboxEvent, error) {
+	return http_downloads.OutboxEvent(ctx, http_downloads.StatusEnvelope(resource, status))
+}
+
+// toDownloadStatus is the api view of a stored download
+func toDownloadStatus(resource *model.Resource) openapi.DownloadStatus {
+	return openapi.DownloadStatus{
+		DownloadId:      resource.Id,
+		Url:             redact.Url(resource.Uri),
+		Status:          fmt.Sprintf("%s", resource.Status),
+		ElapsedMS:       resource.GetElapsedMS(),
+		Progress:        resource.GetProgess(),
+		BytesDownloaded: int64(resource.BytesDownloaded()),
+		TotalSize:       int64(resource.FileSize),
+		StartTime:       resource.StartTime,
+		Labels:          resource.Labels,
+	}
 }
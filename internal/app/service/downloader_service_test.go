@@ -0,0 +1,367 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codejago/polypully/downloader/api/generated/openapi"
+	"github.com/codejago/polypully/downloader/internal/app/disk"
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
+	"github.com/spf13/viper"
+)
+
+func TestDownloadsDownloadIdPatch_ConcurrentResumesStartOneDownload(t *testing.T) {
+	origin := newOrigin(t)
+	api, store, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	pause := openapi.DownloadUpdate{Action: "pause"}
+	if response, err := api.DownloadsDownloadIdPatch(context.Background(), id, pause); err != nil || response.Code != http.StatusAccepted {
+		t.Fatalf("pause = %d, %v", response.Code, err)
+	}
+	fetches := origin.fetches.Load()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resume := openapi.DownloadUpdate{Action: "resume"}
+			if response, err := api.DownloadsDownloadIdPatch(context.Background(), id, resume); err != nil || response.Code != http.StatusAccepted {
+				t.Errorf("resume = %d, %v, expected 202", response.Code, err)
+			}
+		}()
+	}
+	wg.Wait()
+	eventually(t, "the fetch of the resumed download", func() bool { return origin.fetches.Load() > fetches })
+	time.Sleep(50 * time.Millisecond) // time for a second one to show
+	if started := origin.fetches.Load() - fetches; started != 1 {
+		t.Errorf("%d fetches after the resumes, expected 1", started)
+	}
+	if response, err := api.DownloadsDownloadIdDelete(context.Background(), id, false); err != nil || response.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d, %v", response.Code, err)
+	}
+	if r, _ := store.GetResource(id); r != nil {
+		t.Errorf("GetResource() = %s, expected the delete to stand", r.Status)
+	}
+}
+
+func TestDownloadsDownloadIdDelete_ForgetsThePausedUrl(t *testing.T) {
+	origin := newOrigin(t)
+	api, _, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	pause := openapi.DownloadUpdate{Action: "pause"}
+	if response, err := api.DownloadsDownloadIdPatch(context.Background(), id, pause); err != nil || response.Code != http.StatusAccepted {
+		t.Fatalf("pause = %d, %v", response.Code, err)
+	}
+	eventually(t, "the paused url", func() bool {
+		_, ok := downloads.PausedUri(id)
+		return ok && downloads.Get(id) == nil
+	})
+	if response, err := api.DownloadsDownloadIdDelete(context.Background(), id, false); err != nil || response.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d, %v", response.Code, err)
+	}
+	if uri, ok := downloads.PausedUri(id); ok {
+		t.Errorf("PausedUri() = %s, expected it forgotten with the download", uri)
+	}
+}
+
+// failingDeletes is a store whose deletes fail
+type failingDeletes struct {
+	storage.StorageApi
+}
+
+func (failingDeletes) DeleteResource(string, ...*storage.OutboxEvent) error {
+	return errors.New("the store is read only")
+}
+
+func TestDownloadsDownloadIdDelete_KeepsTheFilesOfARecordItCannotDelete(t *testing.T) {
+	origin := newOrigin(t)
+	api, store, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	api.DownloadsDownloadIdPatch(context.Background(), id, openapi.DownloadUpdate{Action: "pause"})
+	eventually(t, "the pause", func() bool { return downloads.Get(id) == nil })
+	resource, _ := store.GetResource(id)
+
+	failing := NewApiService(nil, failingDeletes{store}, disk.NewMonitor(&disk.MonitorConfig{}, nil), downloads, nil)
+	if response, err := failing.DownloadsDownloadIdDelete(context.Background(), id, false); err == nil || response.Code != http.StatusInternalServerError {
+		t.Fatalf("delete = %d, %v, expected 500", response.Code, err)
+	}
+	for _, f := range resource.Fragments {
+		if _, err := os.Stat(f.Filename); err != nil {
+			t.Errorf("fragment %s of the surviving record: %v", f.Filename, err)
+		}
+	}
+}
+
+func TestDownloadsDownloadIdDelete_StopsARunningDownload(t *testing.T) {
+	origin := newOrigin(t)
+	api, store, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	running := downloads.Get(id)
+	resource := running.Snapshot()
+
+	if response, err := api.DownloadsDownloadIdDelete(context.Background(), id, false); err != nil || response.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d, %v", response.Code, err)
+	}
+	select {
+	case <-running.Done():
+	default:
+		t.Errorf("delete returned before the download stopped")
+	}
+	// the stopped download stored its state before the record was deleted
+	if r, _ := store.GetResource(id); r != nil {
+		t.Errorf("GetResource() = %s, expected the record deleted", r.Status)
+	}
+	for _, f := range resource.Fragments {
+		if _, err := os.Stat(f.Filename); !os.IsNotExist(err) {
+			t.Errorf("fragment %s: %v, expected it removed", f.Filename, err)
+		}
+	}
+	if response, _ := api.DownloadsDownloadIdGet(context.Background(), id); response.Code != http.StatusNotFound {
+		t.Errorf("get = %d, expected 404", response.Code)
+	}
+}
+
+func TestDownloadsDownloadIdDelete_KeepsTheFile(t *testing.T) {
+	for _, keepFile := range []bool{true, false} {
+		origin := newOrigin(t)
+		origin.stalled.Store(false)
+		api, store, _ := newApi(t)
+		response, err := api.DownloadsPost(context.Background(), openapi.DownloadRequest{Url: origin.URL + "/f.bin"})
+		if err != nil || response.Code != http.StatusOK {
+			t.Fatalf("DownloadsPost() = %d, %v", response.Code, err)
+		}
+		id := response.Body.(openapi.DownloadStatus).DownloadId
+		eventually(t, "the download", func() bool {
+			r, _ := store.GetResource(id)
+			return r != nil && r.Status == model.DownloadComplete
+		})
+		resource, _ := store.GetResource(id)
+
+		if response, err := api.DownloadsDownloadIdDelete(context.Background(), id, keepFile); err != nil || response.Code != http.StatusNoContent {
+			t.Fatalf("delete keepFile %v = %d, %v", keepFile, response.Code, err)
+		}
+		if r, _ := store.GetResource(id); r != nil {
+			t.Errorf("keepFile %v: GetResource() = %s, expected the record deleted", keepFile, r.Status)
+		}
+		if _, err := os.Stat(resource.File); keepFile && err != nil {
+			t.Errorf("keepFile %v: %s: %v, expected it kept", keepFile, resource.File, err)
+		} else if !keepFile && !os.IsNotExist(err) {
+			t.Errorf("keepFile %v: %s: %v, expected it removed", keepFile, resource.File, err)
+		}
+		if resource.Manifest != "" {
+			if _, err := os.Stat(resource.Manifest); !os.IsNotExist(err) {
+				t.Errorf("keepFile %v: manifest %s: %v, expected it removed", keepFile, resource.Manifest, err)
+			}
+		}
+	}
+}
+
+func TestDownloadsGet_ShowsTheProgressOfARunningDownload(t *testing.T) {
+	origin := newOrigin(t)
+	api, _, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	response, err := api.DownloadsGet(context.Background(), "running", "", "", "", nil, "", 0, "")
+	if err != nil || response.Code != http.StatusOK {
+		t.Fatalf("DownloadsGet() = %d, %v", response.Code, err)
+	}
+	statuses := response.Body.([]openapi.DownloadStatus)
+	if len(statuses) != 1 || statuses[0].DownloadId != id || statuses[0].BytesDownloaded == 0 {
+		t.Errorf("DownloadsGet() = %+v, expected %s with its progress", statuses, id)
+	}
+	api.DownloadsDownloadIdPatch(context.Background(), id, openapi.DownloadUpdate{Action: "cancel"})
+}
+
+func TestDownloadsPost_CountsTheDownloadsInTheMetrics(t *testing.T) {
+	origin := newOrigin(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.ServeContent(w, r, "f.bin", time.Time{}, bytes.NewReader(origin.content))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	_, store, downloads := newApi(t)
+	metrics := metrics.NewMetrics(metrics.MetricsConfig{})
+	api := NewApiService(nil, store, disk.NewMonitor(&disk.MonitorConfig{}, nil), downloads, metrics)
+	// series sums the values of a metric, of those with the label value if one is given
+	series := func(name string, label string) float64 {
+		t.Helper()
+		families, err := metrics.Registry().Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := 0.0
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				matches := label == ""
+				for _, l := range m.GetLabel() {
+					matches = matches || l.GetValue() == label
+				}
+				if matches {
+					sum += m.GetCounter().GetValue() + m.GetGauge().GetValue()
+				}
+			}
+		}
+		return sum
+	}
+
+	running := startDownload(t, api, downloads, origin)
+	if active := series("downloads_active", ""); active != 1 {
+		t.Errorf("downloads_active = %v while one runs, expected 1", active)
+	}
+	api.DownloadsDownloadIdPatch(context.Background(), running, openapi.DownloadUpdate{Action: "cancel"})
+	eventually(t, "the cancel", func() bool { return downloads.Get(running) == nil })
+
+	// several fragments fail each attempt, the download fails once
+	viper.Set("download.max-conc-fragments", 4)
+	viper.Set("download.min-fragment-size", 100)
+	viper.Set("download.max-fragment-size", 1000)
+	viper.Set("download.retries", 1)
+	origin.stalled.Store(false)
+	ids := make([]string, 0, 2)
+	for _, url := range []string{origin.URL + "/f.bin", failing.URL + "/f.bin"} {
+		response, err := api.DownloadsPost(context.Background(), openapi.DownloadRequest{Url: url})
+		if err != nil || response.Code != http.StatusOK {
+			t.Fatalf("DownloadsPost(%s) = %d, %v", url, response.Code, err)
+		}
+		ids = append(ids, response.Body.(openapi.DownloadStatus).DownloadId)
+	}
+	eventually(t, "the downloads to stop", func() bool {
+		complete, _ := store.GetResource(ids[0])
+		failed, _ := store.GetResource(ids[1])
+		return complete != nil && complete.Status == model.DownloadComplete &&
+			failed != nil && failed.Status == model.DownloadError && downloads.Get(ids[1]) == nil
+	})
+
+	host := origin.Listener.Addr().(*net.TCPAddr).IP.String()
+	for _, expected := range []struct {
+		name  string
+		label string
+		value float64
+	}{
+		{"downloads_started_total", "", 3},
+		{"downloads_finished_total", "cancelled", 1},
+		{"downloads_finished_total", "complete", 1},
+		{"downloads_finished_total", "error", 1},
+		{"download_errors_total", "", 1},
+		{"download_errors_total", "http_5xx", 1},
+		{"downloads_active", "", 0},
+		{"download_retries_total", "", 1},
+	} {
+		if value := series(expected.name, expected.label); value != expected.value {
+			t.Errorf("%s{%s} = %v, expected %v", expected.name, expected.label, value, expected.value)
+		}
+	}
+	// the cancelled download had the first bytes, the complete one all of them
+	if bytes := series("download_bytes_total", host); bytes < float64(len(origin.content)) {
+		t.Errorf("download_bytes_total{%s} = %v, expected at least %d", host, bytes, len(origin.content))
+	}
+}
+
+// origin serves content, a GET stops after the first bytes while it
+// is stalled
+type origin struct {
+	*httptest.Server
+	content []byte
+	stalled atomic.Bool
+	fetches atomic.Int32
+}
+
+func newOrigin(t *testing.T) *origin {
+	o := &origin{content: bytes.Repeat([]byte("polypully"), 100)}
+	o.stalled.Store(true)
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			o.fetches.Add(1)
+		}
+		if r.Method != http.MethodGet || !o.stalled.Load() {
+			http.ServeContent(w, r, "f.bin", time.Time{}, bytes.NewReader(o.content))
+			return
+		}
+		if r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(o.content)))
+			w.Write(o.content[:100])
+		} else {
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+// newApi over an empty store, with downloads of one fragment into a
+// temporary directory
+func newApi(t *testing.T) (openapi.DefaultApiServicer, storage.StorageApi, RegistryApi) {
+	directory := t.TempDir()
+	viper.Set("download.directory", directory)
+	viper.Set("download.path-template", "%s/%s")
+	viper.Set("download.max-conc-fragments", 1)
+	viper.Set("download.min-fragment-size", 1000)
+	viper.Set("download.buffer-size", 1024)
+	viper.Set("download.filemode", 0o644)
+	t.Cleanup(viper.Reset)
+	local, err := storage.NewLocalStorage(&storage.LocalStorageConfig{Type: storage.MemoryBackend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewStorage(local)
+	metrics := metrics.NewMetrics(metrics.MetricsConfig{})
+	monitor := disk.NewMonitor(&disk.MonitorConfig{Path: directory}, metrics)
+	downloads := NewRegistry()
+	return NewApiService(nil, store, monitor, downloads, metrics), store, downloads
+}
+
+// startDownload from the origin and wait for its first bytes
+func startDownload(t *testing.T, api openapi.DefaultApiServicer, downloads RegistryApi, origin *origin) string {
+	t.Helper()
+	response, err := api.DownloadsPost(context.Background(), openapi.DownloadRequest{Url: origin.URL + "/f.bin"})
+	if err != nil || response.Code != http.StatusOK {
+		t.Fatalf("DownloadsPost() = %d, %v", response.Code, err)
+	}
+	id := response.Body.(openapi.DownloadStatus).DownloadId
+	eventually(t, "the first bytes", func() bool {
+		d := downloads.Get(id)
+		return d != nil && d.Snapshot().BytesDownloaded() > 0
+	})
+	return id
+}
+
+// eventually waits for ok to hold
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ok() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// stored status of a download
+func stored(t *testing.T, store storage.StorageApi, id string) model.DownloadStatus {
+	t.Helper()
+	r, err := store.GetResource(id)
+	if err != nil || r == nil {
+		t.Fatalf("GetResource() = %v, %v", r, err)
+	}
+	return r.Status
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	http_downloads "github.com/codejago/polypully/downloader/internal/app/http"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+var _ RegistryApi = (*Registry)(nil)
+
+// Registry tracks the downloads running in this process so they
+// can be reached after the request that started them has returned.
+type Registry struct {
+	lock      sync.RWMutex
+	downloads map[string]*http_downloads.Download
+	// urls of paused downloads, the store keeps them redacted
+	paused map[string]string
+	// downloads a user has paused since they last ran
+	held map[string]bool
+	// set when the service is shutting down
+	draining atomic.Bool
+}
+
+type RegistryApi interface {
+	// Add a started download, it is removed again when it stops
+	Add(download *http_downloads.Download)
+	// AddIfAbsent adds a download unless one with its id is running.
+	// Start runs under the registry lock, an error from it adds nothing.
+	AddIfAbsent(download *http_downloads.Download, start func() error) error
+	// IfAbsent runs fn unless a download with the id is running, none
+	// can be added until fn returns. False if one is running.
+	IfAbsent(id string, fn func() error) (bool, error)
+	// Get a running download or nil
+	Get(id string) *http_downloads.Download
+	// List the running downloads
+	List() []*http_downloads.Download
+	// PausedUri is the full url of a download paused by this process
+	PausedUri(id string) (string, bool)
+	// Forget the url of a paused download once it has been deleted or
+	// cancelled, nothing can resume it
+	Forget(id string)
+	// Hold marks a download a user has paused, until it runs again
+	Hold(id string)
+	// Held is true for a download a user has paused since it last ran
+	Held(id string) bool
+	// Drain refuses new and resumed downloads from now on
+	Drain()
+	// Draining is true once the service is shutting down
+	Draining() bool
+}
+
+func NewRegistry() RegistryApi {
+	return &Registry{downloads: make(map[string]*http_downloads.Download), paused: make(map[string]string),
+		held: make(map[string]bool)}
+}
+
+// ErrRunning refuses a download already running in this process
+var ErrRunning = errors.New("the download is already running")
+
+func (r *Registry) Add(download *http_downloads.Download) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.add(download)
+}
+
+func (r *Registry) AddIfAbsent(download *http_downloads.Download, start func() error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.running(download.Id) {
+		return ErrRunning
+	}
+	if err := start(); err != nil {
+		return err
+	}
+	r.add(download)
+	return nil
+}
+
+func (r *Registry) IfAbsent(id string, fn func() error) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.running(id) {
+		return false, nil
+	}
+	return true, fn()
+}
+
+// running is true for a download that has not stopped, one that has
+// may not have been removed yet. The lock is held.
+func (r *Registry) running(id string) bool {
+	download, ok := r.downloads[id]
+	if !ok {
+		return false
+	}
+	select {
+	case <-download.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// add with the lock held
+func (r *Registry) add(download *http_downloads.Download) {
+	r.downloads[download.Id] = download
+	delete(r.held, download.Id)
+	go func() {
+		<-download.Done()
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if current, ok := r.downloads[download.Id]; !ok || current != download {
+			return // forgotten, or resumed again and that one records its state
+		}
+		delete(r.downloads, download.Id)
+		if download.Status == model.DownloadPaused {
+			r.paused[download.Id] = download.Uri
+		} else {
+			delete(r.paused, download.Id)
+		}
+	}()
+}
+
+// Get leaves out a download that has stopped, it has stored its state
+// and a resume has to start it again
+func (r *Registry) Get(id string) *http_downloads.Download {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if !r.running(id) {
+		return nil
+	}
+	return r.downloads[id]
+}
+
+func (r *Registry) List() []*http_downloads.Download {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	downloads := make([]*http_downloads.Download, 0, len(r.downloads))
+	for id, d := range r.downloads {
+		if r.running(id) {
+			downloads = append(downloads, d)
+		}
+	}
+	return downloads
+}
+
+func (r *Registry) PausedUri(id string) (string, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	// stopped but not removed yet
+	if download, ok := r.downloads[id]; ok && !r.running(id) && download.Status == model.DownloadPaused {
+		return download.Uri, true
+	}
+	uri, ok := r.paused[id]
+	return uri, ok
+}
+
+func (r *Registry) Forget(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// stopped but not removed yet, it would record its url on the way
+	if !r.running(id) {
+		delete(r.downloads, id)
+	}
+	delete(r.paused, id)
+	delete(r.held, id)
+}
+
+func (r *Registry) Hold(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.held[id] = true
+}
+
+func (r *Registry) Held(id string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.held[id]
+}
+
+func (r *Registry) Drain() {
+	r.draining.Store(true)
+}
+
+func (r *Registry) Draining() bool {
+	return r.draining.Load()
+}
@@ -0,0 +1,95 @@
+package service
+
+// On a signal the service stops taking work, gives the running
+// downloads the grace period, pauses the rest with their progress
+// saved and closes the store once nothing can write to it.
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+type ShutdownConfig struct {
+	// time for the load balancer to see readiness fail
+	Drain time.Duration
+	// time the running downloads have to finish
+	GracePeriod time.Duration
+	// time the downloads left have to pause after it
+	PauseTimeout time.Duration
+	// stops the intake that does not go through the server, first
+	StopIntake func()
+	// fails readiness
+	Unready func()
+	// shuts the server down, a request let in before the drain can
+	// still add a download until it has
+	StopServer func(ctx context.Context)
+	// stops the background work and delivers the events, nothing
+	// stores anything after it
+	Flush func()
+	// closes the store
+	Close func()
+}
+
+// Shutdown runs the steps in order, a step left nil is skipped
+func Shutdown(config *ShutdownConfig, downloads RegistryApi) {
+	call := func(step func()) {
+		if step != nil {
+			step()
+		}
+	}
+	// a command taken from here on would only be refused
+	call(config.StopIntake)
+	// let the load balancer see the service is going first
+	call(config.Unready)
+	time.Sleep(config.Drain)
+	downloads.Drain()
+
+	grace, cancel := context.WithTimeout(context.Background(), config.GracePeriod)
+	defer cancel()
+	if config.StopServer != nil {
+		config.StopServer(grace)
+	}
+	if !awaitDownloads(grace, downloads) {
+		checkpoint(downloads, config.PauseTimeout)
+	}
+	call(config.Flush)
+	call(config.Close)
+}
+
+// awaitDownloads waits until every download in the registry has
+// stopped, false if the context is done first
+func awaitDownloads(ctx context.Context, downloads RegistryApi) bool {
+	for {
+		running := downloads.List()
+		if len(running) == 0 {
+			return true
+		}
+		for _, d := range running {
+			select {
+			case <-d.Done():
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+}
+
+// checkpoint pauses the downloads still running, they save the
+// progress of their fragments and can be resumed after a restart
+func checkpoint(downloads RegistryApi, timeout time.Duration) {
+	running := downloads.List()
+	slog.Info("pausing downloads", "count", len(running))
+	for _, d := range running {
+		d.Pause()
+	}
+	expired := time.After(timeout)
+	for _, d := range running {
+		select {
+		case <-d.Done():
+		case <-expired:
+			slog.Error("downloads did not pause in time", "timeout", timeout)
+			return
+		}
+	}
+}
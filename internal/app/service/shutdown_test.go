@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/codejago/polypully/downloader/api/generated/openapi"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+func TestShutdown_PausesADownloadPastTheGracePeriod(t *testing.T) {
+	origin := newOrigin(t)
+	api, store, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+
+	Shutdown(&ShutdownConfig{GracePeriod: 50 * time.Millisecond, PauseTimeout: 5 * time.Second}, downloads)
+	r, err := store.GetResource(id)
+	if err != nil || r == nil || r.Status != model.DownloadPaused {
+		t.Fatalf("GetResource() = %v, %v, expected it paused", r, err)
+	}
+	if r.BytesDownloaded() == 0 {
+		t.Errorf("stored without the progress of its fragments")
+	}
+}
+
+func TestShutdown_ClosesTheStoreAfterTheDownloads(t *testing.T) {
+	origin := newOrigin(t)
+	api, _, downloads := newApi(t)
+	id := startDownload(t, api, downloads, origin)
+	download := downloads.Get(id)
+
+	steps := make([]string, 0)
+	step := func(name string) func() { return func() { steps = append(steps, name) } }
+	Shutdown(&ShutdownConfig{
+		GracePeriod:  50 * time.Millisecond,
+		PauseTimeout: 5 * time.Second,
+		StopIntake:   step("intake"),
+		Unready:      step("unready"),
+		StopServer:   func(context.Context) { steps = append(steps, "server") },
+		Flush:        step("flush"),
+		Close: func() {
+			select {
+			case <-download.Done():
+			default:
+				t.Errorf("the store closed while %s was running", id)
+			}
+			if running := downloads.List(); len(running) != 0 {
+				t.Errorf("the store closed with %d downloads running", len(running))
+			}
+			steps = append(steps, "close")
+		}}, downloads)
+	if len(steps) != 5 || steps[0] != "intake" || steps[1] != "unready" || steps[2] != "server" ||
+		steps[3] != "flush" || steps[4] != "close" {
+		t.Errorf("steps = %v, expected intake, unready, server, flush and close", steps)
+	}
+	if _, err := api.DownloadsPost(context.Background(), openapi.DownloadRequest{Url: origin.URL + "/f.bin"}); err == nil {
+		t.Errorf("DownloadsPost() after the shutdown, expected it refused")
+	}
+}
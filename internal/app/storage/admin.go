@@ -0,0 +1,275 @@
+package storage
+
+// Offline maintenance of the store: export and import as JSON lines,
+// compaction, statistics and a consistency check.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+// Record is one line of an export. Index keys have no value.
+type Record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// PrefixStats counts the records under a key prefix
+type PrefixStats struct {
+	Records int   `json:"records"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Stats describes the size of the store
+type Stats struct {
+	// approximate size on disk
+	DiskBytes int64 `json:"disk_bytes"`
+	// by Resource, Schema, idx|status, idx|time, idx|url...
+	Prefixes map[string]*PrefixStats `json:"prefixes"`
+}
+
+// Export writes every key of a consistent view of the store as JSON lines
+func (s *LocalStorage) Export(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	var err error
+	iterErr := s.db.Iterate(nil, nil, false, func(k []byte, v []byte) bool {
+		record := &Record{Key: string(k)}
+		if len(v) > 0 {
+			record.Value = append(json.RawMessage{}, v...)
+		}
+		if err = encoder.Encode(record); err != nil {
+			err = fmt.Errorf("storage error exporting %s: %v", record.Key, err)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return iterErr
+}
+
+// Import writes the records of an export over the store and migrates
+// them if the export came from an older version. The export is read
+// whole first, an export from a newer version writes nothing. A
+// resource replaces the index keys of the one it overwrites.
+func (s *LocalStorage) Import(r io.Reader) (int, error) {
+	records, version, err := readExport(r)
+	if err != nil {
+		return 0, err
+	}
+	if version > SchemaVersion() {
+		return 0, fmt.Errorf("storage export version %d is newer than %d, refusing to downgrade",
+			version, SchemaVersion())
+	}
+	count, err := s.importRecords(records, version)
+	if err != nil {
+		return count, err
+	}
+	return count, s.migrate()
+}
+
+// importRecords of the current version puts the resources with their
+// index keys and drops the exported ones. Older records are written as
+// they are, for the migrations, without the index keys of the
+// resources they overwrite, and the store takes their version.
+func (s *LocalStorage) importRecords(records []*Record, version int) (int, error) {
+	current := version == SchemaVersion()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// an export can hold outbox events, they are counted again
+	s.counted = false
+	resourcePrefix := string(key(&model.Resource{}))
+	batch := new(Batch)
+	if !current {
+		// an export from before versioning has no version of its own
+		batch.Put([]byte(schemaKey), []byte(strconv.Itoa(version)))
+	}
+	// the records in the batch, it also deletes replaced index keys
+	count, queued := 0, 0
+	flush := func() error {
+		if err := s.db.Write(batch); err != nil {
+			return fmt.Errorf("storage error importing: %v", err)
+		}
+		count += queued
+		queued = 0
+		batch.Reset()
+		return nil
+	}
+	// the last imported event, the next stored one follows it
+	var seq uint64
+	for _, record := range records {
+		resource := strings.HasPrefix(record.Key, resourcePrefix)
+		if id, ok := strings.CutPrefix(record.Key, string(outboxPrefix())); ok {
+			if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+				seq = max(seq, n)
+			}
+		}
+		switch {
+		case current && resource:
+			r := &model.Resource{}
+			if err := json.Unmarshal(record.Value, r); err != nil {
+				return count, fmt.Errorf("storage import %s: %v", record.Key, err)
+			}
+			if err := flush(); err != nil {
+				return count, err
+			}
+			if err := s.put(r, nil); err != nil {
+				return count, err
+			}
+			count++
+			continue
+		case current && strings.HasPrefix(record.Key, indexPrefix):
+			continue
+		case resource:
+			previous, err := s.GetResource(strings.TrimPrefix(record.Key, resourcePrefix))
+			if err != nil {
+				return count, err
+			}
+			if previous != nil {
+				for _, k := range indexKeys(previous) {
+					batch.Delete(k)
+				}
+			}
+		}
+		batch.Put([]byte(record.Key), record.Value)
+		queued++
+		if batch.Len() >= 1000 {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+	// a sequence not read yet is read from the store with the imports
+	if s.seq > 0 {
+		s.seq = max(s.seq, seq)
+	}
+	return count, nil
+}
+
+// readExport returns the records of an export and the schema version
+// they were written with, 0 before versioning
+func readExport(r io.Reader) ([]*Record, int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	records := make([]*Record, 0)
+	version := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, 0, fmt.Errorf("storage import line %d: %v", line, err)
+		}
+		if record.Key == "" {
+			return nil, 0, fmt.Errorf("storage import line %d: key is required", line)
+		}
+		if record.Key == schemaKey {
+			v, err := strconv.Atoi(string(record.Value))
+			if err != nil {
+				return nil, 0, fmt.Errorf("storage import line %d: schema version %s is invalid", line, record.Value)
+			}
+			version = v
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("storage error reading import: %v", err)
+	}
+	return records, version, nil
+}
+
+// Compact the whole key range, reclaiming the space of deleted records
+func (s *LocalStorage) Compact() error {
+	return s.db.Compact()
+}
+
+func (s *LocalStorage) Stats() (*Stats, error) {
+	stats := &Stats{Prefixes: make(map[string]*PrefixStats)}
+	var err error
+	if stats.DiskBytes, err = s.db.Size(); err != nil {
+		return nil, err
+	}
+	err = s.db.Iterate(nil, nil, false, func(k []byte, v []byte) bool {
+		prefix := keyPrefix(k)
+		if stats.Prefixes[prefix] == nil {
+			stats.Prefixes[prefix] = &PrefixStats{}
+		}
+		stats.Prefixes[prefix].Records++
+		stats.Prefixes[prefix].Bytes += int64(len(k) + len(v))
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage error reading stats: %v", err)
+	}
+	return stats, nil
+}
+
+// keyPrefix is the record type, or the index name for index keys
+func keyPrefix(key []byte) string {
+	parts := strings.SplitN(string(key), "|", 3)
+	if parts[0]+"|" == indexPrefix && len(parts) > 1 {
+		return parts[0] + "|" + parts[1]
+	}
+	return parts[0]
+}
+
+// Verify lists the inconsistencies between the resources, their index
+// keys and their files. An empty list means the store is consistent.
+func (s *LocalStorage) Verify() ([]string, error) {
+	problems := make([]string, 0)
+	expected := make(map[string]string) // index key to resource id
+	err := s.db.Iterate(key(&model.Resource{}), nil, false, func(k []byte, v []byte) bool {
+		r := &model.Resource{}
+		if err := json.Unmarshal(v, r); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: unreadable: %v", k, err))
+			return true
+		}
+		for _, k := range indexKeys(r) {
+			expected[string(k)] = r.Id
+		}
+		if r.Status == model.DownloadComplete {
+			if _, err := os.Stat(r.File); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: complete but the file is missing: %v", r.Id, err))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage error verifying resources: %v", err)
+	}
+	err = s.db.Iterate([]byte(indexPrefix), nil, false, func(key []byte, _ []byte) bool {
+		k := string(key)
+		if _, ok := expected[k]; ok {
+			delete(expected, k)
+			return true
+		}
+		if r, _ := s.GetResource(idFromKey(key)); r == nil {
+			problems = append(problems, fmt.Sprintf("%s: no resource", k))
+		} else {
+			problems = append(problems, fmt.Sprintf("%s: stale, the resource has moved on", k))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage error verifying indexes: %v", err)
+	}
+	missing := make([]string, 0, len(expected))
+	for k, id := range expected {
+		missing = append(missing, fmt.Sprintf("%s: not indexed, missing %s", id, k))
+	}
+	sort.Strings(missing)
+	return append(problems, missing...), nil
+}
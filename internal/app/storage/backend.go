@@ -0,0 +1,90 @@
+package storage
+
+// LocalStorage keeps the resources, their index keys and the schema
+// version in an ordered key value store. A backend only provides
+// atomic batches and ordered iteration, everything else is shared.
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	LevelDBBackend = "leveldb"
+	BboltBackend   = "bbolt"
+	MemoryBackend  = "memory"
+)
+
+// Backend is an ordered key value store
+type Backend interface {
+	// returns the value of a key, nil if it is missing
+	Get(key []byte) ([]byte, error)
+	// applies the puts and deletes of the batch atomically
+	Write(batch *Batch) error
+	// calls fn in key order, or the reverse, for the keys with the prefix
+	// that come after the after key until fn returns false. The keys
+	// seen are a consistent view of the store, with bbolt of each chunk
+	// of it.
+	Iterate(prefix []byte, after []byte, reverse bool, fn func(key []byte, value []byte) bool) error
+	// reclaims the space of deleted keys
+	Compact() error
+	// bytes used on disk
+	Size() (int64, error)
+	// releases the store
+	Close() error
+}
+
+// Batch of puts and deletes, applied in order
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Put copies the key and value, they may belong to an iteration
+func (b *Batch) Put(key []byte, value []byte) {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(key), value: bytes.Clone(value)})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: bytes.Clone(key), delete: true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// openBackend opens the configured type of backend at the path
+func openBackend(config *LocalStorageConfig, path string) (Backend, error) {
+	switch config.Type {
+	case "", LevelDBBackend:
+		return openLevelDB(config, path)
+	case BboltBackend:
+		return openBbolt(path)
+	case MemoryBackend:
+		return newMemory(), nil
+	}
+	return nil, fmt.Errorf("storage type %q is not one of %s, %s or %s",
+		config.Type, LevelDBBackend, BboltBackend, MemoryBackend)
+}
+
+// prefixEnd is the first key after every key with the prefix, nil if
+// there is none
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
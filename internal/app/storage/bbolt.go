@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ Backend = (*Bbolt)(nil)
+
+// all keys share one bucket so they sort like they do in LevelDB
+var bboltBucket = []byte("downloader")
+
+// Bbolt keeps the store in a single file, downloader.db, in the
+// storage directory. The file can be opened with the bbolt tools.
+type Bbolt struct {
+	file string
+	// held for writing while Compact swaps the file
+	lock sync.RWMutex
+	db   *bolt.DB
+}
+
+func openBbolt(path string) (Backend, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, fmt.Errorf("storage error creating %s: %v", path, err)
+	}
+	b := &Bbolt{file: filepath.Join(path, "downloader.db")}
+	if err := b.open(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Bbolt) open() error {
+	// the file lock is exclusive, a second process fails rather than waits
+	db, err := bolt.Open(b.file, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("storage error opening db: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bboltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("storage error creating bucket: %v", err)
+	}
+	b.db = db
+	return nil
+}
+
+func (b *Bbolt) Get(key []byte) ([]byte, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// only valid for the life of the transaction
+		if v := tx.Bucket(bboltBucket).Get(key); v != nil {
+			data = bytes.Clone(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("storage error getting %s: %v", key, err)
+	}
+	return data, nil
+}
+
+func (b *Bbolt) Write(batch *Batch) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bboltBucket)
+		for _, op := range batch.ops {
+			var err error
+			if op.delete {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("storage error writing: %v", err)
+	}
+	return nil
+}
+
+// bboltChunk is the most keys copied out of a read transaction at once
+const bboltChunk = 256
+
+// Iterate copies the keys and values out of a read transaction a chunk
+// at a time and calls fn after each, like the memory backend. fn can
+// then read the store without a nested transaction, which a pending
+// Compact or a write growing the file would block. Each chunk is a
+// consistent view, the next starts after the last key of the one
+// before, so a page of a large store costs a chunk rather than the
+// whole range.
+func (b *Bbolt) Iterate(prefix []byte, after []byte, reverse bool, fn func(key []byte, value []byte) bool) error {
+	for {
+		keys, values, err := b.snapshot(prefix, after, reverse, bboltChunk)
+		if err != nil {
+			return fmt.Errorf("storage error iterating: %v", err)
+		}
+		for i, k := range keys {
+			if !fn(k, values[i]) {
+				return nil
+			}
+		}
+		if len(keys) < bboltChunk {
+			return nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// snapshot copies up to limit keys and values
+func (b *Bbolt) snapshot(prefix []byte, after []byte, reverse bool, limit int) (keys [][]byte, values [][]byte, err error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	err = b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bboltBucket).Cursor()
+		var k, v []byte
+		next := c.Next
+		if reverse {
+			next = c.Prev
+			start := after
+			if len(start) == 0 {
+				start = prefixEnd(prefix)
+			}
+			// the key before the first one at or after the start
+			if start == nil {
+				k, v = c.Last()
+			} else if k, _ = c.Seek(start); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		} else if len(after) == 0 {
+			k, v = c.Seek(prefix)
+		} else if k, v = c.Seek(after); bytes.Equal(k, after) {
+			k, v = c.Next()
+		}
+		// only valid for the life of the transaction
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(keys) < limit; k, v = next() {
+			keys = append(keys, bytes.Clone(k))
+			values = append(values, bytes.Clone(v))
+		}
+		return nil
+	})
+	return keys, values, err
+}
+
+// Compact copies the live keys into a new file and swaps it in
+func (b *Bbolt) Compact() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	compacted := b.file + ".compact"
+	dst, err := bolt.Open(compacted, 0o600, nil)
+	if err != nil {
+		return fmt.Errorf("storage error compacting: %v", err)
+	}
+	if err := bolt.Compact(dst, b.db, 0); err != nil {
+		dst.Close()
+		os.Remove(compacted)
+		return fmt.Errorf("storage error compacting: %v", err)
+	}
+	dst.Close()
+	if err := b.db.Close(); err != nil {
+		return fmt.Errorf("storage error compacting: %v", err)
+	}
+	if err := os.Rename(compacted, b.file); err != nil {
+		return fmt.Errorf("storage error compacting: %v", err)
+	}
+	return b.open()
+}
+
+func (b *Bbolt) Size() (int64, error) {
+	info, err := os.Stat(b.file)
+	if err != nil {
+		return 0, fmt.Errorf("storage error sizing: %v", err)
+	}
+	return info.Size(), nil
+}
+
+func (b *Bbolt) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.db.Close()
+}
@@ -0,0 +1,511 @@
+package storage
+
+// Every backend has to pass the same suite, so the service behaves the
+// same whichever storage.type is configured.
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	appevents "github.com/matthogan/polypully-events"
+)
+
+type opener func(t *testing.T) LocalStorageApi
+
+func openType(backend string) opener {
+	return func(t *testing.T) LocalStorageApi {
+		s, err := NewLocalStorage(&LocalStorageConfig{Type: backend, Path: t.TempDir()})
+		if err != nil {
+			t.Fatalf("NewLocalStorage(%s) error = %v", backend, err)
+		}
+		t.Cleanup(s.Close)
+		return s
+	}
+}
+
+var backends = map[string]opener{
+	LevelDBBackend: openType(LevelDBBackend),
+	BboltBackend:   openType(BboltBackend),
+	MemoryBackend:  openType(MemoryBackend),
+}
+
+var conformance = map[string]func(t *testing.T, open opener){
+	"BatchIsAppliedInOrder":        testBatchIsAppliedInOrder,
+	"GetPutDelete":                 testGetPutDelete,
+	"PutMovesIndexKeys":            testPutMovesIndexKeys,
+	"ListOrderLimitAndFilter":      testListOrderLimitAndFilter,
+	"QueryFollowsCursorToTheEnd":   testQueryFollowsCursorToTheEnd,
+	"QueryInvalidCursor":           testQueryInvalidCursor,
+	"ConcurrentWritesKeepIndexes":  testConcurrentWritesKeepIndexes,
+	"ExportImportRoundTrip":        testExportImportRoundTrip,
+	"VerifyReportsInconsistencies": testVerifyReportsInconsistencies,
+	"EmptyStoreIsCurrent":          testEmptyStoreIsCurrent,
+	"OutboxIsWrittenWithTheChange": testOutboxIsWrittenWithTheChange,
+	"IterateCallbackUsesTheStore":  testIterateCallbackUsesTheStore,
+	"ChangeKeepsOtherWrites":       testChangeKeepsOtherWrites,
+	"CommandIndexFindsTheDownload": testCommandIndexFindsTheDownload,
+	"ImportReplacesIndexKeys":      testImportReplacesIndexKeys,
+	"IterateManyKeys":              testIterateManyKeys,
+	"ImportedEventsKeepTheirSeq":   testImportedEventsKeepTheirSeq,
+}
+
+func TestConformance(t *testing.T) {
+	for backend, open := range backends {
+		for name, test := range conformance {
+			t.Run(backend+"/"+name, func(t *testing.T) { test(t, open) })
+		}
+	}
+}
+
+// putResources stores n resources, pairs share a start time so the id
+// has to break the tie
+func putResources(t *testing.T, s LocalStorageApi, n int) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		r := &model.Resource{Id: string(rune('a' + i)), Uri: fmt.Sprintf("u%d", i%2),
+			StartTime: start.Add(time.Duration(i/2) * time.Second)}
+		if err := s.PutResource(r); err != nil {
+			t.Fatalf("PutResource() error = %v", err)
+		}
+	}
+}
+
+func ids(resources []*model.Resource) string {
+	ids := ""
+	for _, r := range resources {
+		ids += r.Id
+	}
+	return ids
+}
+
+func testBatchIsAppliedInOrder(t *testing.T, open opener) {
+	db := open(t).(*LocalStorage).db
+	batch := new(Batch)
+	batch.Put([]byte("k|a"), []byte("1"))
+	batch.Put([]byte("k|b"), []byte("2"))
+	batch.Delete([]byte("k|a"))
+	if err := db.Write(batch); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	a, _ := db.Get([]byte("k|a"))
+	b, _ := db.Get([]byte("k|b"))
+	if a != nil || !bytes.Equal(b, []byte("2")) {
+		t.Errorf("Get() = %q, %q, expected nothing and 2", a, b)
+	}
+}
+
+func testGetPutDelete(t *testing.T, open opener) {
+	s := open(t)
+	if r, err := s.GetResource("a"); r != nil || err != nil {
+		t.Errorf("GetResource() = %v, %v, expected nil", r, err)
+	}
+	if err := s.PutResource(&model.Resource{Id: "a", Uri: "u", Labels: map[string]string{"k": "v"}}); err != nil {
+		t.Fatalf("PutResource() error = %v", err)
+	}
+	if r, err := s.GetResource("a"); err != nil || r == nil || r.Uri != "u" || r.Labels["k"] != "v" {
+		t.Errorf("GetResource() = %+v, %v, expected the stored resource", r, err)
+	}
+	if err := s.DeleteResource("a"); err != nil {
+		t.Fatalf("DeleteResource() error = %v", err)
+	}
+	if err := s.DeleteResource("a"); err != nil {
+		t.Errorf("DeleteResource() twice error = %v", err)
+	}
+	if r, _ := s.GetResource("a"); r != nil {
+		t.Errorf("GetResource() = %v after delete, expected nil", r)
+	}
+}
+
+func testPutMovesIndexKeys(t *testing.T, open opener) {
+	s := open(t)
+	r := &model.Resource{Id: "a", Uri: "u", Status: model.DownloadRunning}
+	if err := s.PutResource(r); err != nil {
+		t.Fatalf("PutResource() error = %v", err)
+	}
+	r.Status = model.DownloadComplete
+	if err := s.PutResource(r); err != nil {
+		t.Fatalf("PutResource() error = %v", err)
+	}
+	running, _ := s.ListResources(StatusIndex(model.DownloadRunning), nil, 0)
+	complete, _ := s.ListResources(StatusIndex(model.DownloadComplete), nil, 0)
+	if len(running) != 0 || len(complete) != 1 {
+		t.Errorf("ListResources() running = %d complete = %d, expected 0 and 1", len(running), len(complete))
+	}
+	if err := s.DeleteResource("a"); err != nil {
+		t.Fatalf("DeleteResource() error = %v", err)
+	}
+	byUrl, _ := s.ListResources(UrlIndex("u"), nil, 0)
+	all, _ := s.ListResources(TimeIndex(), nil, 0)
+	if len(byUrl) != 0 || len(all) != 0 {
+		t.Errorf("ListResources() = %d and %d after delete, expected 0", len(byUrl), len(all))
+	}
+}
+
+func testListOrderLimitAndFilter(t *testing.T, open opener) {
+	s := open(t)
+	putResources(t, s, 5)
+	for _, tt := range []struct {
+		index    *Index
+		filter   FilterResources
+		limit    int
+		expected string
+	}{
+		{TimeIndex(), nil, 0, "abcde"},
+		{&Index{Prefix: TimeIndex().Prefix, Reverse: true}, nil, 0, "edcba"},
+		{TimeIndex(), nil, 2, "ab"},
+		{TimeIndex(), func(r *model.Resource) bool { return r.Id != "b" }, 2, "ac"},
+		{UrlIndex("u1"), nil, 0, "bd"},
+		{&Index{Prefix: TimeIndex().Prefix, After: timeKey(&model.Resource{Id: "c",
+			StartTime: time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC)})}, nil, 0, "de"},
+		{&Index{Prefix: TimeIndex().Prefix, Reverse: true, After: timeKey(&model.Resource{Id: "c",
+			StartTime: time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC)})}, nil, 0, "ba"},
+		{StatusIndex(model.DownloadError), nil, 0, ""},
+	} {
+		resources, err := s.ListResources(tt.index, tt.filter, tt.limit)
+		if err != nil || ids(resources) != tt.expected {
+			t.Errorf("ListResources(%+v, %d) = %s, %v, expected %s", tt.index, tt.limit, ids(resources), err, tt.expected)
+		}
+	}
+}
+
+func testQueryFollowsCursorToTheEnd(t *testing.T, open opener) {
+	local := open(t)
+	putResources(t, local, 5)
+	storage := NewStorage(local)
+	for _, descending := range []bool{false, true} {
+		seen := ""
+		q := &Query{Descending: descending, Limit: 2}
+		for pages := 0; pages < 10; pages++ {
+			page, err := storage.QueryResources(q)
+			if err != nil {
+				t.Fatalf("QueryResources() error = %v", err)
+			}
+			seen += ids(page.Resources)
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+		expected := "abcde"
+		if descending {
+			expected = "edcba"
+		}
+		if seen != expected {
+			t.Errorf("QueryResources(descending=%v) = %s, expected %s", descending, seen, expected)
+		}
+	}
+}
+
+func testQueryInvalidCursor(t *testing.T, open opener) {
+	storage := NewStorage(open(t))
+	if _, err := storage.QueryResources(&Query{Cursor: "not a cursor"}); err != ErrInvalidCursor {
+		t.Errorf("QueryResources() error = %v, expected %v", err, ErrInvalidCursor)
+	}
+}
+
+func testConcurrentWritesKeepIndexes(t *testing.T, open opener) {
+	s := open(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := &model.Resource{Id: fmt.Sprintf("r%02d", i), Status: model.DownloadRunning}
+			for _, status := range []model.DownloadStatus{model.DownloadRunning, model.DownloadError} {
+				r.Status = status
+				if err := s.PutResource(r); err != nil {
+					t.Errorf("PutResource() error = %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	failed, _ := s.ListResources(StatusIndex(model.DownloadError), nil, 0)
+	if len(failed) != 20 {
+		t.Errorf("ListResources() = %d in error, expected 20", len(failed))
+	}
+	if problems, _ := s.Verify(); len(problems) != 0 {
+		t.Errorf("Verify() = %v, expected none", problems)
+	}
+}
+
+func testExportImportRoundTrip(t *testing.T, open opener) {
+	source := open(t)
+	putResources(t, source, 3)
+	var export bytes.Buffer
+	if err := source.Export(&export); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	target := open(t)
+	if _, err := target.Import(&export); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	resources, err := target.ListResources(TimeIndex(), nil, 0)
+	if err != nil || ids(resources) != "abc" {
+		t.Errorf("ListResources() = %s, %v, expected abc", ids(resources), err)
+	}
+	if problems, _ := target.Verify(); len(problems) != 0 {
+		t.Errorf("Verify() = %v, expected none", problems)
+	}
+}
+
+func testVerifyReportsInconsistencies(t *testing.T, open opener) {
+	s := open(t)
+	if err := s.PutResource(&model.Resource{Id: "a", Status: model.DownloadComplete, File: "/nonexistent"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Import(bytes.NewBufferString(`{"key":"idx|status|running|gone"}`)); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := s.Verify()
+	if err != nil || len(problems) != 2 {
+		t.Errorf("Verify() = %v, %v, expected 2 problems", problems, err)
+	}
+}
+
+func testEmptyStoreIsCurrent(t *testing.T, open opener) {
+	s := open(t)
+	version, err := s.Version()
+	if err != nil || version != SchemaVersion() {
+		t.Errorf("Version() = %d, %v, expected %d", version, err, SchemaVersion())
+	}
+	if pending, _ := s.PendingMigrations(); len(pending) != 0 {
+		t.Errorf("PendingMigrations() = %d, expected 0", len(pending))
+	}
+}
+
+func testOutboxIsWrittenWithTheChange(t *testing.T, open opener) {
+	s := open(t)
+	event := func(value string) *OutboxEvent {
+		return NewOutboxEvent(appevents.NewDownloadEvent(value, "a"), nil)
+	}
+	if err := s.PutResource(&model.Resource{Id: "a", Status: model.DownloadRunning}, event("running")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enqueue(event("queued")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteResource("a", event("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := s.PendingEvents(0)
+	if err != nil || len(pending) != 3 {
+		t.Fatalf("PendingEvents() = %d, %v, expected 3", len(pending), err)
+	}
+	for i, value := range []string{"running", "queued", "deleted"} {
+		if pending[i].Value != value || pending[i].Seq != uint64(i+1) {
+			t.Errorf("event %d is %s seq %d, expected %s seq %d", i, pending[i].Value, pending[i].Seq, value, i+1)
+		}
+	}
+	if stats, _ := s.Outbox(); stats.Pending != 3 || !stats.Oldest.Equal(pending[0].Created) {
+		t.Errorf("Outbox() = %+v, expected 3 since the first", stats)
+	}
+	if err := s.RemoveEvents(pending[:2]...); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := s.PendingEvents(1); len(left) != 1 || left[0].Value != "deleted" {
+		t.Errorf("PendingEvents() = %v after removing, expected the delete", left)
+	}
+	// the outbox is no index of the downloads
+	if problems, _ := s.Verify(); len(problems) != 0 {
+		t.Errorf("Verify() = %v, expected none", problems)
+	}
+}
+
+// fn reads and compacts the store, which waits for every reader, so a
+// backend iterating in a transaction would hang
+func testIterateCallbackUsesTheStore(t *testing.T, open opener) {
+	s := open(t).(*LocalStorage)
+	putResources(t, s, 3)
+	done := make(chan error, 1)
+	go func() {
+		seen := 0
+		done <- s.db.Iterate([]byte(TimeIndex().Prefix), nil, false, func(k []byte, _ []byte) bool {
+			if r, err := s.GetResource(idFromKey(k)); err != nil || r == nil {
+				t.Errorf("GetResource(%s) = %v, %v", idFromKey(k), r, err)
+			}
+			if seen++; seen == 1 {
+				if err := s.db.Compact(); err != nil {
+					t.Errorf("Compact() error = %v", err)
+				}
+			}
+			return true
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Iterate() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Iterate() blocked the store")
+	}
+}
+
+func testChangeKeepsOtherWrites(t *testing.T, open opener) {
+	s := open(t)
+	stale := &model.Resource{Id: "a", Uri: "u", Status: model.DownloadComplete}
+	if err := s.PutResource(stale); err != nil {
+		t.Fatalf("PutResource() error = %v", err)
+	}
+	if err := s.PutResource(&model.Resource{Id: "a", Uri: "u", Status: model.DownloadError}); err != nil {
+		t.Fatalf("PutResource() error = %v", err)
+	}
+	accessed := time.Now().UTC().Truncate(time.Second)
+	changed, err := s.ChangeResource("a", func(r *model.Resource) { r.LastAccessed = accessed })
+	if err != nil || !changed {
+		t.Fatalf("ChangeResource() = %v, %v, expected true", changed, err)
+	}
+	r, _ := s.GetResource("a")
+	if r.Status != model.DownloadError || !r.LastAccessed.Equal(accessed) {
+		t.Errorf("GetResource() = %s accessed %v, expected error accessed %v", r.Status, r.LastAccessed, accessed)
+	}
+	s.DeleteResource("a")
+	if changed, err := s.ChangeResource("a", func(r *model.Resource) {}); err != nil || changed {
+		t.Errorf("ChangeResource() = %v, %v after delete, expected false", changed, err)
+	}
+	if r, _ := s.GetResource("a"); r != nil {
+		t.Errorf("GetResource() = %v, expected the delete to stand", r)
+	}
+}
+
+func testCommandIndexFindsTheDownload(t *testing.T, open opener) {
+	s := open(t)
+	if err := s.PutResource(&model.Resource{Id: "a", Uri: "u", CommandId: "c|1"}); err != nil {
+		t.Fatalf("PutResource() error = %v", err)
+	}
+	if err := s.PutResource(&model.Resource{Id: "b", Uri: "u"}); err != nil {
+		t.Fatalf("PutResource() error = %v", err)
+	}
+	started, _ := s.ListResources(CommandIndex("c|1"), nil, 0)
+	other, _ := s.ListResources(CommandIndex("c"), nil, 0)
+	if len(started) != 1 || started[0].Id != "a" || len(other) != 0 {
+		t.Errorf("ListResources() = %d and %d, expected a and none", len(started), len(other))
+	}
+}
+
+func testImportReplacesIndexKeys(t *testing.T, open opener) {
+	source := open(t)
+	if err := source.PutResource(&model.Resource{Id: "a", Uri: "u", Status: model.DownloadPaused}); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err := source.Export(&export); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	target := open(t)
+	if err := target.PutResource(&model.Resource{Id: "a", Uri: "u", Status: model.DownloadRunning}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Import(&export); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	running, _ := target.ListResources(StatusIndex(model.DownloadRunning), nil, 0)
+	all, _ := target.ListResources(TimeIndex(), nil, 0)
+	if len(running) != 0 || len(all) != 1 || all[0].Status != model.DownloadPaused {
+		t.Errorf("ListResources() = %d running and %d in all, expected the paused one only", len(running), len(all))
+	}
+	if problems, _ := target.Verify(); len(problems) != 0 {
+		t.Errorf("Verify() = %v, expected none", problems)
+	}
+
+	// from before versioning, written as it is over the one stored and
+	// migrated
+	older := `{"key":"Resource|a","value":{"id":"a","uri":"u","status":3}}` + "\n" +
+		`{"key":"Resource|c","value":{"id":"c","uri":"u","status":3}}` + "\n" +
+		`{"key":"` + legacyIndexKey + `","value":{"name":"downloads","ids":["a","c"]}}`
+	if count, err := target.Import(bytes.NewBufferString(older)); err != nil || count != 3 {
+		t.Errorf("Import() = %d, %v, expected the three records", count, err)
+	}
+	if complete, _ := target.ListResources(StatusIndex(model.DownloadComplete), nil, 0); len(complete) != 2 {
+		t.Errorf("ListResources() = %d complete, expected a and c indexed by the migration", len(complete))
+	}
+
+	newer := `{"key":"Resource|b","value":{"id":"b"}}` + "\n" + `{"key":"Schema|version","value":99}`
+	if _, err := target.Import(bytes.NewBufferString(newer)); err == nil {
+		t.Errorf("Import() of a newer export succeeded")
+	}
+	if r, _ := target.GetResource("b"); r != nil {
+		t.Errorf("GetResource() = %v, expected nothing written", r)
+	}
+	if version, _ := target.Version(); version != SchemaVersion() {
+		t.Errorf("Version() = %d, expected %d", version, SchemaVersion())
+	}
+}
+
+// more keys than the bbolt backend copies at once
+func testIterateManyKeys(t *testing.T, open opener) {
+	db := open(t).(*LocalStorage).db
+	batch := new(Batch)
+	for i := 0; i < 600; i++ {
+		batch.Put([]byte(fmt.Sprintf("k|%03d", i)), []byte{byte(i)})
+	}
+	batch.Put([]byte("l|000"), nil)
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	for _, reverse := range []bool{false, true} {
+		seen := make([]string, 0)
+		after := []byte("k|100")
+		if reverse {
+			after = []byte("k|500")
+		}
+		err := db.Iterate([]byte("k|"), after, reverse, func(k []byte, _ []byte) bool {
+			seen = append(seen, string(k))
+			return true
+		})
+		expected, first, last := 499, "k|101", "k|599"
+		if reverse {
+			expected, first, last = 500, "k|499", "k|000"
+		}
+		if err != nil || len(seen) != expected || seen[0] != first || seen[len(seen)-1] != last {
+			t.Errorf("Iterate(reverse %v) = %d keys, expected %d from %s to %s, %v", reverse, len(seen), expected, first, last, err)
+		}
+	}
+	calls := 0
+	db.Iterate([]byte("k|"), nil, false, func(k []byte, _ []byte) bool {
+		calls++
+		return calls < 300
+	})
+	if calls != 300 {
+		t.Errorf("Iterate() called fn %d times after it stopped at 300", calls)
+	}
+}
+
+func testImportedEventsKeepTheirSeq(t *testing.T, open opener) {
+	event := func(value string) *OutboxEvent {
+		return NewOutboxEvent(appevents.NewDownloadEvent(value, "a"), nil)
+	}
+	s := open(t)
+	if err := s.Enqueue(event("before")); err != nil {
+		t.Fatal(err)
+	}
+	source := open(t)
+	if err := source.Enqueue(event("1"), event("2"), event("3")); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err := source.Export(&export); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	if _, err := s.Import(&export); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	// numbered after the imported events rather than over them
+	if err := s.Enqueue(event("after")); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := s.PendingEvents(0)
+	if err != nil || len(pending) != 4 {
+		t.Fatalf("PendingEvents() = %d, %v, expected 4", len(pending), err)
+	}
+	for i, value := range []string{"1", "2", "3", "after"} {
+		if pending[i].Value != value || pending[i].Seq != uint64(i+1) {
+			t.Errorf("event %d = %s seq %d, expected %s seq %d", i, pending[i].Value, pending[i].Seq, value, i+1)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+// Filters, ordering and paging over the stored downloads
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ByStatus matches downloads in the given status
+func ByStatus(status model.DownloadStatus) FilterResources {
+	return func(r *model.Resource) bool {
+		return r.Status == status
+	}
+}
+
+// ByUrlPrefix matches downloads whose url starts with the prefix
+func ByUrlPrefix(prefix string) FilterResources {
+	return func(r *model.Resource) bool {
+		return strings.HasPrefix(r.Uri, prefix)
+	}
+}
+
+// StartedSince matches downloads started at or after t
+func StartedSince(t time.Time) FilterResources {
+	return func(r *model.Resource) bool {
+		return !r.StartTime.Before(t)
+	}
+}
+
+// StartedUntil matches downloads started before t
+func StartedUntil(t time.Time) FilterResources {
+	return func(r *model.Resource) bool {
+		return r.StartTime.Before(t)
+	}
+}
+
+// ByLabels matches downloads carrying all of the labels
+func ByLabels(labels map[string]string) FilterResources {
+	return func(r *model.Resource) bool {
+		for k, v := range labels {
+			if actual, ok := r.Labels[k]; !ok || actual != v {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// All matches when every filter does, nil filters are ignored
+func All(filters ...FilterResources) FilterResources {
+	return func(r *model.Resource) bool {
+		for _, filter := range filters {
+			if filter != nil && !filter(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Query selects a page of downloads ordered by start time
+type Query struct {
+	Filter     FilterResources
+	Descending bool
+	// page size, 0 returns everything after the cursor
+	Limit int
+	// opaque position from a previous Page.Next
+	Cursor string
+}
+
+// Page of downloads, Next is empty on the last page
+type Page struct {
+	Resources []*model.Resource
+	Next      string
+}
+
+// cursors are the time index key of the last download of a page
+func cursorOf(r *model.Resource) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.TrimPrefix(timeKey(r), TimeIndex().Prefix)))
+}
+
+// parseCursor returns the time index key to resume after
+func parseCursor(s string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	start, id, ok := strings.Cut(string(b), "|")
+	if !ok || id == "" || len(start) != len(timeSegment(time.Time{})) {
+		return "", ErrInvalidCursor
+	}
+	if _, err := strconv.ParseUint(start, 10, 64); err != nil {
+		return "", ErrInvalidCursor
+	}
+	return TimeIndex().Prefix + string(b), nil
+}
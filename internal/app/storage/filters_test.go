@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+func TestAll_CombinesFilters(t *testing.T) {
+	r := &model.Resource{Uri: "https://example.com/a", Status: model.DownloadComplete, Labels: map[string]string{"team": "x"}}
+	if !All(ByUrlPrefix("https://example.com/"), nil, ByLabels(map[string]string{"team": "x"}))(r) {
+		t.Errorf("All() = false, expected true")
+	}
+	if All(ByUrlPrefix("https://example.com/"), ByStatus(model.DownloadError))(r) {
+		t.Errorf("All() = true, expected false")
+	}
+}
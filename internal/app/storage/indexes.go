@@ -0,0 +1,95 @@
+package storage
+
+// Secondary indexes are empty values under ordered keys that end in
+// the resource id, so a listing is a prefix scan rather than a read of
+// one ever growing record. They are written in the same batch as the
+// resource they point to.
+//
+//	idx|status|<status>|<id>
+//	idx|time|<start unix nanos, zero padded>|<id>
+//	idx|url|<sha256 of the url>|<id>
+//	idx|command|<sha256 of the command id>|<id>, for stream commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+const (
+	indexPrefix = "idx|"
+	// the single list of ids kept before the key-prefix indexes
+	legacyIndexKey = "Index|downloads"
+)
+
+// Index is a range of index keys to list resources from
+type Index struct {
+	// all keys of the index start with the prefix
+	Prefix string
+	// resume after this key, in the direction of the listing
+	After string
+	// list in descending key order
+	Reverse bool
+}
+
+// StatusIndex lists the resources in a status
+func StatusIndex(status model.DownloadStatus) *Index {
+	return &Index{Prefix: indexPrefix + "status|" + status.String() + "|"}
+}
+
+// TimeIndex lists all resources by start time, oldest first
+func TimeIndex() *Index {
+	return &Index{Prefix: indexPrefix + "time|"}
+}
+
+// UrlIndex lists the downloads of a url
+func UrlIndex(url string) *Index {
+	return &Index{Prefix: indexPrefix + "url|" + hash(url) + "|"}
+}
+
+// CommandIndex lists the download started by a stream command
+func CommandIndex(commandId string) *Index {
+	return &Index{Prefix: indexPrefix + "command|" + hash(commandId) + "|"}
+}
+
+// timeKey is the time index key of a resource
+func timeKey(r *model.Resource) string {
+	return TimeIndex().Prefix + timeSegment(r.StartTime) + "|" + r.Id
+}
+
+// timeSegment sorts lexically in time order, the zero time first
+func timeSegment(t time.Time) string {
+	nanos := int64(0)
+	if t.After(time.Unix(0, 0)) {
+		nanos = t.UnixNano()
+	}
+	return fmt.Sprintf("%020d", nanos)
+}
+
+// hash of a segment that may contain |
+func hash(segment string) string {
+	sum := sha256.Sum256([]byte(segment))
+	return hex.EncodeToString(sum[:])
+}
+
+// indexKeys are all of the index keys of a resource
+func indexKeys(r *model.Resource) [][]byte {
+	keys := [][]byte{
+		[]byte(StatusIndex(r.Status).Prefix + r.Id),
+		[]byte(timeKey(r)),
+		[]byte(UrlIndex(r.Uri).Prefix + r.Id),
+	}
+	if r.CommandId != "" {
+		keys = append(keys, []byte(CommandIndex(r.CommandId).Prefix+r.Id))
+	}
+	return keys
+}
+
+// idFromKey is the last segment of an index key, ids do not contain |
+func idFromKey(key []byte) string {
+	return string(key[bytes.LastIndexByte(key, '|')+1:])
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var _ Backend = (*LevelDB)(nil)
+
+// LevelDB is the default backend, a directory of LevelDB files
+type LevelDB struct {
+	path string
+	// reference to the leveldb database must be closed
+	db *leveldb.DB
+}
+
+func openLevelDB(config *LocalStorageConfig, path string) (Backend, error) {
+	options := options(config)
+	db, err := leveldb.OpenFile(path, options)
+	// if the database is corrupted, go into recovery mode if enabled
+	if err != nil {
+		switch err.(type) {
+		case *errors.ErrCorrupted:
+			slog.Warn("storage", "corrupted", err, "attempting recovery", config.Recovery)
+			if config.Recovery {
+				db, err = leveldb.RecoverFile(path, options)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storage error opening db: %v", err)
+	}
+	return &LevelDB{path: path, db: db}, nil
+}
+
+func options(config *LocalStorageConfig) *opt.Options {
+	options := &opt.Options{}
+	if config.BufferMiB > 0 {
+		options.WriteBuffer = config.BufferMiB * opt.MiB
+	} else {
+		options.WriteBuffer = 2 * opt.MiB
+	}
+	if config.CacheMiB > 0 {
+		options.BlockCacheCapacity = config.CacheMiB * opt.MiB
+	} else {
+		options.BlockCacheCapacity = 2 * opt.MiB
+	}
+	if config.Compression == "snappy" {
+		options.Compression = opt.SnappyCompression
+	} else if config.Compression == "none" { // less memory, more disk
+		options.Compression = opt.NoCompression
+	} else {
+		options.Compression = opt.DefaultCompression
+	}
+	return options
+}
+
+func (l *LevelDB) Get(key []byte) ([]byte, error) {
+	data, err := l.db.Get(key, nil)
+	if err == errors.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("storage error getting %s: %v", key, err)
+	}
+	return data, nil
+}
+
+func (l *LevelDB) Write(batch *Batch) error {
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+	if err := l.db.Write(b, nil); err != nil {
+		return fmt.Errorf("storage error writing: %v", err)
+	}
+	return nil
+}
+
+// Iterate reads from an iterator, which is an implicit snapshot
+func (l *LevelDB) Iterate(prefix []byte, after []byte, reverse bool, fn func(key []byte, value []byte) bool) error {
+	iter := l.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	next := iter.Next
+	if reverse {
+		next = iter.Prev
+	}
+	for ok := first(iter, after, reverse); ok; ok = next() {
+		if !fn(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("storage error iterating: %v", err)
+	}
+	return nil
+}
+
+// first positions the iterator on the first key after the after key
+func first(iter iterator.Iterator, after []byte, reverse bool) bool {
+	if len(after) == 0 {
+		if reverse {
+			return iter.Last()
+		}
+		return iter.First()
+	}
+	if reverse {
+		// the key before the first one at or after the cursor
+		if !iter.Seek(after) {
+			return iter.Last()
+		}
+		return iter.Prev()
+	}
+	if !iter.Seek(after) {
+		return false
+	}
+	if bytes.Equal(iter.Key(), after) {
+		return iter.Next()
+	}
+	return true
+}
+
+func (l *LevelDB) Compact() error {
+	if err := l.db.CompactRange(util.Range{}); err != nil {
+		return fmt.Errorf("storage error compacting: %v", err)
+	}
+	return nil
+}
+
+// Size of the tables and the journal, which SizeOf leaves out
+func (l *LevelDB) Size() (int64, error) {
+	var size int64
+	err := filepath.WalkDir(l.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil {
+			size += info.Size()
+		} else if os.IsNotExist(err) { // compacted away meanwhile
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("storage error sizing: %v", err)
+	}
+	return size, nil
+}
+
+// release the os lock on the db files
+func (l *LevelDB) Close() error {
+	return l.db.Close() // close also flushes the write buffer
+}
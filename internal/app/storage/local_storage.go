@@ -3,31 +3,36 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"reflect"
+	"sync"
 
 	"github.com/codejago/polypully/downloader/internal/app/model"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/errors"
-	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/codejago/polypully/downloader/internal/app/redact"
 )
 
 // LocalStorage is a storage implementation that uses the local file system
-// and is backed by a LevelDB database for persistence. The store is
-// intended for use by a single instance of the application and is
-// effectively throwaway. It is not intended to be used as a long-term
-// storage solution.
+// and is backed by an ordered key value store, LevelDB by default, see
+// backend.go. The store is intended for use by a single instance of the
+// application. It holds the download history, so the record shape is
+// versioned and migrated rather than thrown away, see migrations.go.
 
 var _ LocalStorageApi = (*LocalStorage)(nil)
 
 type LocalStorage struct {
 	// configuration for the storage
 	config *LocalStorageConfig
-	// leveldb options
-	options *opt.Options
-	// reference to the leveldb database must be closed
-	db *leveldb.DB
+	// the key value store must be closed
+	db Backend
+	// serialises the read of the previous index keys with the write
+	lock sync.Mutex
+	// of the last event put in the outbox, see outbox.go
+	seq uint64
+	// events in the outbox, once counted
+	pending int
+	counted bool
 }
 
 // record is a helper struct for storing records
@@ -36,144 +41,193 @@ type record interface {
 	Identifier() string
 }
 
-func (r *Index) Identifier() string {
-	return r.Id
-}
-
 // filters resources based on their download status, by convention
 type FilterResources func(r *model.Resource) bool
 
 type LocalStorageApi interface {
 	// returns a resource from the storage based on a key
 	GetResource(id string) (*model.Resource, error)
-	// stores a resource in the storage based on a key
-	PutResource(id string, value *model.Resource) error
-	// returns a list of all resources in the storage
-	ListResources(i *Index, filter FilterResources) ([]*model.Resource, error)
-	// returns an index from the storage based on an id
-	GetIndex(id string) (*Index, error)
-	// stores an index in the storage based on an id
-	PutIndex(id string, value *Index) error
-	// atomically stores a resource and an index in the storage
-	PutResourceIndexed(value *model.Resource, index *Index) error
+	// atomically stores a resource, its index keys and the events of
+	// the change
+	PutResource(value *model.Resource, events ...*OutboxEvent) error
+	// changes the stored version of a resource, false if there is none
+	ChangeResource(id string, change func(r *model.Resource)) (bool, error)
+	// atomically removes a resource and its index keys and stores the
+	// events of the change
+	DeleteResource(id string, events ...*OutboxEvent) error
+	// stores events on their own
+	Enqueue(events ...*OutboxEvent) error
+	// events not yet published, oldest first
+	PendingEvents(limit int) ([]*OutboxEvent, error)
+	// removes published events
+	RemoveEvents(events ...*OutboxEvent) error
+	// how many events are waiting and since when
+	Outbox() (*OutboxStats, error)
+	// returns the resources in an index, in order
+	ListResources(i *Index, filter FilterResources, limit int) ([]*model.Resource, error)
+	// schema version of the stored records
+	Version() (int, error)
+	// migrations not yet applied to the store
+	PendingMigrations() ([]*Migration, error)
+	// writes every record as a JSON line
+	Export(w io.Writer) error
+	// restores the records of an export, returning how many
+	Import(r io.Reader) (int, error)
+	// compacts the underlying store
+	Compact() error
+	// size and record counts per key prefix
+	Stats() (*Stats, error)
+	// reports inconsistent indexes and missing files
+	Verify() ([]string, error)
 	// closes the storage
 	Close()
 }
 
 type LocalStorageConfig struct {
-	// path to the storage directory
+	// leveldb, bbolt or memory
+	Type string
+	// path to the storage directory, unused in memory
 	Path string
-	// write buffer size
+	// leveldb write buffer size
 	BufferMiB int
-	// cache for frequently accessed blocks
+	// leveldb cache for frequently accessed blocks
 	CacheMiB int
-	// default, snappy, none
+	// leveldb default, snappy, none
 	Compression string
-	// recovery will be attempted if corruption is detected
+	// leveldb recovery will be attempted if corruption is detected
 	Recovery bool
+	// open without migrating, to inspect the store
+	SkipMigrations bool
 }
 
-// A new local storage instance backed by leveldb, which is a thread-safe
-// key-value store.
+// A new local storage instance backed by the configured type of key
+// value store. All of the backends are thread-safe.
 func NewLocalStorage(config *LocalStorageConfig) (LocalStorageApi, error) {
 	if config == nil {
 		return nil, fmt.Errorf("storage config is required")
 	}
-	if config.Path == "" {
-		return nil, fmt.Errorf("storage path is required")
-	}
-	if fileInfo, err := os.Stat(config.Path); os.IsNotExist(err) || !fileInfo.IsDir() {
-		return nil, fmt.Errorf("storage path is not a directory or is inaccessible to the app user")
-	}
-	options := options(config)
-	db, err := leveldb.OpenFile(config.Path, options)
-	// if the database is corrupted, go into recovery mode if enabled
-	if err != nil {
-		switch err.(type) {
-		case *errors.ErrCorrupted:
-			slog.Warn("storage", "corrupted", err, "attempting recovery", config.Recovery)
-			if config.Recovery {
-				db, err = leveldb.RecoverFile(config.Path, options)
-			}
+	if config.Type != MemoryBackend {
+		if config.Path == "" {
+			return nil, fmt.Errorf("storage path is required")
+		}
+		if fileInfo, err := os.Stat(config.Path); os.IsNotExist(err) || !fileInfo.IsDir() {
+			return nil, fmt.Errorf("storage path is not a directory or is inaccessible to the app user")
 		}
 	}
+	db, err := openBackend(config, config.Path)
 	if err != nil {
-		return nil, fmt.Errorf("storage error opening db: %v", err)
+		return nil, err
+	}
+	s := &LocalStorage{config: config, db: db}
+	if !config.SkipMigrations {
+		if err := s.migrate(); err != nil {
+			s.Close()
+			return nil, err
+		}
 	}
-	return &LocalStorage{config: config, options: options, db: db}, nil
+	return s, nil
 }
 
-// release the os lock on the db files
+// release the os lock on the store
 func (s *LocalStorage) Close() {
 	if s.db == nil {
 		return
 	}
-	if err := s.db.Close(); err != nil { // close also flushes the write buffer
+	if err := s.db.Close(); err != nil {
 		slog.Warn("storage error closing db", "error", err)
 	}
 }
 
-func options(config *LocalStorageConfig) *opt.Options {
-	options := &opt.Options{}
-	if config.BufferMiB > 0 {
-		options.WriteBuffer = config.BufferMiB * opt.MiB
-	} else {
-		options.WriteBuffer = 2 * opt.MiB
-	}
-	if config.CacheMiB > 0 {
-		options.BlockCacheCapacity = config.CacheMiB * opt.MiB
-	} else {
-		options.BlockCacheCapacity = 2 * opt.MiB
-	}
-	if config.Compression == "snappy" {
-		options.Compression = opt.SnappyCompression
-	} else if config.Compression == "none" { // less memory, more disk
-		options.Compression = opt.NoCompression
-	} else {
-		options.Compression = opt.DefaultCompression
-	}
-	return options
-}
-
-// Index is a helper struct for indexing resources
-// The Index records will probably always be hot
-// Avoids iterating over the entire db...
-type Index struct {
-	// name of the index, unique if used as the key for this record
-	Id string `json:"name"`
-	// ids of other resources in the storage
-	Ids []string `json:"ids"`
-}
-
-func (s *LocalStorage) GetIndex(id string) (*Index, error) {
-	i, err := get(s, &Index{Id: id})
+func (s *LocalStorage) GetResource(id string) (*model.Resource, error) {
+	r, err := get(s, &model.Resource{Id: id})
 	if err != nil {
 		return nil, err
 	}
-	if i == nil {
-		return &Index{Id: id, Ids: make([]string, 0)}, err
+	if r == nil {
+		return nil, nil
 	}
-	return *i, err
+	return *r, err
 }
 
-func (s *LocalStorage) PutIndex(id string, value *Index) error {
-	return put(s, value)
+// PutResource stores the resource, its index keys and the events in
+// one batch, replacing the keys of the previous version of the resource
+func (s *LocalStorage) PutResource(value *model.Resource, events ...*OutboxEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.put(value, events)
 }
 
-func (s *LocalStorage) GetResource(id string) (*model.Resource, error) {
-	r, err := get(s, &model.Resource{Id: id})
-	if err != nil {
-		return nil, err
+// ChangeResource reads, changes and stores the resource under the
+// lock, so a copy read before another write cannot undo it
+func (s *LocalStorage) ChangeResource(id string, change func(r *model.Resource)) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current, err := s.GetResource(id)
+	if err != nil || current == nil {
+		return false, err
 	}
-	return *r, err
+	change(current)
+	return true, s.put(current, nil)
 }
 
-func (s *LocalStorage) PutResource(id string, value *model.Resource) error {
-	return put(s, value)
+// put is PutResource with the lock held
+func (s *LocalStorage) put(value *model.Resource, events []*OutboxEvent) error {
+	previous, err := s.GetResource(value.Id)
+	if err != nil {
+		return err
+	}
+	// the running download keeps its credentials, the store does not
+	stored := *value
+	stored.Uri = redact.Url(value.Uri)
+	value = &stored
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("storage error marshalling resource: %v", err)
+	}
+	batch := new(Batch)
+	if previous != nil {
+		for _, k := range indexKeys(previous) {
+			batch.Delete(k)
+		}
+	}
+	batch.Put(key(value), data)
+	for _, k := range indexKeys(value) {
+		batch.Put(k, nil)
+	}
+	if err := s.addEvents(batch, events); err != nil {
+		return err
+	}
+	if err := s.db.Write(batch); err != nil {
+		return fmt.Errorf("storage error storing resource: %v", err)
+	}
+	s.pending += len(events)
+	return nil
 }
 
-func (s *LocalStorage) PutResourceIndexed(r *model.Resource, i *Index) error {
-	return putb(s, i, r)
+// DeleteResource removes the resource and its index keys and stores
+// the events in one batch
+func (s *LocalStorage) DeleteResource(id string, events ...*OutboxEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	previous, err := s.GetResource(id)
+	if err != nil || (previous == nil && len(events) == 0) {
+		return err
+	}
+	batch := new(Batch)
+	if previous != nil {
+		batch.Delete(key(previous))
+		for _, k := range indexKeys(previous) {
+			batch.Delete(k)
+		}
+	}
+	if err := s.addEvents(batch, events); err != nil {
+		return err
+	}
+	if err := s.db.Write(batch); err != nil {
+		return fmt.Errorf("storage error deleting resource: %v", err)
+	}
+	s.pending += len(events)
+	return nil
 }
 
 //
@@ -188,79 +242,47 @@ func key[U record](value U) []byte {
 }
 
 func get[U record](s *LocalStorage, value U) (*U, error) {
-	data, err := s.db.Get(key(value), nil)
-	if err != nil && err == errors.ErrNotFound {
+	data, err := s.db.Get(key(value))
+	if err != nil {
+		return nil, err
+	} else if data == nil {
 		return nil, nil
-	} else if err != nil {
-		return nil, fmt.Errorf("storage error getting index: %v", err)
 	}
 	err = json.Unmarshal(data, value)
 	if err != nil {
-		return nil, fmt.Errorf("storage error unmarshalling index: %v", err)
+		return nil, fmt.Errorf("storage error unmarshalling: %v", err)
 	}
 	return &value, nil
 }
 
-// putb stores multiple records in a batch
-// the first record is the index and the rest are resources
-func putb[U record, V record](s *LocalStorage, value U, values ...V) error {
-	batch := new(leveldb.Batch)
-	data, err := json.Marshal(value)
-	if err != nil {
-		return fmt.Errorf("storage error marshalling: %v", err)
-	}
-	batch.Put(key(value), data)
-	for _, value := range values {
-		data, err := json.Marshal(value)
-		if err != nil {
-			return fmt.Errorf("storage error marshalling: %v", err)
-		}
-		batch.Put(key(value), data)
-	}
-	if err := s.db.Write(batch, nil); err != nil {
-		return fmt.Errorf("storage error storing: %v", err)
-	}
-	return nil
-}
-
-// put stores a single index or resource record
-func put[U record](s *LocalStorage, value U) error {
-	data, err := json.Marshal(value)
-	if err != nil {
-		return fmt.Errorf("storage error marshalling resource: %v", err)
-	}
-	err = s.db.Put(key(value), data, nil)
-	if err != nil {
-		return fmt.Errorf("storage error storing resource: %v", err)
-	}
-	return nil
-}
-
-// Returns the resources listed in the index only.
-// The filter can be used to further refine the results
-func (s *LocalStorage) ListResources(index *Index, filter FilterResources) ([]*model.Resource, error) {
+// Returns the resources listed in the index in key order, or the
+// reverse. The filter can be used to further refine the results and
+// listing stops once limit resources match, 0 for no limit.
+func (s *LocalStorage) ListResources(index *Index, filter FilterResources, limit int) ([]*model.Resource, error) {
 	if index == nil {
 		return nil, fmt.Errorf("storage index is required")
 	}
 	resources := make([]*model.Resource, 0)
-	if len(index.Ids) == 0 {
-		return resources, nil
-	}
-	value := &model.Resource{}
-	for _, id := range index.Ids {
-		value.Id = id
-		data, err := s.db.Get(key(value), nil)
-		if err != nil {
-			return nil, fmt.Errorf("storage error getting index: %v", err)
+	var err error
+	iterErr := s.db.Iterate([]byte(index.Prefix), []byte(index.After), index.Reverse, func(k []byte, _ []byte) bool {
+		var resource *model.Resource
+		if resource, err = s.GetResource(idFromKey(k)); err != nil {
+			return false
 		}
-		resource := model.Resource{}
-		err = json.Unmarshal(data, &resource)
-		if err != nil {
-			return nil, fmt.Errorf("storage error unmarshalling resource: %v", err)
+		if resource == nil { // index keys are written with the resource
+			slog.Warn("storage index without resource", "index", string(k))
+			return true
 		}
-		if filter == nil || filter(&resource) {
-			resources = append(resources, &resource)
+		if filter == nil || filter(resource) {
+			resources = append(resources, resource)
 		}
+		return limit <= 0 || len(resources) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if iterErr != nil {
+		return nil, fmt.Errorf("storage error listing resources: %v", iterErr)
 	}
 	return resources, nil
 }
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var _ Backend = (*Memory)(nil)
+
+// Memory keeps the store in a map for tests and runs that do not need
+// the history, nothing survives the process
+type Memory struct {
+	lock sync.RWMutex
+	data map[string][]byte
+}
+
+func newMemory() Backend {
+	return &Memory{data: make(map[string][]byte)}
+}
+
+func (m *Memory) Get(key []byte) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if v, ok := m.data[string(key)]; ok {
+		return bytes.Clone(v), nil
+	}
+	return nil, nil
+}
+
+func (m *Memory) Write(batch *Batch) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, op := range batch.ops {
+		if op.delete {
+			delete(m.data, string(op.key))
+		} else {
+			m.data[string(op.key)] = bytes.Clone(op.value)
+		}
+	}
+	return nil
+}
+
+// Iterate copies the matching keys first, so fn can read the store
+func (m *Memory) Iterate(prefix []byte, after []byte, reverse bool, fn func(key []byte, value []byte) bool) error {
+	m.lock.RLock()
+	keys := make([]string, 0)
+	for k := range m.data {
+		if !strings.HasPrefix(k, string(prefix)) {
+			continue
+		}
+		if len(after) > 0 && ((!reverse && k <= string(after)) || (reverse && k >= string(after))) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = m.data[k]
+	}
+	m.lock.RUnlock()
+	for i, k := range keys {
+		if !fn([]byte(k), values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Compact() error {
+	return nil
+}
+
+func (m *Memory) Size() (int64, error) {
+	return 0, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+// The shape of the stored records is versioned. The version is kept
+// under its own key and every change to the shape that old records
+// cannot be read with comes with a migration, applied in order when
+// the store is opened.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+)
+
+const schemaKey = "Schema|version"
+
+// Migration moves the store from Version-1 to Version. The changes are
+// added to the batch, which is written with the new version.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(s *LocalStorage, batch *Batch) error
+}
+
+// migrations are ordered by version, append only
+var migrations = []*Migration{
+	{Version: 1, Description: "replace the downloads id list with key-prefix indexes", Migrate: migrateIndex},
+}
+
+// SchemaVersion is the version the code reads and writes
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Version of the records in the store, 0 before versioning. An empty
+// store has no records to migrate and is at the current version.
+func (s *LocalStorage) Version() (int, error) {
+	data, err := s.db.Get([]byte(schemaKey))
+	if err != nil {
+		return 0, fmt.Errorf("storage error reading schema version: %v", err)
+	} else if data == nil {
+		empty := true
+		err := s.db.Iterate(nil, nil, false, func([]byte, []byte) bool {
+			empty = false
+			return false
+		})
+		if empty {
+			return SchemaVersion(), err
+		}
+		return 0, err
+	}
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("storage schema version %q is invalid: %v", data, err)
+	}
+	return version, nil
+}
+
+// PendingMigrations are the migrations the store has not had yet
+func (s *LocalStorage) PendingMigrations() ([]*Migration, error) {
+	version, err := s.Version()
+	if err != nil {
+		return nil, err
+	}
+	if version > SchemaVersion() {
+		return nil, fmt.Errorf("storage schema version %d is newer than %d, refusing to downgrade",
+			version, SchemaVersion())
+	}
+	pending := make([]*Migration, 0)
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrate snapshots the store and then applies the pending migrations,
+// each one in a batch together with its version
+func (s *LocalStorage) migrate() error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		batch := new(Batch)
+		batch.Put([]byte(schemaKey), []byte(strconv.Itoa(SchemaVersion())))
+		return s.db.Write(batch)
+	}
+	// nothing outlives the process in memory, so there is nothing to lose
+	backup := "none"
+	if s.config.Type != MemoryBackend {
+		backup = fmt.Sprintf("%s.v%d.%d.bak", filepath.Clean(s.config.Path), pending[0].Version-1, time.Now().Unix())
+		if err := s.backup(backup); err != nil {
+			return err
+		}
+		slog.Info("storage backup", "path", backup)
+	}
+	for _, m := range pending {
+		batch := new(Batch)
+		if err := m.Migrate(s, batch); err != nil {
+			return fmt.Errorf("storage migration %d failed, the backup is in %s: %v", m.Version, backup, err)
+		}
+		batch.Put([]byte(schemaKey), []byte(strconv.Itoa(m.Version)))
+		if err := s.db.Write(batch); err != nil {
+			return fmt.Errorf("storage migration %d failed, the backup is in %s: %v", m.Version, backup, err)
+		}
+		slog.Info("storage migrated", "version", m.Version, "description", m.Description)
+	}
+	return nil
+}
+
+// backup copies a consistent view of every key into a new store of
+// the same type at path
+func (s *LocalStorage) backup(path string) error {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return fmt.Errorf("storage error creating backup: %v", err)
+	}
+	db, err := openBackend(s.config, path)
+	if err != nil {
+		return fmt.Errorf("storage error opening backup: %v", err)
+	}
+	defer db.Close()
+	batch := new(Batch)
+	iterErr := s.db.Iterate(nil, nil, false, func(k []byte, v []byte) bool {
+		batch.Put(k, v)
+		if batch.Len() >= 1000 {
+			if err = db.Write(batch); err != nil {
+				return false
+			}
+			batch.Reset()
+		}
+		return true
+	})
+	if err == nil && iterErr == nil {
+		err = db.Write(batch)
+	}
+	if err != nil || iterErr != nil {
+		return fmt.Errorf("storage error writing backup: %v %v", err, iterErr)
+	}
+	return nil
+}
+
+// migrateIndex replaces the single list of ids with index keys. The
+// list lost ids to racing updates, so every stored resource is indexed
+// rather than the ones it names.
+func migrateIndex(s *LocalStorage, batch *Batch) error {
+	var err error
+	iterErr := s.db.Iterate(key(&model.Resource{}), nil, false, func(k []byte, v []byte) bool {
+		r := &model.Resource{}
+		if err = json.Unmarshal(v, r); err != nil {
+			err = fmt.Errorf("storage error unmarshalling %s: %v", k, err)
+			return false
+		}
+		for _, k := range indexKeys(r) {
+			batch.Put(k, nil)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if iterErr != nil {
+		return fmt.Errorf("storage error reading the resources: %v", iterErr)
+	}
+	batch.Delete([]byte(legacyIndexKey))
+	return nil
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// legacyStore writes a store as it was before versioning, the backup
+// is written next to it so it gets its own directory
+func legacyStore(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "storage")
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("Resource|a"), []byte(`{"id":"a","uri":"u","status":3}`), nil)
+	// dropped from the list by a racing update
+	db.Put([]byte("Resource|b"), []byte(`{"id":"b","uri":"u","status":3}`), nil)
+	db.Put([]byte(legacyIndexKey), []byte(`{"name":"downloads","ids":["a","missing"]}`), nil)
+	db.Close()
+	return dir
+}
+
+func TestNewLocalStorage_MigratesLegacyIndex(t *testing.T) {
+	dir := legacyStore(t)
+	s, err := NewLocalStorage(&LocalStorageConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("NewLocalStorage() error = %v", err)
+	}
+	defer s.Close()
+	complete, err := s.ListResources(StatusIndex(model.DownloadComplete), nil, 0)
+	if err != nil || len(complete) != 2 {
+		t.Errorf("ListResources() = %v, %v, expected a and b, also missing from the list", complete, err)
+	}
+	if data, err := s.(*LocalStorage).db.Get([]byte(legacyIndexKey)); data != nil || err != nil {
+		t.Errorf("legacy index still present, error = %v", err)
+	}
+	if version, _ := s.Version(); version != SchemaVersion() {
+		t.Errorf("Version() = %d, expected %d", version, SchemaVersion())
+	}
+	backups, _ := filepath.Glob(dir + ".v0.*.bak")
+	if len(backups) != 1 {
+		t.Errorf("backups = %v, expected one", backups)
+	}
+}
+
+func TestNewLocalStorage_SkipMigrationsReportsPending(t *testing.T) {
+	s, err := NewLocalStorage(&LocalStorageConfig{Path: legacyStore(t), SkipMigrations: true})
+	if err != nil {
+		t.Fatalf("NewLocalStorage() error = %v", err)
+	}
+	defer s.Close()
+	pending, err := s.PendingMigrations()
+	if err != nil || len(pending) != len(migrations) {
+		t.Errorf("PendingMigrations() = %d, %v, expected %d", len(pending), err, len(migrations))
+	}
+}
+
+func TestNewLocalStorage_RefusesNewerSchema(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "storage")
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte(schemaKey), []byte("999"), nil)
+	db.Close()
+	if _, err := NewLocalStorage(&LocalStorageConfig{Path: dir}); err == nil {
+		t.Errorf("NewLocalStorage() error = nil, expected a downgrade error")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("store removed: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package storage
+
+// The outbox holds the events of a change in the same batch as the
+// change, a relay publishes them afterwards. A broker outage delays
+// the events but cannot fail or lose the change. New keys, the stored
+// resources keep their shape.
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"time"
+
+	"github.com/google/uuid"
+	appevents "github.com/matthogan/polypully-events"
+)
+
+// OutboxEvent is an event waiting to be published, in Seq order
+type OutboxEvent struct {
+	Seq uint64 `json:"seq"`
+	// sent with the event so a consumer can drop a repeat
+	Key           string    `json:"key"`
+	Type          string    `json:"type"`
+	Value         string    `json:"value"`
+	CorrelationId string    `json:"correlation_id,omitempty"`
+	ContentType   string    `json:"content_type"`
+	Created       time.Time `json:"created"`
+	// the trace of the change, the event is published in it
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+func (e *OutboxEvent) Identifier() string {
+	return fmt.Sprintf("%020d", e.Seq) // keys sort in sequence
+}
+
+// NewOutboxEvent is the event to publish in the trace of the carrier,
+// the sequence is assigned when it is stored. An event with an
+// event-id in its content type keeps it as its key.
+func NewOutboxEvent(event *appevents.Event, trace map[string]string) *OutboxEvent {
+	key := uuid.New().String()
+	if _, params, err := mime.ParseMediaType(event.ContentType); err == nil && params["event-id"] != "" {
+		key = params["event-id"]
+	}
+	return &OutboxEvent{
+		Key:           key,
+		Type:          event.Type,
+		Value:         event.Value,
+		CorrelationId: event.CorrelationId,
+		ContentType:   event.ContentType,
+		Created:       time.Now(),
+		Trace:         trace,
+	}
+}
+
+// Event to publish, the dedupe key is an event-id parameter of the
+// content type as the message has no headers
+func (e *OutboxEvent) Event() *appevents.Event {
+	contentType := e.ContentType
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	params["event-id"] = e.Key
+	contentType = mime.FormatMediaType(mediaType, params)
+	return &appevents.Event{Type: e.Type, Value: e.Value, CorrelationId: e.CorrelationId, ContentType: contentType}
+}
+
+// OutboxStats is how far the relay is behind
+type OutboxStats struct {
+	Pending int `json:"pending"`
+	// of the oldest pending event, zero when there is none
+	Oldest time.Time `json:"oldest"`
+}
+
+// addEvents numbers the events and adds them to the batch, the caller
+// holds the lock
+func (s *LocalStorage) addEvents(batch *Batch, events []*OutboxEvent) error {
+	if len(events) > 0 && s.seq == 0 {
+		if err := s.lastSeq(); err != nil {
+			return err
+		}
+	}
+	for _, e := range events {
+		s.seq++
+		e.Seq = s.seq
+		data, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("storage error marshalling event: %v", err)
+		}
+		batch.Put(key(e), data)
+	}
+	return nil
+}
+
+// lastSeq carries on from the last event stored
+func (s *LocalStorage) lastSeq() error {
+	var err error
+	iterErr := s.db.Iterate(outboxPrefix(), nil, true, func(_ []byte, v []byte) bool {
+		last := &OutboxEvent{}
+		if err = json.Unmarshal(v, last); err == nil {
+			s.seq = last.Seq
+		}
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("storage error reading the outbox: %v", err)
+	}
+	return iterErr
+}
+
+// Enqueue stores events that come with no change of a resource
+func (s *LocalStorage) Enqueue(events ...*OutboxEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	batch := new(Batch)
+	if err := s.addEvents(batch, events); err != nil {
+		return err
+	}
+	if err := s.db.Write(batch); err != nil {
+		return fmt.Errorf("storage error storing events: %v", err)
+	}
+	s.pending += len(events)
+	return nil
+}
+
+// PendingEvents returns up to limit events in the order they were
+// stored, 0 for no limit
+func (s *LocalStorage) PendingEvents(limit int) ([]*OutboxEvent, error) {
+	events := make([]*OutboxEvent, 0)
+	var err error
+	iterErr := s.db.Iterate(outboxPrefix(), nil, false, func(k []byte, v []byte) bool {
+		e := &OutboxEvent{}
+		if err = json.Unmarshal(v, e); err != nil {
+			err = fmt.Errorf("storage error unmarshalling %s: %v", k, err)
+			return false
+		}
+		events = append(events, e)
+		return limit <= 0 || len(events) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if iterErr != nil {
+		return nil, fmt.Errorf("storage error reading the outbox: %v", iterErr)
+	}
+	return events, nil
+}
+
+// RemoveEvents drops published events from the outbox
+func (s *LocalStorage) RemoveEvents(events ...*OutboxEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	batch := new(Batch)
+	for _, e := range events {
+		batch.Delete(key(e))
+	}
+	if err := s.db.Write(batch); err != nil {
+		return fmt.Errorf("storage error removing events: %v", err)
+	}
+	s.pending = max(s.pending-len(events), 0)
+	return nil
+}
+
+// Outbox counts the pending events once and keeps the count with the
+// writes after, a relay pass only reads the oldest event
+func (s *LocalStorage) Outbox() (*OutboxStats, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.counted {
+		pending := 0
+		if err := s.db.Iterate(outboxPrefix(), nil, false, func(_ []byte, _ []byte) bool {
+			pending++
+			return true
+		}); err != nil {
+			return nil, fmt.Errorf("storage error reading the outbox: %v", err)
+		}
+		s.pending, s.counted = pending, true
+	}
+	stats := &OutboxStats{}
+	found := false
+	var err error
+	iterErr := s.db.Iterate(outboxPrefix(), nil, false, func(k []byte, v []byte) bool {
+		found = true
+		e := &OutboxEvent{}
+		if err = json.Unmarshal(v, e); err != nil {
+			err = fmt.Errorf("storage error unmarshalling %s: %v", k, err)
+		}
+		stats.Oldest = e.Created
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if iterErr != nil {
+		return nil, fmt.Errorf("storage error reading the outbox: %v", iterErr)
+	}
+	if !found {
+		s.pending = 0
+	}
+	stats.Pending = s.pending
+	return stats, nil
+}
+
+func outboxPrefix() []byte {
+	return []byte("OutboxEvent|")
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"mime"
+	"testing"
+
+	appevents "github.com/matthogan/polypully-events"
+)
+
+func TestOutbox_SequenceCarriesOnAfterReopening(t *testing.T) {
+	dir := t.TempDir()
+	config := &LocalStorageConfig{Type: LevelDBBackend, Path: dir}
+	s, err := NewLocalStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Enqueue(NewOutboxEvent(appevents.NewServiceEvent("a"), nil), NewOutboxEvent(appevents.NewServiceEvent("b"), nil))
+	s.Close()
+
+	s, err = NewLocalStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Enqueue(NewOutboxEvent(appevents.NewServiceEvent("c"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := s.PendingEvents(0)
+	if len(pending) != 3 || pending[2].Value != "c" || pending[2].Seq != 3 {
+		t.Errorf("PendingEvents() = %v, expected c last with seq 3", pending)
+	}
+}
+
+func TestOutbox_KeepsTheCountWithTheWrites(t *testing.T) {
+	s, err := NewLocalStorage(&LocalStorageConfig{Type: MemoryBackend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Enqueue(NewOutboxEvent(appevents.NewServiceEvent("a"), nil), NewOutboxEvent(appevents.NewServiceEvent("b"), nil))
+	if stats, err := s.Outbox(); err != nil || stats.Pending != 2 {
+		t.Fatalf("Outbox() = %+v, %v, expected 2 pending", stats, err)
+	}
+	pending, _ := s.PendingEvents(0)
+	s.RemoveEvents(pending[0])
+	s.Enqueue(NewOutboxEvent(appevents.NewServiceEvent("c"), nil))
+	if stats, _ := s.Outbox(); stats.Pending != 2 || !stats.Oldest.Equal(pending[1].Created) {
+		t.Errorf("Outbox() = %+v, expected 2 pending from b", stats)
+	}
+	pending, _ = s.PendingEvents(0)
+	s.RemoveEvents(pending...)
+	if stats, _ := s.Outbox(); stats.Pending != 0 || !stats.Oldest.IsZero() {
+		t.Errorf("Outbox() = %+v, expected none", stats)
+	}
+}
+
+func TestOutboxEvent_CarriesItsKey(t *testing.T) {
+	e := NewOutboxEvent(appevents.NewDownloadEvent("complete", "id"), nil)
+	mediaType, params, err := mime.ParseMediaType(e.Event().ContentType)
+	if err != nil || mediaType != "text/plain" || params["event-id"] != e.Key {
+		t.Errorf("content type %q, expected text/plain with event-id %s", e.Event().ContentType, e.Key)
+	}
+}
+
+func TestOutboxEvent_KeepsTheIdOfTheEvent(t *testing.T) {
+	event := &appevents.Event{Type: "t", ContentType: "application/cloudevents+json; event-id=e1"}
+	if e := NewOutboxEvent(event, nil); e.Key != "e1" || e.Event().ContentType != event.ContentType {
+		t.Errorf("key %s content type %q, expected the event-id e1 kept", e.Key, e.Event().ContentType)
+	}
+}
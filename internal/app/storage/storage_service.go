@@ -6,18 +6,36 @@ import (
 
 var _ StorageApi = (*Storage)(nil)
 
-const (
-	DownloadsIndex = "downloads"
-)
-
 type Storage struct {
 	localStorage LocalStorageApi
 }
 
 type StorageApi interface {
-	UpdateResource(value *model.Resource) error
-	GetResource(id string) (*model.Resource, *Index, error)
+	// UpdateResource stores the download and the events of the change
+	// together, the events are published by the outbox relay
+	UpdateResource(value *model.Resource, events ...*OutboxEvent) error
+	// ChangeResource changes the stored download in place, false if
+	// it has been deleted
+	ChangeResource(id string, change func(r *model.Resource)) (bool, error)
+	GetResource(id string) (*model.Resource, error)
+	// ListResources returns the matching downloads, oldest first
 	ListResources(filter FilterResources) ([]*model.Resource, error)
+	// ListResourcesByStatus returns the matching downloads in a status
+	ListResourcesByStatus(status model.DownloadStatus, filter FilterResources) ([]*model.Resource, error)
+	DeleteResource(id string, events ...*OutboxEvent) error
+	// Enqueue stores events that come with no change of a download
+	Enqueue(events ...*OutboxEvent) error
+	// PendingEvents returns up to limit events still to publish, in order
+	PendingEvents(limit int) ([]*OutboxEvent, error)
+	// RemoveEvents drops the events once published
+	RemoveEvents(events ...*OutboxEvent) error
+	// Outbox reports the events waiting
+	Outbox() (*OutboxStats, error)
+	// CommandResource returns the download a stream command started, nil
+	// if it has not started one
+	CommandResource(commandId string) (*model.Resource, error)
+	// QueryResources returns one page of the filtered downloads
+	QueryResources(query *Query) (*Page, error)
 }
 
 func NewStorage(localStorage LocalStorageApi) StorageApi {
@@ -25,39 +43,77 @@ func NewStorage(localStorage LocalStorageApi) StorageApi {
 }
 
 func (s *Storage) ListResources(filter FilterResources) ([]*model.Resource, error) {
-	index, err := s.localStorage.GetIndex(DownloadsIndex)
-	if err != nil {
+	return s.localStorage.ListResources(TimeIndex(), filter, 0)
+}
+
+func (s *Storage) ListResourcesByStatus(status model.DownloadStatus, filter FilterResources) ([]*model.Resource, error) {
+	return s.localStorage.ListResources(StatusIndex(status), filter, 0)
+}
+
+func (s *Storage) GetResource(id string) (*model.Resource, error) {
+	return s.localStorage.GetResource(id)
+}
+
+func (s *Storage) UpdateResource(value *model.Resource, events ...*OutboxEvent) error {
+	return s.localStorage.PutResource(value, events...)
+}
+
+func (s *Storage) ChangeResource(id string, change func(r *model.Resource)) (bool, error) {
+	return s.localStorage.ChangeResource(id, change)
+}
+
+func (s *Storage) DeleteResource(id string, events ...*OutboxEvent) error {
+	return s.localStorage.DeleteResource(id, events...)
+}
+
+func (s *Storage) Enqueue(events ...*OutboxEvent) error {
+	return s.localStorage.Enqueue(events...)
+}
+
+func (s *Storage) PendingEvents(limit int) ([]*OutboxEvent, error) {
+	return s.localStorage.PendingEvents(limit)
+}
+
+func (s *Storage) RemoveEvents(events ...*OutboxEvent) error {
+	return s.localStorage.RemoveEvents(events...)
+}
+
+func (s *Storage) Outbox() (*OutboxStats, error) {
+	return s.localStorage.Outbox()
+}
+
+func (s *Storage) CommandResource(commandId string) (*model.Resource, error) {
+	resources, err := s.localStorage.ListResources(CommandIndex(commandId), nil, 1)
+	if err != nil || len(resources) == 0 {
 		return nil, err
 	}
-	return s.localStorage.ListResources(index, filter)
+	return resources[0], nil
 }
 
-func (s *Storage) GetResource(id string) (*model.Resource, *Index, error) {
-	r, err := s.localStorage.GetResource(id)
-	if err != nil {
-		return nil, nil, err
+// QueryResources walks the time index from the cursor and reads one
+// more than the limit to know whether there is a next page
+func (s *Storage) QueryResources(query *Query) (*Page, error) {
+	index := TimeIndex()
+	index.Reverse = query.Descending
+	if query.Cursor != "" {
+		after, err := parseCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		index.After = after
 	}
-	i, err := s.localStorage.GetIndex(DownloadsIndex)
-	if err != nil {
-		return nil, nil, err
+	limit := 0
+	if query.Limit > 0 {
+		limit = query.Limit + 1
 	}
-	return r, i, nil
-}
-
-func (s *Storage) UpdateResource(value *model.Resource) error {
-	index, err := s.localStorage.GetIndex(DownloadsIndex)
+	resources, err := s.localStorage.ListResources(index, query.Filter, limit)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ids := make([]string, 0)
-	for _, id := range index.Ids {
-		if id != value.Id {
-			ids = append(ids, id)
-		}
+	page := &Page{Resources: resources}
+	if query.Limit > 0 && len(resources) > query.Limit {
+		page.Resources = resources[:query.Limit]
+		page.Next = cursorOf(page.Resources[query.Limit-1])
 	}
-	// if value.Status != model.DownloadComplete {
-	ids = append(ids, value.Id)
-	// }
-	index.Ids = ids
-	return s.localStorage.PutResourceIndexed(value, index)
+	return page, nil
 }
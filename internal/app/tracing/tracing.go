@@ -0,0 +1,245 @@
+package tracing
+
+// OpenTelemetry tracing of the api, the downloads and their
+// fragments. Spans are exported over OTLP/HTTP or written out as
+// JSON for local debugging.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+
+	appevents "github.com/matthogan/polypully-events"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation scope of the spans
+const scope = "github.com/codejago/polypully/downloader"
+
+var _ TracingApi = (*Tracing)(nil)
+
+type TracingConfig struct {
+	Enable bool
+	// otlp, stdout or file
+	Exporter string
+	// host:port of the OTLP/HTTP collector
+	Endpoint string
+	// plain http to the collector
+	Insecure bool
+	// spans are appended to it by the file exporter
+	File string
+	// share of new traces recorded, a sampled parent is always followed
+	SampleRatio float64
+	ServiceName string
+}
+
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+	file     io.Closer
+}
+
+type TracingApi interface {
+	// Shutdown exports the spans still buffered
+	Shutdown(ctx context.Context) error
+}
+
+// NewTracing sets the global tracer provider and the W3C propagator.
+// Disabled, the spans cost next to nothing and go nowhere.
+func NewTracing(config *TracingConfig) (TracingApi, error) {
+	if !config.Enable {
+		return &Tracing{}, nil
+	}
+	t := &Tracing{}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "otlp":
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		var f *os.File
+		f, err = os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			break
+		}
+		t.file = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		err = fmt.Errorf("unknown exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the %s exporter: %v", config.Exporter, err)
+	}
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(config.ServiceName))))
+	otel.SetTracerProvider(t.provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return t, nil
+}
+
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	err := t.provider.Shutdown(ctx)
+	if t.file != nil {
+		t.file.Close()
+	}
+	return err
+}
+
+// Start a span under the one in the context
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(scope).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End the span, failed if there is an error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Middleware continues the trace of the caller from the W3C headers
+// of the request
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Request traces an outbound request within the span of its context,
+// its headers carry the trace on to the origin and the phases of the
+// connection are added to the span as events
+func Request(req *http.Request) *http.Request {
+	ctx := req.Context()
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req.WithContext(httptrace.WithClientTrace(ctx, ClientTrace(ctx)))
+}
+
+// ClientTrace adds DNS, connect, TLS and first byte events to the span
+// of the context
+func ClientTrace(ctx context.Context) *httptrace.ClientTrace {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return &httptrace.ClientTrace{}
+	}
+	failed := func(attrs []attribute.KeyValue, err error) []attribute.KeyValue {
+		if err != nil {
+			attrs = append(attrs, attribute.String("error", err.Error()))
+		}
+		return attrs
+	}
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			span.AddEvent("get conn", trace.WithAttributes(attribute.String("host", hostPort)))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			span.AddEvent("got conn", trace.WithAttributes(attribute.Bool("reused", info.Reused)))
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			span.AddEvent("dns start", trace.WithAttributes(attribute.String("host", info.Host)))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			addrs := make([]string, 0, len(info.Addrs))
+			for _, a := range info.Addrs {
+				addrs = append(addrs, a.String())
+			}
+			span.AddEvent("dns done", trace.WithAttributes(
+				failed([]attribute.KeyValue{attribute.StringSlice("addrs", addrs)}, info.Err)...))
+		},
+		ConnectStart: func(network, addr string) {
+			span.AddEvent("connect start", trace.WithAttributes(attribute.String("addr", addr)))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			span.AddEvent("connect done", trace.WithAttributes(
+				failed([]attribute.KeyValue{attribute.String("addr", addr)}, err)...))
+		},
+		TLSHandshakeStart: func() {
+			span.AddEvent("tls start")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			span.AddEvent("tls done", trace.WithAttributes(
+				failed([]attribute.KeyValue{attribute.String("version", tls.VersionName(state.Version))}, err)...))
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			span.AddEvent("wrote request", trace.WithAttributes(failed(nil, info.Err)...))
+		},
+		GotFirstResponseByte: func() {
+			span.AddEvent("first byte")
+		},
+	}
+}
+
+// Notify sends the event in a span of its own. The trace goes along
+// as parameters of the content type, text/plain; traceparent=...
+func Notify(ctx context.Context, events appevents.EventsApi, event *appevents.Event) error {
+	ctx, span := Start(ctx, "EventsApi.Notify",
+		attribute.String("event.type", event.Type),
+		attribute.String("event.value", event.Value),
+		attribute.String("event.correlation_id", event.CorrelationId))
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if carrier.Get("traceparent") != "" {
+		traced := *event
+		traced.ContentType = withTrace(event.ContentType, carrier)
+		event = &traced
+	}
+	err := events.Notify(event)
+	End(span, err)
+	return err
+}
+
+func withTrace(contentType string, carrier propagation.MapCarrier) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	for _, key := range []string{"traceparent", "tracestate"} {
+		if value := carrier.Get(key); value != "" {
+			params[key] = value
+		}
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// Carrier holds the trace of the context to carry on with it later,
+// nil when there is none
+func Carrier(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Resume carries on with the trace of a carrier
+func Resume(ctx context.Context, carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
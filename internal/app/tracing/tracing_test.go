@@ -0,0 +1,124 @@
+package tracing
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	appevents "github.com/matthogan/polypully-events"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func recorder(t *testing.T) *tracetest.SpanRecorder {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	return spans
+}
+
+func TestRequest_PropagatesToTheOrigin(t *testing.T) {
+	spans := recorder(t)
+	var traceparent string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer origin.Close()
+
+	// the caller's trace comes in through the middleware
+	caller := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled})
+	inbound := httptest.NewRequest(http.MethodPost, "/v1/downloads", nil)
+	otel.GetTextMapPropagator().Inject(trace.ContextWithRemoteSpanContext(context.Background(), caller),
+		propagation.HeaderCarrier(inbound.Header))
+	Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := Start(r.Context(), "DownloadSingleFragment")
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, origin.URL, nil)
+		resp, err := http.DefaultClient.Do(Request(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		End(span, nil)
+	})).ServeHTTP(httptest.NewRecorder(), inbound)
+
+	ended := spans.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d spans, expected 1", len(ended))
+	}
+	span := ended[0]
+	if span.Parent().SpanID() != caller.SpanID() || span.SpanContext().TraceID() != caller.TraceID() {
+		t.Errorf("span is not a child of the caller: %v", span.Parent())
+	}
+	expected := "00-" + caller.TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+	if traceparent != expected {
+		t.Errorf("origin got traceparent %q, expected %q", traceparent, expected)
+	}
+	events := map[string]bool{}
+	for _, e := range span.Events() {
+		events[e.Name] = true
+	}
+	for _, name := range []string{"connect start", "connect done", "wrote request", "first byte"} {
+		if !events[name] {
+			t.Errorf("no %q event in %v", name, span.Events())
+		}
+	}
+}
+
+type events struct {
+	appevents.Dummy
+	sent []*appevents.Event
+}
+
+func (e *events) Notify(event *appevents.Event) error {
+	e.sent = append(e.sent, event)
+	return nil
+}
+
+func TestNotify_CarriesTheTrace(t *testing.T) {
+	spans := recorder(t)
+	ctx, parent := Start(context.Background(), "Download")
+	sink := &events{}
+	event := appevents.NewDownloadEvent("complete", "id")
+	if err := Notify(ctx, sink, event); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	if event.ContentType != "text/plain" {
+		t.Errorf("the event given was changed: %q", event.ContentType)
+	}
+	mediaType, params, err := mime.ParseMediaType(sink.sent[0].ContentType)
+	if err != nil || mediaType != "text/plain" {
+		t.Fatalf("content type %q: %v", sink.sent[0].ContentType, err)
+	}
+	notify := spans.Ended()[0]
+	if notify.Name() != "EventsApi.Notify" || notify.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("got span %q under %v", notify.Name(), notify.Parent())
+	}
+	expected := "00-" + notify.SpanContext().TraceID().String() + "-" + notify.SpanContext().SpanID().String() + "-01"
+	if params["traceparent"] != expected {
+		t.Errorf("traceparent is %q, expected %q", params["traceparent"], expected)
+	}
+}
+
+func TestNotify_Untraced(t *testing.T) {
+	sink := &events{}
+	if err := Notify(context.Background(), sink, appevents.NewServiceEvent("started")); err != nil {
+		t.Fatal(err)
+	}
+	if sink.sent[0].ContentType != "text/plain" {
+		t.Errorf("content type is %q, expected text/plain", sink.sent[0].ContentType)
+	}
+}
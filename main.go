@@ -33,6 +33,11 @@ func main() {
 
 	rootCmd.AddCommand(cmd.StartCmd())
 	rootCmd.AddCommand(cmd.Config())
+	rootCmd.AddCommand(cmd.GcCmd())
+	rootCmd.AddCommand(cmd.StorageCmd())
+	rootCmd.AddCommand(cmd.GetCmd())
+	rootCmd.AddCommand(cmd.ClientCmd())
+	rootCmd.AddCommand(cmd.VerifyCmd())
 
 	co.Load()
 
@@ -45,5 +50,6 @@ func main() {
 func finally() {
 	if err := recover(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,293 @@
+// Package client is a typed client of the downloader REST API, as
+// described by api/openapi.yaml, for the CLI and for other services.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The statuses a download goes through
+const (
+	StatusInitializing = "initializing"
+	StatusRunning      = "running"
+	StatusComplete     = "complete"
+	StatusError        = "error"
+	StatusInitError    = "init_error"
+	StatusCancelled    = "cancelled"
+	StatusPaused       = "paused"
+)
+
+// Finished is true for the statuses a download stays in unless it
+// is resumed
+func Finished(status string) bool {
+	switch status {
+	case StatusComplete, StatusError, StatusInitError, StatusCancelled, StatusPaused:
+		return true
+	}
+	return false
+}
+
+var _ ClientApi = (*Client)(nil)
+
+// ClientApi is the downloader REST API
+type ClientApi interface {
+	// Add requests a new download
+	Add(ctx context.Context, request *DownloadRequest) (*DownloadStatus, error)
+	// List a page of downloads, the next page is at Page.Next
+	List(ctx context.Context, options *ListOptions) (*Page, error)
+	// Get the status of a download
+	Get(ctx context.Context, id string) (*DownloadStatus, error)
+	// Pause a running download, keeping what it has so far
+	Pause(ctx context.Context, id string) error
+	// Resume a paused or failed download
+	Resume(ctx context.Context, id string) error
+	// Cancel a running or paused download
+	Cancel(ctx context.Context, id string) error
+	// Delete a download and its files, optionally keeping the file
+	Delete(ctx context.Context, id string, keepFile bool) error
+}
+
+type DownloadRequest struct {
+	Url    string            `json:"url"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type DownloadStatus struct {
+	DownloadId      string            `json:"downloadId"`
+	Url             string            `json:"url"`
+	Status          string            `json:"status"`
+	BytesDownloaded int64             `json:"bytesDownloaded,omitempty"`
+	TotalSize       int64             `json:"totalSize,omitempty"` // 0 if unknown
+	ElapsedMS       int64             `json:"elapsedMS,omitempty"`
+	Progress        int               `json:"progress,omitempty"` // percent, 0 if unknown
+	StartTime       time.Time         `json:"startTime,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// ListOptions filter and order the downloads, zero values are left
+// to the service
+type ListOptions struct {
+	Status    string
+	UrlPrefix string
+	Since     time.Time // inclusive
+	Until     time.Time // exclusive
+	Labels    map[string]string
+	Oldest    bool // oldest first instead of newest
+	Limit     int
+	Cursor    string // from Page.Next
+}
+
+type Page struct {
+	Downloads []DownloadStatus
+	// cursor of the next page, empty on the last one
+	Next string
+}
+
+// Error is a response other than the one expected
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s", http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound is true if the download does not exist
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+type ClientConfig struct {
+	// Address of the service, such as http://127.0.0.1:8080
+	Address string
+	// Timeout of each request, none if 0
+	Timeout time.Duration
+	// HttpClient replaces the default client, for TLS or tracing
+	HttpClient *http.Client
+}
+
+type Client struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func NewClient(config *ClientConfig) (ClientApi, error) {
+	base, err := url.Parse(strings.TrimSuffix(config.Address, "/") + "/v1")
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %v", config.Address, err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid address %q: expected http or https", config.Address)
+	}
+	client := config.HttpClient
+	if client == nil {
+		client = &http.Client{Timeout: config.Timeout}
+	}
+	return &Client{base: base, client: client}, nil
+}
+
+func (c *Client) Add(ctx context.Context, request *DownloadRequest) (*DownloadStatus, error) {
+	status := &DownloadStatus{}
+	if _, err := c.do(ctx, http.MethodPost, "/downloads", nil, request, status, http.StatusOK, http.StatusAccepted); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// the cursor of the next page is in the Link header
+var nextLink = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="next"`)
+
+func (c *Client) List(ctx context.Context, options *ListOptions) (*Page, error) {
+	if options == nil {
+		options = &ListOptions{}
+	}
+	query := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	set("status", options.Status)
+	set("url", options.UrlPrefix)
+	if !options.Since.IsZero() {
+		set("since", options.Since.Format(time.RFC3339))
+	}
+	if !options.Until.IsZero() {
+		set("until", options.Until.Format(time.RFC3339))
+	}
+	// a label a parameter of its own, a value can hold a comma
+	for k, v := range options.Labels {
+		query.Add("label", k+":"+v)
+	}
+	if options.Oldest {
+		set("sort", "startTime")
+	}
+	if options.Limit > 0 {
+		set("limit", strconv.Itoa(options.Limit))
+	}
+	set("cursor", options.Cursor)
+	page := &Page{Downloads: make([]DownloadStatus, 0)}
+	header, err := c.do(ctx, http.MethodGet, "/downloads", query, nil, &page.Downloads, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	if m := nextLink.FindStringSubmatch(header.Get("Link")); m != nil {
+		if next, err := url.Parse(m[1]); err == nil {
+			page.Next = next.Query().Get("cursor")
+		}
+	}
+	return page, nil
+}
+
+func (c *Client) Get(ctx context.Context, id string) (*DownloadStatus, error) {
+	status := &DownloadStatus{}
+	if _, err := c.do(ctx, http.MethodGet, "/downloads/"+url.PathEscape(id), nil, nil, status, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *Client) Pause(ctx context.Context, id string) error {
+	return c.update(ctx, id, "pause")
+}
+
+func (c *Client) Resume(ctx context.Context, id string) error {
+	return c.update(ctx, id, "resume")
+}
+
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	return c.update(ctx, id, "cancel")
+}
+
+func (c *Client) update(ctx context.Context, id string, action string) error {
+	_, err := c.do(ctx, http.MethodPatch, "/downloads/"+url.PathEscape(id), nil,
+		map[string]string{"action": action}, nil, http.StatusAccepted)
+	return err
+}
+
+func (c *Client) Delete(ctx context.Context, id string, keepFile bool) error {
+	var query url.Values
+	if keepFile {
+		query = url.Values{"keepFile": {"true"}}
+	}
+	_, err := c.do(ctx, http.MethodDelete, "/downloads/"+url.PathEscape(id), query, nil, nil, http.StatusNoContent)
+	return err
+}
+
+// do sends the body as JSON and decodes the response into out when
+// the status is one of those expected
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body any, out any,
+	expected ...int) (http.Header, error) {
+	u := *c.base
+	u.Path += path
+	u.RawQuery = query.Encode()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expected {
+		if resp.StatusCode != code {
+			continue
+		}
+		if out != nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, fmt.Errorf("invalid response from %s %s: %v", method, u.Path, err)
+			}
+		}
+		return resp.Header, nil
+	}
+	return nil, &Error{StatusCode: resp.StatusCode, Message: errorMessage(data)}
+}
+
+// errorMessage reads the error body, the service sends a JSON string
+// but the spec also allows {"message": ...}
+func errorMessage(data []byte) string {
+	var message string
+	if json.Unmarshal(data, &message) == nil {
+		return message
+	}
+	var e struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &e) == nil {
+		return e.Message
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a service with five downloads, two to a page
+func newService(t *testing.T) ClientApi {
+	ids := []string{"a", "b", "c", "d", "e"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/downloads", func(w http.ResponseWriter, r *http.Request) {
+		start := 0
+		if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+			fmt.Sscan(cursor, &start)
+		}
+		end := min(start+2, len(ids))
+		page := make([]DownloadStatus, 0)
+		for _, id := range ids[start:end] {
+			page = append(page, DownloadStatus{DownloadId: id, Status: StatusComplete})
+		}
+		if end < len(ids) {
+			w.Header().Set("Link", fmt.Sprintf(`</v1/downloads?limit=2&cursor=%d>; rel="next"`, end))
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("/v1/downloads/a", func(w http.ResponseWriter, r *http.Request) {
+		var update map[string]string
+		json.NewDecoder(r.Body).Decode(&update)
+		if r.Method != http.MethodPatch || update["action"] != "pause" {
+			t.Errorf("%s %v, expected PATCH pause", r.Method, update)
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode("a complete download cannot be paused")
+	})
+	service := httptest.NewServer(mux)
+	t.Cleanup(service.Close)
+	c, err := NewClient(&ClientConfig{Address: service.URL})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	return c
+}
+
+func TestList_FollowsTheNextLink(t *testing.T) {
+	c := newService(t)
+	seen := ""
+	options := &ListOptions{Limit: 2}
+	for pages := 0; pages < 5; pages++ {
+		page, err := c.List(context.Background(), options)
+		if err != nil {
+			t.Fatalf("List() error = %v", err)
+		}
+		for _, d := range page.Downloads {
+			seen += d.DownloadId
+		}
+		if page.Next == "" {
+			break
+		}
+		options.Cursor = page.Next
+	}
+	if seen != "abcde" {
+		t.Errorf("List() = %s, expected abcde", seen)
+	}
+}
+
+func TestList_SendsALabelParameterEach(t *testing.T) {
+	var labels []string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labels = r.URL.Query()["label"]
+		json.NewEncoder(w).Encode([]DownloadStatus{})
+	}))
+	t.Cleanup(service.Close)
+	c, err := NewClient(&ClientConfig{Address: service.URL})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if _, err := c.List(context.Background(), &ListOptions{Labels: map[string]string{"team": "a,b"}}); err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(labels) != 1 || labels[0] != "team:a,b" {
+		t.Errorf("List() sent labels %q, expected team:a,b", labels)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	c := newService(t)
+	err := c.Pause(context.Background(), "a")
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusConflict || e.Message != "a complete download cannot be paused" {
+		t.Errorf("Pause() error = %v, expected the conflict", err)
+	}
+	if _, err := c.Get(context.Background(), "missing"); !IsNotFound(err) {
+		t.Errorf("Get() error = %v, expected not found", err)
+	}
+	if _, err := NewClient(&ClientConfig{Address: "localhost:8080"}); err == nil {
+		t.Error("NewClient() without a scheme, expected an error")
+	}
+}
@@ -0,0 +1,183 @@
+// Package manifest is the record written next to every completed
+// download, documented by api/manifest.schema.json. It describes the
+// artefact and where it came from well enough to check the file
+// later without the downloader's store.
+package manifest
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version of the format written, readers refuse anything newer.
+// Adding optional fields does not change it.
+const Version = 1
+
+// ErrUnversioned is returned for manifests written before the format
+// was versioned, which are the downloader's internal record
+var ErrUnversioned = errors.New("manifest has no version")
+
+type Manifest struct {
+	ManifestVersion int               `json:"manifestVersion"`
+	Id              string            `json:"id"` // of the download
+	Artefact        Artefact          `json:"artefact"`
+	Source          Source            `json:"source"`
+	Digests         map[string]string `json:"digests"` // algorithm to lower case hex
+	Fragments       []Fragment        `json:"fragments"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	StartTime       time.Time         `json:"startTime"`
+	EndTime         time.Time         `json:"endTime"`
+}
+
+type Artefact struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"` // where it was written
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type Source struct {
+	Url        string     `json:"url"`
+	Validators Validators `json:"validators"`
+}
+
+// Validators the origin sent, to tell whether it has changed since
+type Validators struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// Fragment is a byte range of the artefact, inclusive, fetched on
+// its own
+type Fragment struct {
+	Index int   `json:"index"`
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+var algorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Parse decodes a manifest, ErrUnversioned if it has no version
+func Parse(data []byte) (*Manifest, error) {
+	// the version decides how the rest reads
+	var version struct {
+		ManifestVersion int `json:"manifestVersion"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return nil, err
+	}
+	if version.ManifestVersion == 0 {
+		return nil, ErrUnversioned
+	}
+	if version.ManifestVersion > Version {
+		return nil, fmt.Errorf("manifest version %d is newer than %d", version.ManifestVersion, Version)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func Read(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// Write the manifest with the fragments in order
+func (m *Manifest) Write(path string, mode fs.FileMode) error {
+	m.ManifestVersion = Version
+	sort.Slice(m.Fragments, func(i, j int) bool { return m.Fragments[i].Index < m.Fragments[j].Index })
+	data, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), mode)
+}
+
+// Locate finds the artefact where it was written or, for a tree that
+// has been moved, next to the manifest
+func (m *Manifest) Locate(manifest string) (string, error) {
+	if _, err := os.Stat(m.Artefact.Path); err == nil {
+		return m.Artefact.Path, nil
+	}
+	moved := filepath.Join(filepath.Dir(manifest), m.Artefact.Name)
+	if _, err := os.Stat(moved); err == nil {
+		return moved, nil
+	}
+	return "", fmt.Errorf("%s not found at %s or next to the manifest", m.Artefact.Name, m.Artefact.Path)
+}
+
+// Check is one property of the file compared with the manifest
+type Check struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (c *Check) Ok() bool {
+	return c.Expected == c.Actual
+}
+
+// Verify compares the size and every digest of the file with the
+// manifest. A manifest without a digest fails, it proves nothing.
+func (m *Manifest) Verify(file string) ([]Check, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names := make([]string, 0, len(m.Digests))
+	for name := range m.Digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hashes := make([]hash.Hash, 0, len(names))
+	writers := make([]io.Writer, 0, len(names))
+	for _, name := range names {
+		newHash, ok := algorithms[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported digest %s", name)
+		}
+		h := newHash()
+		hashes = append(hashes, h)
+		writers = append(writers, h)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), f)
+	if err != nil {
+		return nil, err
+	}
+	checks := []Check{{Name: "size", Expected: fmt.Sprint(m.Artefact.Size), Actual: fmt.Sprint(size)}}
+	for i, name := range names {
+		checks = append(checks, Check{Name: name, Expected: strings.ToLower(m.Digests[name]),
+			Actual: hex.EncodeToString(hashes[i].Sum(nil))})
+	}
+	if len(names) == 0 {
+		checks = append(checks, Check{Name: "digest", Expected: "any", Actual: "none"})
+	}
+	return checks, nil
+}
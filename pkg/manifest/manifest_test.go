@@ -0,0 +1,64 @@
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReadVerify(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.bin")
+	if err := os.WriteFile(file, []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{
+		Id:       "a",
+		Artefact: Artefact{Name: "a.bin", Path: file, Size: 3},
+		Digests: map[string]string{
+			"sha256": "BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD",
+			"sha1":   "0000000000000000000000000000000000000000"},
+		Fragments: []Fragment{{Index: 1, Start: 2, End: 2}, {Index: 0, Start: 0, End: 1}},
+	}
+	path := filepath.Join(dir, "manifest.json")
+	if err := m.Write(path, 0o644); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	read, err := Read(path)
+	if err != nil || read.ManifestVersion != Version || read.Fragments[0].Index != 0 {
+		t.Fatalf("Read() = %+v, %v, expected the version and the fragments in order", read, err)
+	}
+	checks, err := read.Verify(file)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	ok := make(map[string]bool)
+	for _, c := range checks {
+		ok[c.Name] = c.Ok()
+	}
+	if !ok["size"] || ok["sha1"] || !ok["sha256"] {
+		t.Errorf("Verify() = %+v, expected size and sha256 to match and sha1 not to", checks)
+	}
+}
+
+func TestParse_Versions(t *testing.T) {
+	if _, err := Parse([]byte(`{"id":"a","fragments":{"0":{}}}`)); !errors.Is(err, ErrUnversioned) {
+		t.Errorf("Parse() unversioned error = %v, expected %v", err, ErrUnversioned)
+	}
+	if _, err := Parse([]byte(`{"manifestVersion":2}`)); err == nil {
+		t.Error("Parse() of a newer version, expected an error")
+	}
+}
+
+func TestLocate_NextToTheManifest(t *testing.T) {
+	dir := t.TempDir()
+	moved := filepath.Join(dir, "a.bin")
+	if err := os.WriteFile(moved, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Artefact: Artefact{Name: "a.bin", Path: "/elsewhere/a.bin"}}
+	if file, err := m.Locate(filepath.Join(dir, "manifest.json")); err != nil || file != moved {
+		t.Errorf("Locate() = %s, %v, expected %s", file, err, moved)
+	}
+}
@@ -0,0 +1,9 @@
+Feature: Download Commands
+    As a service
+    I want to refuse download commands that the api would refuse
+    So that a bad command is answered and not delivered again
+
+    Scenario: Refusing a download command without a url
+        Given I have received a download event without a url
+        When the command is consumed
+        Then the command should be rejected and committed
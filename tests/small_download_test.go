@@ -1,13 +1,28 @@
 package tests
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/codejago/polypully/downloader/internal/app/disk"
+	"github.com/codejago/polypully/downloader/internal/app/inbound"
+	"github.com/codejago/polypully/downloader/internal/app/message"
+	"github.com/codejago/polypully/downloader/internal/app/metrics"
+	"github.com/codejago/polypully/downloader/internal/app/model"
+	"github.com/codejago/polypully/downloader/internal/app/service"
+	"github.com/codejago/polypully/downloader/internal/app/storage"
 	"github.com/cucumber/godog"
 	"github.com/cucumber/godog/colors"
+	appevents "github.com/matthogan/polypully-events"
+	"github.com/spf13/viper"
 )
 
 var opts = godog.Options{
@@ -39,24 +54,167 @@ func TestFeatures(t *testing.T) {
 	}
 }
 
-func iDownloadTheFile() error {
-	return godog.ErrPending
+// a small file is below the minimum fragment size
+var smallFile = bytes.Repeat([]byte("polypully"), 100)
+
+// scenario runs the service offline, the commands arrive on a stream in
+// memory and the origin is local
+type scenario struct {
+	origin   *httptest.Server
+	stream   inbound.MemoryApi
+	storage  storage.StorageApi
+	stop     context.CancelFunc
+	reply    *service.Reply
+	download *model.Resource
+}
+
+func (s *scenario) iHaveReceivedADownloadEventForASmallFile() error {
+	s.origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "small.bin", time.Time{}, bytes.NewReader(smallFile))
+	}))
+	if err := s.start(); err != nil {
+		return err
+	}
+	return s.stream.SendCommand(&inbound.Command{Id: "c1", Action: "download", Url: s.origin.URL + "/small.bin"})
 }
 
-func iHaveReceivedADownloadEventForASmallFile() error {
-	return godog.ErrPending
+// start with an empty store and stream
+func (s *scenario) start() error {
+	local, err := storage.NewLocalStorage(&storage.LocalStorageConfig{Type: storage.MemoryBackend})
+	if err != nil {
+		return err
+	}
+	s.storage = storage.NewStorage(local)
+	s.stream = inbound.NewMemory(10 * time.Millisecond)
+	return nil
+}
+
+func (s *scenario) iHaveReceivedADownloadEventWithoutAUrl() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	return s.stream.SendCommand(&inbound.Command{Id: "c1", Action: "download"})
 }
 
-func theFileShouldBeDownloadedAsASingleFragment() error {
-	return godog.ErrPending
+// consume starts the service on the stream
+func (s *scenario) consume() error {
+	events, _ := appevents.NewEvents(&appevents.EventsConfig{Enabled: false})
+	metrics := metrics.NewMetrics(metrics.MetricsConfig{})
+	monitor := disk.NewMonitor(&disk.MonitorConfig{Path: viper.GetString("download.directory")}, metrics)
+	api := service.NewApiService(events, s.storage, monitor, service.NewRegistry(), metrics)
+	ctx, stop := context.WithCancel(context.Background())
+	s.stop = stop
+	go s.stream.Consume(ctx, service.NewCommandHandler(api, s.storage))
+	var err error
+	s.reply, err = s.awaitReply("c1")
+	return err
+}
+
+func (s *scenario) theCommandShouldBeRejectedAndCommitted() error {
+	if s.reply.Result != "rejected" || s.reply.Error == "" {
+		return fmt.Errorf("command %s, expected it rejected with the reason", s.reply.Result)
+	}
+	return nil
+}
+
+func (s *scenario) iDownloadTheFile() error {
+	if err := s.consume(); err != nil {
+		return err
+	}
+	if s.reply.Result != "accepted" {
+		return fmt.Errorf("command %s: %s", s.reply.Result, s.reply.Error)
+	}
+	// the reply names the download
+	downloadId := s.reply.DownloadId
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		r, err := s.storage.GetResource(downloadId)
+		if err != nil {
+			return err
+		}
+		if r != nil && r.Status != model.DownloadInitialising && r.Status != model.DownloadRunning {
+			s.download = r
+			return nil
+		}
+	}
+	return fmt.Errorf("download %s did not finish", downloadId)
+}
+
+// awaitReply waits for a command to be committed and returns its reply
+func (s *scenario) awaitReply(command string) (*service.Reply, error) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if s.stream.Committed() != 1 {
+			continue
+		}
+		pending, err := s.storage.PendingEvents(0)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range pending {
+			if e.Type != message.CommandReplyType || e.CorrelationId != command {
+				continue
+			}
+			envelope := struct{ Data *service.Reply }{}
+			if err := json.Unmarshal([]byte(e.Value), &envelope); err != nil {
+				return nil, err
+			}
+			return envelope.Data, nil
+		}
+	}
+	return nil, fmt.Errorf("command %s was not replied to and committed", command)
+}
+
+func (s *scenario) theFileShouldBeDownloadedAsASingleFragment() error {
+	if s.download.Status != model.DownloadComplete {
+		return fmt.Errorf("download is %s, expected complete", s.download.Status)
+	}
+	if len(s.download.Fragments) != 1 {
+		return fmt.Errorf("downloaded in %d fragments, expected 1", len(s.download.Fragments))
+	}
+	data, err := os.ReadFile(s.download.File)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, smallFile) {
+		return fmt.Errorf("%s differs from the origin", s.download.File)
+	}
+	return nil
+}
+
+func (s *scenario) close() {
+	if s.stop != nil {
+		s.stop()
+	}
+	if s.origin != nil {
+		s.origin.Close()
+	}
 }
 
 func InitializeScenario(ctx *godog.ScenarioContext) {
-	ctx.Step(`^I download the file$`, iDownloadTheFile)
-	ctx.Step(`^I have received a download event for a small file$`, iHaveReceivedADownloadEventForASmallFile)
-	ctx.Step(`^the file should be downloaded as a single fragment$`, theFileShouldBeDownloadedAsASingleFragment)
+	s := &scenario{}
+	ctx.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		s.close()
+		return ctx, nil
+	})
+	ctx.Step(`^I download the file$`, s.iDownloadTheFile)
+	ctx.Step(`^I have received a download event for a small file$`, s.iHaveReceivedADownloadEventForASmallFile)
+	ctx.Step(`^the file should be downloaded as a single fragment$`, s.theFileShouldBeDownloadedAsASingleFragment)
+	ctx.Step(`^I have received a download event without a url$`, s.iHaveReceivedADownloadEventWithoutAUrl)
+	ctx.Step(`^the command is consumed$`, s.consume)
+	ctx.Step(`^the command should be rejected and committed$`, s.theCommandShouldBeRejectedAndCommitted)
 }
 
 func InitializeTestSuite(ctx *godog.TestSuiteContext) {
-	ctx.BeforeSuite(func() { fmt.Println("Get the party started!") })
+	var directory string
+	ctx.BeforeSuite(func() {
+		directory, _ = os.MkdirTemp("", "downloads")
+		viper.Set("download.directory", directory)
+		viper.Set("download.max-conc-fragments", 4)
+		viper.Set("download.min-fragment-size", 1000000)
+		viper.Set("download.max-fragment-size", 5000000)
+		viper.Set("download.buffer-size", 81920)
+		viper.Set("download.path-template", "%s/%s")
+		viper.Set("download.filemode", 0o644)
+		viper.Set("download.redirects", 5)
+	})
+	ctx.AfterSuite(func() { os.RemoveAll(directory) })
 }